@@ -0,0 +1,246 @@
+//    Copyright 2015 Cloud Security Alliance EMEA (cloudsecurityalliance.org)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// ctpscript evaluates a CTPScript expression, such as a measurement
+// objective or a trigger condition, against a measurement result read from
+// a JSON file, without a ctpd server or a database.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/cloudsecurityalliance/ctpd/server"
+	"github.com/cloudsecurityalliance/ctpd/server/jsmm"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+var (
+	resultFlag      string
+	disassembleFlag bool
+	traceFlag       bool
+	interactiveFlag bool
+	setFlag         string
+)
+
+// An input holds the measurement data that expressions are evaluated
+// against.
+type input struct {
+	Result     *server.Result             `json:"result"`
+	History    []server.MeasurementResult `json:"history"`
+	Parameters map[string]interface{}     `json:"parameters"`
+}
+
+// loadResult reads a measurement result in the JSON format used by the CTP
+// API. The file may also hold a whole measurement, in which case its
+// "result" property is used. Previous results, if any, are read from the
+// "history" property, the most recent first, and parameter values from the
+// "parameters" property.
+func loadResult(fname string) (*input, error) {
+	var measurement input
+	var result server.Result
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &measurement); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s", fname, err.Error())
+	}
+	if measurement.Result != nil {
+		return &measurement, nil
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s", fname, err.Error())
+	}
+	measurement.Result = &result
+	return &measurement, nil
+}
+
+func printError(w io.Writer, err error) {
+	fmt.Fprintf(w, "error: %s\n", err.Error())
+	if serr, ok := err.(jsmm.SourceError); ok {
+		if _, located := serr.Position(); located {
+			fmt.Fprintln(w, serr.Excerpt())
+		}
+	}
+}
+
+// importInput sets the global variables of machine from in.
+func importInput(machine *jsmm.Machine, in *input) error {
+	if err := server.ImportMeasurementResultInJSMM(machine, in.Result); err != nil {
+		return err
+	}
+	if err := server.ImportResultHistoryInJSMM(machine, in.History); err != nil {
+		return err
+	}
+	return server.ImportMeasurementParametersInJSMM(machine, in.Parameters)
+}
+
+// printTraceStep prints an instruction executed by a machine, with the
+// position of the source it was compiled from and the value it left on top
+// of the stack, if any.
+func printTraceStep(w io.Writer, step jsmm.TraceStep) {
+	fmt.Fprintf(w, "%4d  %-14s %3d:%-3d  depth %d", step.PC, step.Op, step.Position.Line, step.Position.Column, step.Depth)
+	if step.Type != "" {
+		fmt.Fprintf(w, "  %s %s", step.Type, step.Top)
+	}
+	fmt.Fprintln(w)
+}
+
+// evaluate compiles and runs expr, printing either the result on out or the
+// exception on errOut, where the trace also goes. It returns false if expr
+// could not be evaluated.
+func evaluate(out io.Writer, errOut io.Writer, expr string, in *input, disassemble bool, trace bool) bool {
+	machine, err := jsmm.Compile(expr)
+	if err != nil {
+		printError(errOut, err)
+		return false
+	}
+	machine.EnableFunctions(jsmm.FunctionSet(setFlag))
+
+	if disassemble {
+		jsmm.DumpCode(out, machine)
+		return true
+	}
+
+	if err := importInput(machine, in); err != nil {
+		printError(errOut, err)
+		return false
+	}
+
+	if trace {
+		machine.SetTracer(func(step jsmm.TraceStep) {
+			printTraceStep(errOut, step)
+		})
+	}
+	v, exception := machine.Execute()
+	if exception != nil {
+		printError(errOut, exception)
+		return false
+	}
+	if v == nil {
+		fmt.Fprintln(out, "(no value)")
+	} else if v.Type() == jsmm.TypeFunction {
+		fmt.Fprintln(out, v.ToString())
+	} else {
+		fmt.Fprintln(out, v.ToJSON())
+	}
+	return true
+}
+
+func printFunctions() {
+	for _, fn := range jsmm.DefaultRegistry.Functions(jsmm.BuiltinFunctions, jsmm.FunctionSet(setFlag)) {
+		fmt.Printf("  %-14s %s\n", fn.Name, fn.Doc)
+	}
+}
+
+const replHelp = `Enter an expression to evaluate it, or one of the following commands:
+  :dis EXPR       show the compiled code of EXPR
+  :trace on|off   trace the execution of each instruction
+  :result FILE    evaluate the next expressions against the result in FILE
+  :functions      list the functions available to expressions
+  :help           show this help
+  :quit           leave ctpscript`
+
+func repl(in *input) {
+	trace := traceFlag
+	scanner := bufio.NewScanner(os.Stdin)
+
+	fmt.Println("ctpscript, type :help for help.")
+	for {
+		fmt.Print("> ")
+		if !scanner.Scan() {
+			fmt.Println()
+			return
+		}
+		line := strings.TrimSpace(scanner.Text())
+		command, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i > 0 {
+			command, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch command {
+		case "":
+		case ":quit", ":q":
+			return
+		case ":help", ":h":
+			fmt.Println(replHelp)
+		case ":dis":
+			evaluate(os.Stdout, os.Stderr, arg, in, true, false)
+		case ":functions":
+			printFunctions()
+		case ":trace":
+			trace = arg != "off"
+			fmt.Printf("trace is %v\n", trace)
+		case ":result":
+			loaded, err := loadResult(arg)
+			if err != nil {
+				printError(os.Stderr, err)
+			} else {
+				in = loaded
+			}
+		default:
+			if strings.HasPrefix(command, ":") {
+				fmt.Fprintf(os.Stderr, "Unknown command %s, type :help for help.\n", command)
+			} else {
+				evaluate(os.Stdout, os.Stderr, line, in, false, trace)
+			}
+		}
+	}
+}
+
+func main() {
+	flag.StringVar(&resultFlag, "result", "", "JSON file holding the measurement result that the expression is evaluated against.")
+	flag.BoolVar(&disassembleFlag, "d", false, "Print the compiled code of the expression instead of evaluating it.")
+	flag.BoolVar(&traceFlag, "trace", false, "Trace the execution of each instruction on standard error.")
+	flag.BoolVar(&interactiveFlag, "i", false, "Read and evaluate expressions interactively.")
+	flag.StringVar(&setFlag, "functions", string(jsmm.ObjectiveFunctions), "Set of host functions enabled in addition to the builtin ones: objective, trigger or admin.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: ctpscript [options] [expression]\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	log.SetFlags(0)
+	log.SetOutput(os.Stderr)
+
+	in := new(input)
+	if resultFlag != "" {
+		var err error
+
+		if in, err = loadResult(resultFlag); err != nil {
+			printError(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	if interactiveFlag {
+		repl(in)
+		return
+	}
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !evaluate(os.Stdout, os.Stderr, flag.Arg(0), in, disassembleFlag, traceFlag) {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"github.com/cloudsecurityalliance/ctpd/server/jsmm"
+	"strings"
+	"testing"
+)
+
+func TestLoadResult(t *testing.T) {
+	in, err := loadResult("testdata/result.json")
+	if err != nil {
+		t.Fatal("Could not load result:", err)
+	}
+	if in.Result == nil || len(in.Result.Value) != 2 || len(in.History) != 0 || in.Parameters != nil {
+		t.Errorf("Unexpected result: %+v", in)
+	}
+
+	in, err = loadResult("testdata/measurement.json")
+	if err != nil {
+		t.Fatal("Could not load measurement:", err)
+	}
+	if in.Result == nil || len(in.Result.Value) != 1 || len(in.History) != 1 || in.Parameters["threshold"] != 5.0 {
+		t.Errorf("Unexpected measurement: %+v", in)
+	}
+
+	if _, err := loadResult("testdata/missing.json"); err == nil {
+		t.Error("Loading a missing file should fail")
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	result, err := loadResult("testdata/result.json")
+	if err != nil {
+		t.Fatal("Could not load result:", err)
+	}
+	measurement, err := loadResult("testdata/measurement.json")
+	if err != nil {
+		t.Fatal("Could not load measurement:", err)
+	}
+
+	tests := []struct {
+		in     *input
+		expr   string
+		ok     bool
+		output string
+	}{
+		{result, "value.length", true, "2\n"},
+		{result, "value[0].name + value[1].name", true, "\"ab\"\n"},
+		{result, "value[0].v > 5 && value[1].v > 5", true, "false\n"},
+		{result, "history.length", true, "0\n"},
+		{measurement, "value[0].v > parameters.threshold", true, "true\n"},
+		{measurement, "history[0].value[0].v", true, "2\n"},
+		{result, "value[0].x.y", false, ""},
+		{result, "1 +", false, ""},
+	}
+	for _, test := range tests {
+		var out, errOut bytes.Buffer
+
+		ok := evaluate(&out, &errOut, test.expr, test.in, false, false)
+		if ok != test.ok || out.String() != test.output {
+			t.Errorf("Evaluation of %q returned %v with %q, expected %v with %q", test.expr, ok, out.String(), test.ok, test.output)
+		}
+		if ok == (errOut.Len() != 0) {
+			t.Errorf("Evaluation of %q printed %q on error output", test.expr, errOut.String())
+		}
+	}
+}
+
+func TestEvaluateException(t *testing.T) {
+	in, err := loadResult("testdata/result.json")
+	if err != nil {
+		t.Fatal("Could not load result:", err)
+	}
+
+	var out, errOut bytes.Buffer
+	if evaluate(&out, &errOut, "value.length > 0 &&\n value[0].v.x.y", in, false, false) {
+		t.Fatal("Evaluation should fail")
+	}
+	lines := strings.Split(strings.TrimSpace(errOut.String()), "\n")
+	if len(lines) < 2 || !strings.HasPrefix(lines[0], "error: ") || !strings.Contains(errOut.String(), "value[0].v.x.y") {
+		t.Errorf("Exception is not located: %q", errOut.String())
+	}
+}
+
+func TestEvaluateTrace(t *testing.T) {
+	in, err := loadResult("testdata/result.json")
+	if err != nil {
+		t.Fatal("Could not load result:", err)
+	}
+
+	var out, errOut bytes.Buffer
+	if !evaluate(&out, &errOut, "value[0].v > 5", in, false, true) || out.String() != "true\n" {
+		t.Fatalf("Traced evaluation returned %q", out.String())
+	}
+
+	machine, err := jsmm.Compile("value[0].v > 5")
+	if err != nil {
+		t.Fatal("Could not compile:", err)
+	}
+	var steps int
+	machine.SetTracer(func(jsmm.TraceStep) { steps++ })
+	if err := importInput(machine, in); err != nil {
+		t.Fatal("Could not import result:", err)
+	}
+	machine.Execute()
+
+	lines := strings.Split(strings.TrimSuffix(errOut.String(), "\n"), "\n")
+	if len(lines) != steps {
+		t.Errorf("Trace has %d lines, expected %d steps: %q", len(lines), steps, errOut.String())
+	}
+	if !strings.HasSuffix(lines[len(lines)-1], "boolean true") {
+		t.Errorf("Last step does not show the result: %q", lines[len(lines)-1])
+	}
+}
+
+func TestEvaluateDisassemble(t *testing.T) {
+	var out, errOut bytes.Buffer
+
+	if !evaluate(&out, &errOut, "value.length > 0", &input{}, true, false) {
+		t.Fatal("Disassembly failed:", errOut.String())
+	}
+	if out.Len() == 0 || errOut.Len() != 0 {
+		t.Errorf("Disassembly printed %q and %q", out.String(), errOut.String())
+	}
+}
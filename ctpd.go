@@ -15,12 +15,19 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
     "path"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 	"github.com/cloudsecurityalliance/ctpd/server"
 	"github.com/cloudsecurityalliance/ctpd/server/ctp"
 )
@@ -68,28 +75,119 @@ func main() {
 		return
 	}
 
-	if configFileFlag == "/path/to/file" {
-		conf, ok = ctp.SearchAndLoadConfigurationFile()
-	} else {
-		conf, ok = ctp.LoadConfigurationFromFile(configFileFlag)
+	configFile := configFileFlag
+	if configFile == "/path/to/file" {
+		configFile = ctp.FindConfigurationFile()
+	}
+	if configFile != "" {
+		conf, ok = ctp.LoadConfigurationFromFile(configFile)
 	}
 
 	if !ok {
         ctp.Log(nil,ctp.INFO,"No configuration file was loaded, using defaults.")
-        conf = ctp.ConfigurationDefaults
+        conf = make(ctp.Configuration)
+        for k, v := range ctp.ConfigurationDefaults {
+            conf[k] = v
+        }
+        configFile = ""
 	}
 
-    if logfileFlag!="" {
-        conf["log-file"] = logfileFlag
+    applyFlags(conf)
+
+    if err := openLogFile(conf["log-file"]); err!=nil {
+        log.Fatalf("Could not open %s, %s", conf["log-file"], err.Error())
     }
+    defer closeLogFile()
 
-    if conf["log-file"]!="" {
-        file, err := os.Create(conf["log-file"])
-        if err!=nil {
-            log.Fatalf("Could not open %s, %s", conf["log-file"], err.Error())
-        }
-        defer file.Close()
-        log.SetOutput(file)
+	if conf["client"] != "" {
+		http.Handle("/", http.FileServer(http.Dir(conf["client"])))
+	}
+
+	integerOptions := append(ctp.DatabaseIntegerOptions, "shutdown_timeout", "vm_cache_size", "history_depth", "result_retention")
+	integerOptions = append(integerOptions, server.MachineLimitOptions...)
+	for _, key := range integerOptions {
+		if conf[key] != "" {
+			if v, err := strconv.Atoi(conf[key]); err != nil || v < 0 {
+				log.Fatalf("Configuration: %s must be a positive number", key)
+			}
+		}
+	}
+	if conf["db_reconnect"] != "" && conf["db_reconnect"] != "yes" && conf["db_reconnect"] != "no" {
+		log.Fatal("Configuration: db_reconnect must be either 'yes' or 'no'")
+	}
+
+	switch conf["storage"] {
+	case "", "mongodb":
+		if !ctp.IsMongoRunning(conf) {
+			log.Fatal("Missing mongodb.")
+		}
+	case "memory":
+		if err := ctp.OpenMemoryStorage(conf); err != nil {
+			log.Fatalf("Could not initialize in-memory storage, %s", err.Error())
+		}
+		ctp.Log(nil, ctp.WARNING, "Using in-memory storage, all data will be lost when ctpd stops.")
+	default:
+		log.Fatal("Configuration: storage must be either 'mongodb' or 'memory'")
+	}
+
+	if conf["xmpp_use"] != "" && conf["xmpp_use"] != "no" {
+		if conf["xmpp_use"] != "yes" {
+			log.Fatal("Configuration: xmpp_use must be either 'yes' or 'no'")
+		}
+		if conf["xmpp_jid"] == "" || conf["xmpp_password"] == "" {
+			log.Fatal("Missing xmpp_jid or xmpp_password in configuration.")
+		}
+		ctp.Log(nil, ctp.INFO, "XMPP notifications will be sent as %s", conf["xmpp_jid"])
+	}
+
+	mux := server.NewCtpApiHandlerMux(conf)
+	http.Handle(conf["basepath"], mux)
+
+	srv := &http.Server{Addr: conf["listen"]}
+	certificate := new(certificateLoader)
+	serverError := make(chan error, 1)
+
+	if conf["tls_use"] != "" && conf["tls_use"] != "no" {
+		if conf["tls_use"] != "yes" {
+			log.Fatal("Configuration: tls_use must be either 'yes' or 'no'")
+		}
+		if conf["tls_key_file"] == "" || conf["tls_cert_file"] == "" {
+			log.Fatal("Missing tls_key_file or tls_cert_file in configuration.")
+		}
+		if err := certificate.Load(conf["tls_cert_file"], conf["tls_key_file"]); err != nil {
+			log.Fatalf("Could not load TLS certificate, %s", err.Error())
+		}
+		srv.TLSConfig = &tls.Config{GetCertificate: certificate.GetCertificate}
+		ctp.Log(nil,ctp.INFO,"Starting ctpd with TLS enabled at %s", conf["listen"])
+		go func() { serverError <- srv.ListenAndServeTLS("", "") }()
+	} else {
+		ctp.Log(nil,ctp.INFO,"Starting ctpd at %s", conf["listen"])
+		go func() { serverError <- srv.ListenAndServe() }()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	for {
+		select {
+		case err := <-serverError:
+			log.Fatal(err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				conf = reloadConfiguration(configFile, conf, mux, certificate)
+				continue
+			}
+			ctp.Log(nil, ctp.INFO, "Received %s, shutting down", sig.String())
+			shutdown(srv, conf)
+			return
+		}
+	}
+}
+
+// applyFlags overrides configuration entries with command line flags.
+func applyFlags(conf ctp.Configuration) {
+    if logfileFlag!="" {
+        conf["log-file"] = logfileFlag
     }
 
     if colorFlag {
@@ -103,27 +201,133 @@ func main() {
     if debugVMFlag {
         conf["debug-vm"]="true"
     }
+}
 
-	if conf["client"] != "" {
-		http.Handle("/", http.FileServer(http.Dir(conf["client"])))
+var logFile *os.File
+
+// openLogFile directs logs to fname, or to standard error if fname is empty,
+// and closes the previous log file. Logs are appended to fname, so that it can
+// be reopened after being moved away by logrotate.
+func openLogFile(fname string) error {
+	if fname == "" {
+		log.SetOutput(os.Stderr)
+		closeLogFile()
+		return nil
 	}
+	file, err := os.OpenFile(fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(file)
+	closeLogFile()
+	logFile = file
+	return nil
+}
 
-    if !ctp.IsMongoRunning(conf) {
-        log.Fatal("Missing mongodb.")
-    }
+func closeLogFile() {
+	if logFile != nil {
+		logFile.Close()
+		logFile = nil
+	}
+}
 
-	http.Handle(conf["basepath"], server.NewCtpApiHandlerMux(conf))
-	if conf["tls_use"] != "" && conf["tls_use"] != "no" {
-		if conf["tls_use"] != "yes" {
-			log.Fatal("Configuration: tls_use must be either 'yes' or 'no'")
-		}
-		if conf["tls_key_file"] == "" || conf["tls_cert_file"] == "" {
-			log.Fatal("Missing tls_key_file or tls_cert_file in configuration.")
+// certificateLoader holds the TLS certificate presented by the server, which
+// can be replaced without restarting the listener.
+type certificateLoader struct {
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+}
+
+func (loader *certificateLoader) Load(certFile string, keyFile string) error {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	loader.mutex.Lock()
+	loader.certificate = &certificate
+	loader.mutex.Unlock()
+	return nil
+}
+
+func (loader *certificateLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	loader.mutex.RLock()
+	defer loader.mutex.RUnlock()
+	return loader.certificate, nil
+}
+
+// staticConfiguration lists the configuration entries that are only read at
+// startup: changing them requires a restart.
+var staticConfiguration = []string{
+	"listen", "basepath", "client", "tls_use", "storage", "storage_seed",
+	"databaseurl", "db_pool_limit", "db_timeout", "db_socket_timeout", "db_reconnect",
+	"xmpp_use", "xmpp_jid", "xmpp_password", "xmpp_server", "xmpp_tls", "xmpp_timeout",
+}
+
+// reloadConfiguration handles SIGHUP: it reads the configuration file again,
+// reopens the log file and reloads the TLS certificate. New requests use the
+// new configuration, without interrupting those in progress. The current
+// configuration is kept if the file cannot be read.
+func reloadConfiguration(configFile string, current ctp.Configuration, mux *server.CtpApiHandlerMux, certificate *certificateLoader) ctp.Configuration {
+	conf := make(ctp.Configuration)
+
+	if configFile == "" {
+		for k, v := range current {
+			conf[k] = v
 		}
-		ctp.Log(nil,ctp.INFO,"Starting ctpd with TLS enabled at %s", conf["listen"])
-		log.Fatal(http.ListenAndServeTLS(conf["listen"], conf["tls_cert_file"], conf["tls_key_file"], nil))
 	} else {
-		ctp.Log(nil,ctp.INFO,"Starting ctpd at %s", conf["listen"])
-		log.Fatal(http.ListenAndServe(conf["listen"], nil))
+		var err error
+
+		if conf, err = ctp.ReadConfigurationFile(configFile); err != nil {
+			ctp.Log(nil, ctp.ERROR, "Could not reload configuration, %s", err.Error())
+			return current
+		}
+		applyFlags(conf)
+	}
+
+	for _, key := range staticConfiguration {
+		if conf[key] != current[key] {
+			ctp.Log(nil, ctp.WARNING, "Configuration: a change of %s requires a restart of ctpd", key)
+		}
+		if current[key] == "" {
+			delete(conf, key)
+		} else {
+			conf[key] = current[key]
+		}
+	}
+
+	if err := openLogFile(conf["log-file"]); err != nil {
+		ctp.Log(nil, ctp.ERROR, "Could not open %s, %s", conf["log-file"], err.Error())
+		conf["log-file"] = current["log-file"]
+	}
+
+	if conf["tls_use"] == "yes" {
+		if err := certificate.Load(conf["tls_cert_file"], conf["tls_key_file"]); err != nil {
+			ctp.Log(nil, ctp.ERROR, "Could not reload TLS certificate, %s", err.Error())
+		}
+	}
+
+	mux.Reconfigure(conf)
+	if configFile != "" {
+		ctp.Log(nil, ctp.INFO, "Reloaded configuration from %s.", configFile)
+	}
+	return conf
+}
+
+// shutdown stops accepting connections and waits for requests in progress to
+// complete, for at most shutdown_timeout seconds (30 by default).
+func shutdown(srv *http.Server, conf ctp.Configuration) {
+	timeout := 30
+	if v, err := strconv.Atoi(conf["shutdown_timeout"]); err == nil && v >= 0 {
+		timeout = v
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		ctp.Log(nil, ctp.WARNING, "Requests still in progress after %d seconds were interrupted", timeout)
+		srv.Close()
 	}
+	ctp.CloseDatabase()
+	ctp.Log(nil, ctp.INFO, "ctpd stopped")
 }
@@ -36,28 +36,63 @@ func (account *Account) Load(context *ctp.ApiContext) *ctp.HttpError {
 }
 
 func (account *Account) Create(context *ctp.ApiContext) *ctp.HttpError {
-	var key [24]byte
-
 	account.BuildLinks(context)
 
 	if account.Token == "" {
-		_, err := rand.Read(key[:])
+		token, err := accountNewToken()
 		if err != nil {
-			return ctp.NewInternalServerError("Error generating key")
+			return err
 		}
-		account.Token = base64.StdEncoding.EncodeToString(key[:])
+		account.Token = token
 	}
+	account.PreviousToken = ""
+	account.PreviousTokenExpiry = 0
 
-	if len(account.AccountTags.WithPrefix("account:")) == 0 {
-		account.AccountTags.Append(ctp.NewTags("account:" + string(account.Id)))
+	accountDefaultTags(account)
+
+	if !ctp.CreateResource(context, "accounts", account) {
+		return ctp.NewHttpError(http.StatusInternalServerError, "Could not save account")
 	}
+	return nil
+}
 
-	if len(account.AccountTags.WithPrefix("role:")) == 0 {
-		account.AccountTags.Append(ctp.UserRoleTag)
+func (account *Account) Update(context *ctp.ApiContext, update ctp.ResourceUpdater) *ctp.HttpError {
+	account.BuildLinks(context)
+	up, ok := update.(*Account)
+	if !ok {
+		return ctp.NewInternalServerError("Updated object is not an account") // should never happen
 	}
 
-	if !ctp.CreateResource(context, "accounts", account) {
-		return ctp.NewHttpError(http.StatusInternalServerError, "Could not save account")
+	switch context.QueryParam {
+	case "name":
+		account.Name = up.Name
+		account.Annotation = up.Annotation
+	case "accountTags":
+		if up.AccountTags == nil {
+			return ctp.NewBadRequestError("No accountTags provided in request")
+		}
+		account.AccountTags = up.AccountTags
+		accountDefaultTags(account)
+	case "token":
+		token, err := accountNewToken()
+		if err != nil {
+			return err
+		}
+		if up.GracePeriod > 0 {
+			account.PreviousToken = account.Token
+			account.PreviousTokenExpiry = ctp.Now() + ctp.Timestamp(up.GracePeriod)
+		} else {
+			account.PreviousToken = ""
+			account.PreviousTokenExpiry = 0
+		}
+		account.Token = token
+		ctp.Log(context, ctp.INFO, "Rotated token of account %s, with a grace period of %d seconds", account.Id, up.GracePeriod)
+	default:
+		return ctp.NewBadRequestError("Account update requires one of x=name, x=accountTags or x=token in query string")
+	}
+
+	if !ctp.UpdateResource(context, "accounts", account.Id, account) {
+		return ctp.NewInternalServerError("Could not update account")
 	}
 	return nil
 }
@@ -71,6 +106,29 @@ func (account *Account) Delete(context *ctp.ApiContext) *ctp.HttpError {
 
 ////////////////////////////////////////////////////////////////////////////
 
+func accountNewToken() (string, *ctp.HttpError) {
+	var key [24]byte
+
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", ctp.NewInternalServerError("Error generating key")
+	}
+	return base64.StdEncoding.EncodeToString(key[:]), nil
+}
+
+// accountDefaultTags makes sure an account keeps an 'account:' tag, so that
+// the resources tagged with its id remain accessible, and a 'role:' tag.
+func accountDefaultTags(account *Account) {
+	if len(account.AccountTags.WithPrefix("account:")) == 0 {
+		account.AccountTags.Append(ctp.NewTags("account:" + string(account.Id)))
+	}
+
+	if len(account.AccountTags.WithPrefix("role:")) == 0 {
+		account.AccountTags.Append(ctp.UserRoleTag)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////
+
 func HandleGETAccount(w http.ResponseWriter, r *http.Request, context *ctp.ApiContext) {
 	var account Account
 
@@ -87,6 +145,15 @@ func HandlePOSTAccount(w http.ResponseWriter, r *http.Request, context *ctp.ApiC
 	handler.Handle(w, r, context, &account)
 }
 
+func HandlePUTAccount(w http.ResponseWriter, r *http.Request, context *ctp.ApiContext) {
+	var account Account
+	var update Account
+
+	handler := ctp.NewPUTHandler(ctp.AdminRoleTag)
+
+	handler.Handle(w, r, context, &account, &update)
+}
+
 func HandleDELETEAccount(w http.ResponseWriter, r *http.Request, context *ctp.ApiContext) {
 	var account Account
 
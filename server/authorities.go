@@ -0,0 +1,112 @@
+//    Copyright 2015 Cloud Security Alliance EMEA (cloudsecurityalliance.org)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/cloudsecurityalliance/ctpd/server/ctp"
+	"net/http"
+)
+
+// An Authority is a back office resource that holds the public key used to
+// verify the signature of measurement results produced by the entity
+// identified by AuthorityId.
+type Authority struct {
+	ctp.NamedResource `bson:",inline"`
+	AuthorityId       string `json:"authorityId" bson:"authorityId"`
+	PublicKey         string `json:"publicKey"   bson:"publicKey"`
+}
+
+func (authority *Authority) BuildLinks(context *ctp.ApiContext) {
+	authority.Self = ctp.NewLink(context.CtpBase, "@/authorities/$", authority.Id)
+}
+
+func (authority *Authority) Load(context *ctp.ApiContext) *ctp.HttpError {
+	if !ctp.LoadResource(context, "authorities", ctp.Base64Id(context.Params[1]), authority) {
+		return ctp.NewHttpError(http.StatusNotFound, "Not Found")
+	}
+	authority.BuildLinks(context)
+	return nil
+}
+
+func (authority *Authority) Create(context *ctp.ApiContext) *ctp.HttpError {
+	authority.BuildLinks(context)
+
+	if authority.AuthorityId == "" {
+		return ctp.NewBadRequestError("Missing authorityId")
+	}
+
+	if _, err := ctp.ParseRSAPublicKey(authority.PublicKey); err != nil {
+		return ctp.NewBadRequestErrorf("Invalid public key - %s", err.Error())
+	}
+
+	count, err := context.Storage.Count("authorities", ctp.Selector{"authorityId": authority.AuthorityId})
+	if err != nil {
+		return ctp.NewInternalServerError(err)
+	}
+	if count > 0 {
+		return ctp.NewHttpErrorf(http.StatusConflict, "Authority '%s' already exists", authority.AuthorityId)
+	}
+
+	if authority.AccessTags == nil {
+		authority.AccessTags = ctp.AdminRoleTag
+	}
+
+	if !ctp.CreateResource(context, "authorities", authority) {
+		return ctp.NewHttpError(http.StatusInternalServerError, "Could not save authority")
+	}
+	return nil
+}
+
+func (authority *Authority) Delete(context *ctp.ApiContext) *ctp.HttpError {
+	if !ctp.DeleteResource(context, "authorities", authority.Id) {
+		return ctp.NewInternalServerError("Authority deletion failed")
+	}
+	return nil
+}
+
+func loadAuthority(context *ctp.ApiContext, authorityId string) (*Authority, bool) {
+	authority := new(Authority)
+
+	if err := context.Storage.FindOne("authorities", ctp.Selector{"authorityId": authorityId}, authority); err != nil {
+		return nil, false
+	}
+	return authority, true
+}
+
+////////////////////////////////////////////////////////////////////////////
+
+func HandleGETAuthority(w http.ResponseWriter, r *http.Request, context *ctp.ApiContext) {
+	var authority Authority
+
+	handler := ctp.NewGETHandler(ctp.AdminRoleTag)
+
+	handler.Handle(w, r, context, &authority)
+}
+
+func HandlePOSTAuthority(w http.ResponseWriter, r *http.Request, context *ctp.ApiContext) {
+	var authority Authority
+
+	handler := ctp.NewPOSTHandler(ctp.AdminRoleTag)
+
+	handler.Handle(w, r, context, &authority)
+}
+
+func HandleDELETEAuthority(w http.ResponseWriter, r *http.Request, context *ctp.ApiContext) {
+	var authority Authority
+
+	handler := ctp.NewDELETEHandler(ctp.AdminRoleTag)
+
+	handler.Handle(w, r, context, &authority)
+}
@@ -0,0 +1,237 @@
+//    Copyright 2015 Cloud Security Alliance EMEA (cloudsecurityalliance.org)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/cloudsecurityalliance/ctpd/server/ctp"
+	"net/http"
+	"strconv"
+)
+
+const defaultResultBatchSize = 1000
+
+// resultBatchSize returns the maximum number of results in a request to
+// PUT /measurements?x=results, set by the result_batch_size configuration
+// entry.
+func resultBatchSize(conf ctp.Configuration) int {
+	if v, err := strconv.Atoi(conf["result_batch_size"]); err == nil && v > 0 {
+		return v
+	}
+	return defaultResultBatchSize
+}
+
+// A BatchResult is a new result for one measurement in a ResultBatch.
+type BatchResult struct {
+	Measurement ctp.Link `json:"measurement"`
+	Result      *Result  `json:"result"`
+}
+
+// A ResultBatch is the body of PUT /measurements?x=results, which updates
+// the result of several measurements at once.
+type ResultBatch struct {
+	Results []BatchResult `json:"results"`
+}
+
+// A BatchResultStatus reports the outcome of one BatchResult, with the HTTP
+// status that PUT /measurements/{id}?x=result would have returned.
+type BatchResultStatus struct {
+	Measurement     ctp.Link     `json:"measurement"`
+	Status          int          `json:"status"`
+	Error           string       `json:"error,omitempty"`
+	ObjectiveStatus *ctp.BoolErr `json:"objectiveStatus,omitempty"`
+}
+
+// A BatchStatus is the response to PUT /measurements?x=results. Results are
+// reported in the order of the request.
+type BatchStatus struct {
+	ChangeId ctp.Base64Id        `json:"changeId,omitempty"`
+	Accepted int                 `json:"accepted"`
+	Rejected int                 `json:"rejected"`
+	Results  []BatchResultStatus `json:"results"`
+}
+
+// measurementsAcceptBatch applies each result of a batch independently, as
+// PUT /measurements/{id}?x=result does, including the evaluation of
+// triggers against each accepted result. The triggers of all the
+// measurements in the batch are read with a single query. All the ancestors
+// of the updated measurements then receive the same changeId once.
+func measurementsAcceptBatch(context *ctp.ApiContext, batch *ResultBatch) *BatchStatus {
+	status := &BatchStatus{Results: make([]BatchResultStatus, len(batch.Results))}
+	changeId := ctp.NewBase64Id()
+
+	updated := make(map[ctp.Base64Id]*Measurement)
+	var order []*Measurement
+
+	var mlinks []ctp.Link
+	seen := make(map[ctp.Base64Id]bool)
+	for _, item := range batch.Results {
+		if id := measurementBatchId(context, item.Measurement); id != "" && !seen[id] {
+			mlinks = append(mlinks, ctp.ShortenLink(context.CtpBase, ctp.NewLink(context.CtpBase, "@/measurements/$", id)))
+			seen[id] = true
+		}
+	}
+	triggers, triggersLoaded := measurementsTriggersLoad(context, mlinks)
+
+	for i, item := range batch.Results {
+		status.Results[i].Measurement = item.Measurement
+
+		measurement := updated[measurementBatchId(context, item.Measurement)]
+		if measurement == nil {
+			var err *ctp.HttpError
+
+			if measurement, err = measurementBatchLoad(context, item.Measurement); err != nil {
+				status.Results[i].Status = err.StatusCode()
+				status.Results[i].Error = err.Error()
+				continue
+			}
+		}
+		status.Results[i].Measurement = measurement.Self
+
+		// a rejected result leaves the measurement as it was, since it may
+		// be updated again by a later result of the batch.
+		saved := *measurement
+		if measurement.Objective != nil {
+			objective := *measurement.Objective
+			saved.Objective = &objective
+		}
+
+		err := measurementAcceptResult(context, measurement, item.Result)
+		if err == nil && !measurementStoreResult(context, measurement) {
+			err = ctp.NewInternalServerError("Could not save measurement result")
+		}
+		if err == nil {
+			measurement.ChangeId = changeId
+			if !ctp.UpdateResource(context, "measurements", measurement.Id, measurement) {
+				// the stored result would otherwise show in the history of a
+				// measurement that never had it.
+				if !resultDelete(context, measurement.ResultId) {
+					ctp.Log(context, ctp.ERROR, "Could not remove result %s of measurement %s", measurement.ResultId, measurement.Id)
+				}
+				err = ctp.NewInternalServerError("Could not update measurement object")
+			}
+		}
+		if err != nil {
+			*measurement = saved
+			status.Results[i].Status = err.StatusCode()
+			status.Results[i].Error = err.Error()
+			continue
+		}
+
+		if measurement.Objective != nil {
+			objective := measurement.Objective.Status
+			status.Results[i].ObjectiveStatus = &objective
+		}
+		status.Results[i].Status = http.StatusOK
+
+		if triggersLoaded {
+			for _, trigger := range triggers[ctp.ShortenLink(context.CtpBase, measurement.Self)] {
+				triggerEvaluate(context, trigger, measurement)
+			}
+		}
+
+		if updated[measurement.Id] == nil {
+			updated[measurement.Id] = measurement
+			order = append(order, measurement)
+		}
+	}
+
+	status.Accepted = len(batch.Results)
+	for _, result := range status.Results {
+		if result.Status != http.StatusOK {
+			status.Accepted--
+			status.Rejected++
+		}
+	}
+	if len(order) == 0 {
+		return status
+	}
+
+	resources := make([]*ctp.Resource, len(order))
+	for i, measurement := range order {
+		resources[i] = measurement.Super()
+	}
+	if !ctp.PropagateChangeIds(context, "measurements", resources) {
+		ctp.Log(context, ctp.ERROR, "Failed to propagate changeId %s of a batch of results", changeId)
+	}
+	status.ChangeId = changeId
+	return status
+}
+
+// measurementBatchId returns the id in a measurement link, or an empty id if
+// the link is not a measurement link.
+func measurementBatchId(context *ctp.ApiContext, link ctp.Link) ctp.Base64Id {
+	params, ok := ctp.ParseLink(context.CtpBase, "@/measurements/$", link)
+	if !ok {
+		return ""
+	}
+	return ctp.Base64Id(params[0])
+}
+
+// measurementBatchLoad loads the measurement of a BatchResult, provided that
+// the client has access to it.
+func measurementBatchLoad(context *ctp.ApiContext, link ctp.Link) (*Measurement, *ctp.HttpError) {
+	measurement := new(Measurement)
+
+	id := measurementBatchId(context, link)
+	if id == "" {
+		return nil, ctp.NewBadRequestError("Invalid measurement URL")
+	}
+	if !ctp.LoadResource(context, "measurements", id, measurement) {
+		return nil, ctp.NewHttpErrorf(http.StatusNotFound, "Measurement %s was not found", id)
+	}
+	if !ctp.MatchTags(context.AccountTags, measurement.AccessTags) {
+		return nil, ctp.NewHttpError(http.StatusUnauthorized, "You do not have permission to access this resource")
+	}
+	measurement.Metric = ctp.ExpandLink(context.CtpBase, measurement.Metric)
+	measurement.BuildLinks(context)
+	return measurement, nil
+}
+
+// HandlePUTMeasurementResults serves PUT /measurements?x=results, which lets
+// an agent send the results of many measurements in one request. Each result
+// is accepted or rejected independently, and the response has the status
+// 207 (Multi-Status).
+func HandlePUTMeasurementResults(w http.ResponseWriter, r *http.Request, context *ctp.ApiContext) {
+	var batch ResultBatch
+
+	if !context.AuthenticateClient(w, r) {
+		ctp.Log(context, ctp.WARNING, "Missing access tags")
+		return
+	}
+
+	if !context.VerifyAccessTags(w, ctp.AgentRoleTag) {
+		ctp.Log(context, ctp.WARNING, "Mismatched access tags for API signature")
+		return
+	}
+
+	if err := ctp.ParseResource(r.Body, &batch); err != nil {
+		ctp.RenderErrorResponse(w, context, ctp.NewBadRequestErrorf("Failed to parse result batch, %s", err.Error()))
+		return
+	}
+
+	if len(batch.Results) == 0 {
+		ctp.RenderErrorResponse(w, context, ctp.NewBadRequestError("No result provided in request"))
+		return
+	}
+	if max := resultBatchSize(context.Configuration); len(batch.Results) > max {
+		ctp.RenderErrorResponse(w, context, ctp.NewHttpErrorf(http.StatusRequestEntityTooLarge, "A batch cannot hold more than %d results", max))
+		return
+	}
+
+	status := measurementsAcceptBatch(context, &batch)
+	ctp.Log(context, ctp.INFO, "Accepted %d and rejected %d results in batch", status.Accepted, status.Rejected)
+
+	ctp.RenderJsonResponse(w, context, http.StatusMultiStatus, status)
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/cloudsecurityalliance/ctpd/server/ctp"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testBatchContext adds to testMetricContext a service view with an asset
+// and an attribute, two measurements of the attribute, one of which the
+// "agent" account cannot access, and a trigger on the first measurement.
+func testBatchContext(t *testing.T) *ctp.ApiContext {
+	context, _ := testMetricContext(t)
+
+	for _, parent := range []struct {
+		category string
+		id       ctp.Base64Id
+	}{
+		{"serviceViews", "sv1"},
+		{"assets", "asset1"},
+		{"attributes", "attr1"},
+	} {
+		if !ctp.CreateResource(context, parent.category, &ctp.Resource{Id: parent.id}) {
+			t.Fatal("Could not create", parent.category)
+		}
+	}
+
+	for _, m := range []struct {
+		id   ctp.Base64Id
+		tags ctp.Tags
+	}{
+		{"m1", ctp.NewTags("tag:a")},
+		{"m2", ctp.NewTags("tag:b")},
+	} {
+		measurement := &Measurement{Metric: "@/metrics/metric1", State: "activated"}
+		measurement.Id = m.id
+		measurement.Parent = []ctp.Base64Id{"attr1", "asset1", "sv1"}
+		measurement.AccessTags = m.tags
+		measurement.Objective = &Objective{Condition: "value[0].v > 5"}
+		if !ctp.CreateResource(context, "measurements", measurement) {
+			t.Fatal("Could not create measurement", m.id)
+		}
+	}
+
+	trigger := &Trigger{Measurement: "@/measurements/m1", Condition: "history.length == 0 && value[0].v > 5", Status: ctp.Tfalse}
+	trigger.Id = "trigger1"
+	trigger.Parent = []ctp.Base64Id{"sv1"}
+	trigger.AccessTags = ctp.NewTags("tag:a")
+	if !ctp.CreateResource(context, "triggers", trigger) {
+		t.Fatal("Could not create trigger")
+	}
+
+	account := &ctp.Account{AccountTags: ctp.NewTags("role:agent", "tag:a"), Token: "agent"}
+	account.Id = "account1"
+	if !ctp.CreateResource(context, "accounts", account) {
+		t.Fatal("Could not create account")
+	}
+	return context
+}
+
+func TestMeasurementsAcceptBatch(t *testing.T) {
+	context := testBatchContext(t)
+	context.AccountTags = ctp.NewTags("role:agent", "tag:a")
+
+	batch := &ResultBatch{Results: []BatchResult{
+		{"@/measurements/m1", &Result{Value: []ResultRow{{"v": 7.0}}}},
+		{"@/measurements/m1", &Result{Value: []ResultRow{{"v": "x"}}}},
+		{"@/measurements/m1", &Result{Value: []ResultRow{{"v": 2.0}}}},
+		{"@/measurements/m2", &Result{Value: []ResultRow{{"v": 1.0}}}},
+		{"@/measurements/m3", &Result{Value: []ResultRow{{"v": 1.0}}}},
+		{"@/metrics/metric1", &Result{Value: []ResultRow{{"v": 1.0}}}},
+		{"@/measurements/m1", nil},
+	}}
+	status := measurementsAcceptBatch(context, batch)
+
+	expected := []int{200, 400, 200, 401, 404, 400, 400}
+	for i, result := range status.Results {
+		if result.Status != expected[i] {
+			t.Errorf("Result %d has status %d (%s), expected %d", i, result.Status, result.Error, expected[i])
+		}
+	}
+	if status.Accepted != 2 || status.Rejected != 5 || status.ChangeId == "" {
+		t.Error("Batch status is", status.Accepted, status.Rejected, status.ChangeId)
+	}
+	if s := status.Results[0].ObjectiveStatus; s == nil || *s != ctp.Ttrue {
+		t.Error("Objective status of the first result is", s)
+	}
+	if s := status.Results[2].ObjectiveStatus; s == nil || *s != ctp.Tfalse {
+		t.Error("Objective status of the third result is", s)
+	}
+
+	var measurement Measurement
+	if !ctp.LoadResource(context, "measurements", "m1", &measurement) {
+		t.Fatal("Could not load measurement")
+	}
+	if measurement.Result == nil || measurement.Result.Value[0]["v"] != 2.0 || measurement.ChangeId != status.ChangeId {
+		t.Error("Measurement was not updated by its last result:", measurement.Result, measurement.ChangeId)
+	}
+	if n, _ := context.Storage.Count("results", ctp.Selector{"parent.0": "m1"}); n != 2 {
+		t.Error("Measurement has", n, "stored results, expected 2")
+	}
+	if !ctp.LoadResource(context, "measurements", "m2", &measurement) || measurement.Result != nil {
+		t.Error("Rejected result was applied to measurement m2")
+	}
+
+	for _, parent := range []struct {
+		category string
+		id       ctp.Base64Id
+	}{
+		{"serviceViews", "sv1"},
+		{"assets", "asset1"},
+		{"attributes", "attr1"},
+	} {
+		var resource ctp.Resource
+
+		if !ctp.LoadResource(context, parent.category, parent.id, &resource) || resource.ChangeId != status.ChangeId {
+			t.Errorf("%s %s has changeId %s, expected %s", parent.category, parent.id, resource.ChangeId, status.ChangeId)
+		}
+	}
+
+	// the trigger only holds for the first result, before any history.
+	if n, _ := context.Storage.Count("logs", ctp.Selector{}); n != 1 {
+		t.Error("Trigger logged", n, "times, expected once")
+	}
+	var trigger Trigger
+	if !ctp.LoadResource(context, "triggers", "trigger1", &trigger) || trigger.Status != ctp.Ttrue {
+		t.Error("Trigger status is", trigger.Status)
+	}
+}
+
+func TestMeasurementsAcceptBatchRejected(t *testing.T) {
+	context := testBatchContext(t)
+	context.AccountTags = ctp.NewTags("role:agent", "tag:a")
+
+	batch := &ResultBatch{Results: []BatchResult{
+		{"@/measurements/m2", &Result{Value: []ResultRow{{"v": 1.0}}}},
+	}}
+	status := measurementsAcceptBatch(context, batch)
+	if status.Accepted != 0 || status.Rejected != 1 || status.ChangeId != "" {
+		t.Error("Batch status is", status.Accepted, status.Rejected, status.ChangeId)
+	}
+
+	var resource ctp.Resource
+	if !ctp.LoadResource(context, "serviceViews", "sv1", &resource) || resource.ChangeId != "" {
+		t.Error("Rejected batch changed the service view:", resource.ChangeId)
+	}
+}
+
+func TestHandlePUTMeasurementResults(t *testing.T) {
+	context := testBatchContext(t)
+
+	tests := []struct {
+		token  string
+		body   string
+		code   int
+		status []int
+	}{
+		{"agent", `{"results":[{"measurement":"https://localhost/api/1.0/measurements/m1","result":{"value":[{"v":7}]}},{"measurement":"@/measurements/m2","result":{"value":[{"v":1}]}}]}`, http.StatusMultiStatus, []int{200, 401}},
+		{"agent", `{"results":[]}`, http.StatusBadRequest, nil},
+		{"agent", `{"results":`, http.StatusBadRequest, nil},
+		{"unknown", `{"results":[{"measurement":"@/measurements/m1","result":{"value":[{"v":7}]}}]}`, http.StatusUnauthorized, nil},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("PUT", "/measurements?x=results", strings.NewReader(test.body))
+		r.Header.Set("Authorization", "Bearer "+test.token)
+		w := httptest.NewRecorder()
+
+		HandlePUTMeasurementResults(w, r, context)
+		if w.Code != test.code {
+			t.Errorf("PUT %s returned %d, expected %d: %s", test.body, w.Code, test.code, w.Body.String())
+			continue
+		}
+		if test.status == nil {
+			continue
+		}
+
+		var status BatchStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatal("Invalid response body:", err, w.Body.String())
+		}
+		if len(status.Results) != len(test.status) || status.ChangeId == "" {
+			t.Fatal("Unexpected response body:", w.Body.String())
+		}
+		for i, result := range status.Results {
+			if result.Status != test.status[i] {
+				t.Errorf("Result %d has status %d, expected %d", i, result.Status, test.status[i])
+			}
+		}
+		if status.Results[0].Measurement != "https://localhost/api/1.0/measurements/m1" {
+			t.Error("Result 0 refers to", status.Results[0].Measurement)
+		}
+	}
+}
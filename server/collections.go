@@ -15,8 +15,6 @@
 package server
 
 import (
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 	"net/http"
 	"github.com/cloudsecurityalliance/ctpd/server/ctp"
 	"strconv"
@@ -35,47 +33,56 @@ type Collection struct {
 	Items            []CollectionItem `json:"collection"`
 }
 
+// parsePagination returns the number of items to skip and to return, as
+// set by the 'page' and 'items' query parameters. items is 0 if the
+// query is not paginated.
+func parsePagination(r *http.Request) (int, int, *ctp.HttpError) {
+	var page, items int
+	var err error
+
+	page_query := r.URL.Query().Get("page")
+	items_query := r.URL.Query().Get("items")
+	if page_query == "" && items_query == "" {
+		return 0, 0, nil
+	}
+	if page_query == "" || items_query == "" {
+		return 0, 0, ctp.NewHttpError(http.StatusBadRequest, "Must specify both 'page' and 'items' in query string.")
+	}
+	if page, err = strconv.Atoi(page_query); err != nil || page < 0 {
+		return 0, 0, ctp.NewHttpError(http.StatusBadRequest, "page must be a positive number.")
+	}
+	if items, err = strconv.Atoi(items_query); err != nil || items <= 0 {
+		return 0, 0, ctp.NewHttpError(http.StatusBadRequest, "items must be a non-zero positive number.")
+	}
+	return items * page, items, nil
+}
+
 func HandleGETCollection(w http.ResponseWriter, r *http.Request, context *ctp.ApiContext) {
 	var item ctp.NamedResource
 	var parent ctp.Resource
-	var query *mgo.Query
+	var category string
 	var collectionType string
-	var skip, page, items int
-	var err error
 
 	collection := new(Collection)
-	selector := make(bson.M)
+	selector := make(ctp.Selector)
 
 	if name, ok := r.URL.Query()["name"]; ok {
 		selector["name"] = name[0]
 	}
 
-	page_query := r.URL.Query().Get("page")
-	items_query := r.URL.Query().Get("items")
-	if page_query != "" || items_query != "" {
-		if page_query == "" || items_query == "" {
-			ctp.RenderErrorResponse(w, context, ctp.NewHttpError(http.StatusBadRequest, "Must specify both 'page' and 'items' in query string."))
-			return
-		}
-		if page, err = strconv.Atoi(page_query); err != nil || page < 0 {
-			ctp.RenderErrorResponse(w, context, ctp.NewHttpError(http.StatusBadRequest, "page must be a positive number."))
-			return
-		}
-		if items, err = strconv.Atoi(items_query); err != nil || items <= 0 {
-			ctp.RenderErrorResponse(w, context, ctp.NewHttpError(http.StatusBadRequest, "items must be a non-zero positive number."))
-		}
-		skip = items * page
+	skip, items, perr := parsePagination(r)
+	if perr != nil {
+		ctp.RenderErrorResponse(w, context, perr)
+		return
 	}
 
 	if !context.AuthenticateClient(w, r) {
 		return
 	}
 
-	var mgoCollection *mgo.Collection
-
 	if len(context.Params) == 1 {
 		collectionType = context.Params[0]
-		mgoCollection = context.Session.DB("ctp").C(collectionType)
+		category = collectionType
 
 		switch collectionType {
 		case "serviceViews":
@@ -83,7 +90,11 @@ func HandleGETCollection(w http.ResponseWriter, r *http.Request, context *ctp.Ap
 				return
 			}
 			if !ctp.MatchTags(context.AccountTags, ctp.AdminRoleTag) {
-				selector["accessTags"] = bson.M{"$in": context.AccountTags.WithPrefix("account:")}
+				var accountTags ctp.AnyOf
+				for _, tag := range context.AccountTags.WithPrefix("account:") {
+					accountTags = append(accountTags, tag)
+				}
+				selector["accessTags"] = accountTags
 			}
 		case "metrics":
 			if !context.VerifyAccessTags(w, ctp.UserRoleTag) {
@@ -111,24 +122,19 @@ func HandleGETCollection(w http.ResponseWriter, r *http.Request, context *ctp.Ap
 
 		collectionType = context.Params[2]
         if context.Params[2]=="indicators" {
-            mgoCollection = context.Session.DB("ctp").C("measurements")
+            category = "measurements"
         } else {
-            mgoCollection = context.Session.DB("ctp").C(collectionType)
+            category = collectionType
         }
-		selector["parent"] = context.Params[1]
-	}
-
-	query = mgoCollection.Find(selector)
-
-	collection_length, err := query.Count()
-	if err != nil {
-		ctp.RenderErrorResponse(w, context, ctp.NewInternalServerError(err))
-		return
+		if collectionType == "dependencies" {
+			// nested dependencies also list this scope among their ancestors
+			selector["parent.0"] = context.Params[1]
+		} else {
+			selector["parent"] = context.Params[1]
+		}
 	}
 
-	query = query.Sort("$natural").Skip(skip).Limit(items)
-
-	returned_length, err := query.Count()
+	collection_length, err := context.Storage.Count(category, selector)
 	if err != nil {
 		ctp.RenderErrorResponse(w, context, ctp.NewInternalServerError(err))
 		return
@@ -136,11 +142,10 @@ func HandleGETCollection(w http.ResponseWriter, r *http.Request, context *ctp.Ap
 
 	collection.Self = ctp.Link(r.URL.RequestURI())
 	collection.CollectionLength = collection_length
-	collection.ReturnedLength = returned_length
 	collection.CollectionType = collectionType
-	collection.Items = make([]CollectionItem, 0, returned_length)
+	collection.Items = make([]CollectionItem, 0)
 
-	iter := query.Iter()
+	iter := context.Storage.Find(category, selector, "", skip, items)
 	for iter.Next(&item) {
 		collection.Items = append(collection.Items, CollectionItem{
 			Link: ctp.NewLink(context.CtpBase, "@/$/$", collectionType, item.Id),
@@ -152,6 +157,7 @@ func HandleGETCollection(w http.ResponseWriter, r *http.Request, context *ctp.Ap
 		ctp.RenderErrorResponse(w, context, ctp.NewInternalServerError(err))
 		return
 	}
+	collection.ReturnedLength = len(collection.Items)
 
 	ctp.RenderJsonResponse(w, context, 200, collection)
 }
@@ -20,9 +20,12 @@ import (
 )
 
 type Account struct {
-	NamedResource `bson:",inline"`
-	AccountTags   Tags   `json:"accountTags" bson:"accountTags"`
-	Token         string `json:"token" bson:"token"`
+	NamedResource       `bson:",inline"`
+	AccountTags         Tags      `json:"accountTags" bson:"accountTags"`
+	Token               string    `json:"token" bson:"token"`
+	PreviousToken       string    `json:"-" bson:"previousToken,omitempty"`
+	PreviousTokenExpiry Timestamp `json:"previousTokenExpiry,omitempty" bson:"previousTokenExpiry,omitempty"`
+	GracePeriod         uint      `json:"gracePeriod,omitempty" bson:"-"` // seconds, only used when rotating the token
 }
 
 func BearerAuth(r *http.Request) (token string, ok bool) {
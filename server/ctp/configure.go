@@ -16,6 +16,7 @@ package ctp
 
 import (
 	"bufio"
+	"fmt"
 	"log"
 	"os"
 	"os/user"
@@ -32,22 +33,23 @@ var ConfigurationDefaults = Configuration{
 	"databaseurl": "localhost",
 }
 
-var validEntry1 = regexp.MustCompile(`^([a-zA-Z0-9_]+)\s*=\s*([^ "\t\r\n]+)$`)
-var validEntry2 = regexp.MustCompile(`^([a-zA-Z0-9_]+)\s*=\s*"([^"]*)"$`)
+var validEntry1 = regexp.MustCompile(`^([a-zA-Z0-9_-]+)\s*=\s*([^ "\t\r\n]+)$`)
+var validEntry2 = regexp.MustCompile(`^([a-zA-Z0-9_-]+)\s*=\s*"([^"]*)"$`)
 
-func LoadConfigurationFromFile(fname string) (Configuration, bool) {
+// ReadConfigurationFile parses a configuration file, completing it with
+// default values.
+func ReadConfigurationFile(fname string) (Configuration, error) {
 	info, err := os.Stat(fname)
 	if err != nil {
-		return nil, false
+		return nil, err
 	}
 	if (info.Mode() & 077) != 0 {
-		Log(nil, ERROR, "Permissions 0%o for %s are too open.", info.Mode()&os.ModePerm, fname)
-		log.Fatalf("Configuration file should not be readable or writable by other users.")
+		return nil, fmt.Errorf("Permissions 0%o for %s are too open, configuration file should not be readable or writable by other users.", info.Mode()&os.ModePerm, fname)
 	}
 
 	file, err := os.Open(fname)
 	if err != nil {
-		return nil, false
+		return nil, err
 	}
 	defer file.Close()
 
@@ -67,7 +69,7 @@ func LoadConfigurationFromFile(fname string) (Configuration, bool) {
 			} else if r := validEntry2.FindStringSubmatch(line); r != nil {
 				conf[r[1]] = r[2]
 			} else {
-				log.Fatalf("Error on line %d in %s", linecount, fname)
+				return nil, fmt.Errorf("Error on line %d in %s", linecount, fname)
 			}
 		}
 	}
@@ -82,28 +84,50 @@ func LoadConfigurationFromFile(fname string) (Configuration, bool) {
 	if conf["basepath"][len(conf["basepath"])-1] != '/' {
 		conf["basepath"] += "/"
 	}
+	return conf, nil
+}
+
+// LoadConfigurationFromFile reads a configuration file, and stops ctpd if the
+// file exists but is incorrect.
+func LoadConfigurationFromFile(fname string) (Configuration, bool) {
+	conf, err := ReadConfigurationFile(fname)
+	if err != nil {
+		if _, ok := err.(*os.PathError); ok {
+			return nil, false
+		}
+		log.Fatal(err.Error())
+	}
 
 	Log(nil, INFO, "Loaded configuration from %s.", fname)
 
 	return conf, true
 }
 
-func SearchAndLoadConfigurationFile() (Configuration, bool) {
-	cwd, err := os.Getwd()
-	if err == nil {
-		fname := path.Join(cwd, "ctpd.conf")
-		if c, r := LoadConfigurationFromFile(fname); r {
-			return c, true
-		}
+// FindConfigurationFile returns the first configuration file found among
+// ./ctpd.conf, ~/.ctpd.conf and /etc/ctpd.conf, or "" if there is none.
+func FindConfigurationFile() string {
+	var candidates []string
+
+	if cwd, err := os.Getwd(); err == nil {
+		candidates = append(candidates, path.Join(cwd, "ctpd.conf"))
+	}
+	if usr, err := user.Current(); err == nil {
+		candidates = append(candidates, path.Join(usr.HomeDir, ".ctpd.conf"))
 	}
+	candidates = append(candidates, "/etc/ctpd.conf")
 
-	usr, err := user.Current()
-	if err == nil {
-		fname := path.Join(usr.HomeDir, ".ctpd.conf")
-		if c, r := LoadConfigurationFromFile(fname); r {
-			return c, true
+	for _, fname := range candidates {
+		if _, err := os.Stat(fname); err == nil {
+			return fname
 		}
 	}
+	return ""
+}
 
-	return LoadConfigurationFromFile("/etc/ctpd.conf")
+func SearchAndLoadConfigurationFile() (Configuration, bool) {
+	fname := FindConfigurationFile()
+	if fname == "" {
+		return nil, false
+	}
+	return LoadConfigurationFromFile(fname)
 }
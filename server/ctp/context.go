@@ -17,11 +17,9 @@ package ctp
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 	"io"
 	"net/http"
+	"net/url"
 	"sync"
 )
 
@@ -34,8 +32,9 @@ type ApiContext struct {
 	Signature     string
 	Params        []string
 	QueryParam    string
+	Query         url.Values // query parameters of the request
 	Id            SessionId
-	Session       *mgo.Session
+	Storage       Storage
 	AccountTags   Tags
 	ColorLogs     bool
 	DebugVM       bool
@@ -59,17 +58,17 @@ func NewApiContext(r *http.Request, conf Configuration) (*ApiContext, error) {
 	c.Signature = signature
 	c.Params = params
 	c.QueryParam = xparam
+	c.Query = r.URL.Query()
 	mutexCounter.Lock()
 	contextCounter++
 	c.Id = SessionId(contextCounter)
 	mutexCounter.Unlock()
 
-	session, err := mgo.Dial(conf["databaseurl"])
+	storage, err := openStorage(conf)
 	if err != nil {
-		Log(c, ERROR, "Failed to connect to database %s: %s", conf["databaseurl"], err.Error())
 		return c, err
 	}
-	c.Session = session
+	c.Storage = storage
 	c.AccountTags = NewTags()
 	if conf["color-logs"] == "true" {
 		c.ColorLogs = true
@@ -81,17 +80,23 @@ func NewApiContext(r *http.Request, conf Configuration) (*ApiContext, error) {
 }
 
 func (c *ApiContext) Close() {
-	if c.Session != nil {
-		c.Session.Close()
+	if c.Storage != nil {
+		c.Storage.Close()
 	}
 }
 
+// IsMongoRunning opens the master database session shared by all requests
+// and checks that the database answers.
 func IsMongoRunning(conf Configuration) bool {
-	session, err := mgo.Dial(conf["databaseurl"])
-	if err != nil {
+	if err := OpenDatabase(conf); err != nil {
 		Log(nil, ERROR, "Failed to connect to database %s: %s", conf["databaseurl"], err.Error())
 		return false
 	}
+
+	session, err := copyDatabaseSession(conf)
+	if err != nil {
+		return false
+	}
 	defer session.Close()
 
 	bi, err := session.BuildInfo()
@@ -103,20 +108,18 @@ func IsMongoRunning(conf Configuration) bool {
     return true
 }
 
-func load_account_tags(session *mgo.Session, key string) ([]string, bool) {
+func load_account_tags(storage Storage, key string) ([]string, bool) {
 	var account Account
 
-	query := session.DB("ctp").C("accounts").Find(bson.M{"token": key})
-
-	count, err := query.Count()
+	err := storage.FindOne("accounts", Selector{"token": key}, &account)
+	if err == ErrNotFound {
+		// a rotated token remains valid until the end of its grace period.
+		err = storage.FindOne("accounts", Selector{"previousToken": key}, &account)
+	}
 	if err != nil {
 		return nil, false
 	}
-	if count == 0 {
-		return nil, false
-	}
-
-	if err = query.One(&account); err != nil {
+	if account.Token != key && account.PreviousTokenExpiry <= Now() {
 		return nil, false
 	}
 	if account.AccountTags == nil {
@@ -139,7 +142,7 @@ func (c *ApiContext) AuthenticateClient(w http.ResponseWriter, r *http.Request)
 
 	c.AccountTags = nil
 	if ok {
-		if accounttags, ok := load_account_tags(c.Session, token); ok {
+		if accounttags, ok := load_account_tags(c.Storage, token); ok {
 			c.AccountTags = accounttags
 			return true
 		}
@@ -159,18 +162,7 @@ func (c *ApiContext) AuthenticateClient(w http.ResponseWriter, r *http.Request)
 }
 
 func LoadResource(c *ApiContext, category string, id Base64Id, resource interface{}) bool {
-	query := c.Session.DB("ctp").C(category).FindId(id)
-
-	count, err := query.Count()
-	if err != nil {
-		return false
-	}
-	if count == 0 {
-		return false
-	}
-
-	err = query.One(resource)
-	if err != nil {
+	if err := c.Storage.Load(category, id, resource); err != nil {
 		return false
 	}
 	return true
@@ -191,28 +183,28 @@ func ParseResource(body io.ReadCloser, resource interface{}) error {
 }
 
 func CreateResource(c *ApiContext, category string, resource interface{}) bool {
-	if err := c.Session.DB("ctp").C(category).Insert(resource); err != nil {
+	if err := c.Storage.Create(category, resource); err != nil {
 		return false
 	}
 	return true
 }
 
 func UpdateResource(c *ApiContext, category string, id Base64Id, resource interface{}) bool {
-	if err := c.Session.DB("ctp").C(category).UpdateId(id, resource); err != nil {
+	if err := c.Storage.Update(category, id, resource); err != nil {
 		return false
 	}
 	return true
 }
 
 func DeleteResource(c *ApiContext, category string, id Base64Id) bool {
-	if err := c.Session.DB("ctp").C(category).RemoveId(id); err != nil {
+	if err := c.Storage.Delete(category, id); err != nil {
 		return false
 	}
 	return true
 }
 
 func UpdateResourcePart(c *ApiContext, category string, id Base64Id, part string, resource interface{}) bool {
-	if err := c.Session.DB("ctp").C(category).UpdateId(id, bson.M{"$set": bson.M{part: resource}}); err != nil {
+	if err := c.Storage.UpdateParts(category, id, map[string]interface{}{part: resource}); err != nil {
 		return false
 	}
 	return true
@@ -221,9 +213,16 @@ func UpdateResourcePart(c *ApiContext, category string, id Base64Id, part string
 /////////////////////////
 
 func RenderErrorResponse(w http.ResponseWriter, context *ApiContext, err *HttpError) {
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	body := map[string]interface{}{"error": err.Error()}
+	for k, v := range err.Details() {
+		body[k] = v
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(err.StatusCode())
-	fmt.Fprintf(w, `{ "error": "%s" }`, err.Error())
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(body)
 	Log(context, WARNING, "%s", err.Error())
 }
 
@@ -0,0 +1,168 @@
+//    Copyright 2015 Cloud Security Alliance EMEA (cloudsecurityalliance.org)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ctp
+
+import (
+	"errors"
+	"gopkg.in/mgo.v2"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrDatabaseUnavailable is returned when no session to the database can be
+// obtained for a request.
+var ErrDatabaseUnavailable = errors.New("Database is unavailable")
+
+// All requests share the socket pool of a single master session, which is
+// copied for each request.
+var (
+	masterSession *mgo.Session
+	masterMutex   sync.Mutex
+)
+
+// DatabaseIntegerOptions lists the configuration entries of the database
+// connection that hold a non-negative number (timeouts are in seconds).
+var DatabaseIntegerOptions = []string{"db_pool_limit", "db_timeout", "db_socket_timeout"}
+
+func databaseOption(conf Configuration, key string, def int) int {
+	if v, err := strconv.Atoi(conf[key]); err == nil && v >= 0 {
+		return v
+	}
+	return def
+}
+
+// dialDatabase opens a new session to the database in the 'databaseurl'
+// configuration entry.
+func dialDatabase(conf Configuration) (*mgo.Session, error) {
+	info, err := mgo.ParseURL(conf["databaseurl"])
+	if err != nil {
+		return nil, err
+	}
+	info.Timeout = time.Duration(databaseOption(conf, "db_timeout", 10)) * time.Second
+	if limit := databaseOption(conf, "db_pool_limit", 0); limit > 0 {
+		info.PoolLimit = limit
+	}
+
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	session.SetSyncTimeout(info.Timeout)
+	session.SetSocketTimeout(time.Duration(databaseOption(conf, "db_socket_timeout", 60)) * time.Second)
+	return session, nil
+}
+
+// OpenDatabase creates the master session used by all requests, replacing
+// any previous one.
+func OpenDatabase(conf Configuration) error {
+	session, err := dialDatabase(conf)
+	if err != nil {
+		return err
+	}
+
+	masterMutex.Lock()
+	if masterSession != nil {
+		masterSession.Close()
+	}
+	masterSession = session
+	masterMutex.Unlock()
+	return nil
+}
+
+// CloseDatabase closes the master session and its socket pool.
+func CloseDatabase() {
+	masterMutex.Lock()
+	if masterSession != nil {
+		masterSession.Close()
+		masterSession = nil
+	}
+	masterMutex.Unlock()
+}
+
+// copyDatabaseSession returns a copy of the master session for the duration of a
+// request, or ErrDatabaseUnavailable if the database does not answer. Unless
+// db_reconnect is "no", a missing master session is dialed again. Dialing
+// happens outside of the lock, so that requests do not queue behind a
+// connection attempt, and the new session is swapped in only if no other
+// request did so in the meantime.
+func copyDatabaseSession(conf Configuration) (*mgo.Session, error) {
+	var session *mgo.Session
+
+	masterMutex.Lock()
+	if masterSession != nil {
+		session = masterSession.Copy()
+	}
+	masterMutex.Unlock()
+
+	if session == nil {
+		if conf["db_reconnect"] == "no" {
+			return nil, ErrDatabaseUnavailable
+		}
+		dialed, err := dialDatabase(conf)
+		if err != nil {
+			Log(nil, ERROR, "Failed to connect to database %s: %s", conf["databaseurl"], err.Error())
+			return nil, ErrDatabaseUnavailable
+		}
+		masterMutex.Lock()
+		if masterSession == nil {
+			masterSession = dialed
+		} else {
+			dialed.Close()
+		}
+		session = masterSession.Copy()
+		masterMutex.Unlock()
+	}
+
+	// the master session outlives an outage, so check that the database
+	// still answers before serving the request.
+	if err := session.Ping(); err != nil {
+		session.Close()
+		Log(nil, ERROR, "Database %s is not answering: %s", conf["databaseurl"], err.Error())
+		if conf["db_reconnect"] != "no" {
+			refreshDatabase(err)
+		}
+		return nil, ErrDatabaseUnavailable
+	}
+	return session, nil
+}
+
+// isSocketError tells if err was caused by a lost connection to the database,
+// rather than by the operation itself.
+func isSocketError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return err == io.EOF || err.Error() == "no reachable servers"
+}
+
+// refreshDatabase makes the master session drop its sockets after an
+// operation failed with a socket error, so that the following requests
+// connect again instead of reusing a dead connection.
+func refreshDatabase(err error) {
+	if !isSocketError(err) {
+		return
+	}
+	masterMutex.Lock()
+	if masterSession != nil {
+		masterSession.Refresh()
+	}
+	masterMutex.Unlock()
+}
@@ -22,6 +22,7 @@ import (
 type HttpError struct {
 	code    int
 	message string
+	details map[string]interface{}
 }
 
 func (e *HttpError) Error() string {
@@ -32,20 +33,34 @@ func (e *HttpError) StatusCode() int {
 	return e.code
 }
 
+// WithDetail adds a property to the JSON body of the error response, next
+// to "error".
+func (e *HttpError) WithDetail(key string, value interface{}) *HttpError {
+	if e.details == nil {
+		e.details = make(map[string]interface{})
+	}
+	e.details[key] = value
+	return e
+}
+
+func (e *HttpError) Details() map[string]interface{} {
+	return e.details
+}
+
 func NewHttpError(code int, msg interface{}) *HttpError {
     switch msg.(type) {
     case string:
-        return &HttpError{code, msg.(string)}
+        return &HttpError{code, msg.(string), nil}
     case error:
-        return &HttpError{code, msg.(error).Error()}
+        return &HttpError{code, msg.(error).Error(), nil}
     case fmt.Stringer:
-        return &HttpError{code, msg.(fmt.Stringer).String()}
+        return &HttpError{code, msg.(fmt.Stringer).String(), nil}
     }
-    return &HttpError{code, fmt.Sprintf("%v",msg)}
+    return &HttpError{code, fmt.Sprintf("%v",msg), nil}
 }
 
 func NewHttpErrorf(code int, format string, params ...interface{}) *HttpError {
-    return &HttpError{code, fmt.Sprintf(format,params...)}
+    return &HttpError{code, fmt.Sprintf(format,params...), nil}
 }
 
 func NewInternalServerError(msg interface{}) *HttpError {
@@ -0,0 +1,109 @@
+//    Copyright 2015 Cloud Security Alliance EMEA (cloudsecurityalliance.org)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ctp
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ParseRSAPublicKey reads a PEM encoded RSA public key, either as a PKIX
+// "PUBLIC KEY", a PKCS#1 "RSA PUBLIC KEY" or a "CERTIFICATE".
+func ParseRSAPublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("Public key is not in PEM format")
+	}
+
+	var key interface{}
+	var err error
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block type '%s'", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Public key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+type jwsHeader struct {
+	Alg string `json:"alg"`
+}
+
+// VerifyJWS checks a JSON Web Signature in compact serialization (RFC 7515),
+// signed with RSASSA-PKCS1-v1_5 SHA-256 ("RS256"), and returns its payload.
+// If the JWS has a detached payload, the detached argument is used instead.
+func VerifyJWS(jws string, key *rsa.PublicKey, detached []byte) ([]byte, error) {
+	var header jwsHeader
+
+	parts := strings.Split(jws, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Signature is not in JWS compact serialization format")
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("Signature header is not base64url encoded")
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, errors.New("Signature header is not a JSON object")
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("Unsupported signature algorithm '%s'", header.Alg)
+	}
+
+	var payload []byte
+	if parts[1] == "" {
+		payload = detached
+		parts[1] = base64.RawURLEncoding.EncodeToString(detached)
+	} else if payload, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, errors.New("Signature payload is not base64url encoded")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Signature value is not base64url encoded")
+	}
+
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return nil, errors.New("Signature verification failed")
+	}
+	return payload, nil
+}
@@ -0,0 +1,65 @@
+package ctp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+func signJWS(t *testing.T, key *rsa.PrivateKey, header string, payload string) string {
+	input := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(payload))
+	hash := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal("Signing failed", err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyJWS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Key generation failed", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	public, err := ParseRSAPublicKey(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	if err != nil {
+		t.Fatal("ParseRSAPublicKey failed", err)
+	}
+
+	payload := `{"value":[{"a":1}],"updateTime":"2015-10-01T10:00:00Z","authorityId":"agent"}`
+	jws := signJWS(t, key, `{"alg":"RS256"}`, payload)
+
+	p, err := VerifyJWS(jws, public, nil)
+	if err != nil {
+		t.Fatal("VerifyJWS failed", err)
+	}
+	if string(p) != payload {
+		t.Error("Unexpected payload", string(p))
+	}
+
+	tampered := signJWS(t, key, `{"alg":"RS256"}`, payload)
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+	if _, err := VerifyJWS(tampered, public, nil); err == nil {
+		t.Error("Expected failure on tampered signature")
+	}
+
+	parts := strings.Split(signJWS(t, key, `{"alg":"RS256"}`, payload), ".")
+	detached := parts[0] + ".." + parts[2]
+	if _, err := VerifyJWS(detached, public, []byte(payload)); err != nil {
+		t.Error("VerifyJWS failed on detached payload", err)
+	}
+	if _, err := VerifyJWS(detached, public, []byte(`{"value":[]}`)); err == nil {
+		t.Error("Expected failure on different detached payload")
+	}
+
+	if _, err := VerifyJWS(signJWS(t, key, `{"alg":"none"}`, payload), public, nil); err == nil {
+		t.Error("Expected failure on unsupported algorithm")
+	}
+}
@@ -57,6 +57,25 @@ func propagateChangeId(context *ApiContext, res *Resource) bool {
     } else {
         category = context.Params[0]
     }
+    return propagateChangeIdOnce(context, category, res, nil)
+}
+
+// PropagateChangeIds copies the changeId of several resources of a category
+// to their ancestors, updating each ancestor only once.
+func PropagateChangeIds(context *ApiContext, category string, resources []*Resource) bool {
+    updated := make(map[Base64Id]bool)
+
+    for _, res := range resources {
+        if !propagateChangeIdOnce(context, category, res, updated) {
+            return false
+        }
+    }
+    return true
+}
+
+// propagateChangeIdOnce copies the changeId of res to its ancestors, skipping
+// those in updated, if not nil.
+func propagateChangeIdOnce(context *ApiContext, category string, res *Resource, updated map[Base64Id]bool) bool {
     o_category := category
 
     for i:=0; i<len(res.Parent); i++ {
@@ -65,13 +84,25 @@ func propagateChangeId(context *ApiContext, res *Resource) bool {
             category="attributes";
         case "attributes":
             category="assets"
-        case "assets", "triggers", "dependencies", "logs":
+        case "dependencies":
+            // a dependency is scoped by other dependencies up to the root service-view
+            if i == len(res.Parent)-1 {
+                category="serviceViews"
+            }
+        case "assets", "triggers", "logs":
             category="serviceViews"
         default:
             Log(context, ERROR, "Trying to propagate a changeId to '%s'",category)
             return false
         }
 
+        if updated != nil {
+            if updated[res.Parent[i]] {
+                continue
+            }
+            updated[res.Parent[i]] = true
+        }
+
         if !UpdateResourcePart(context,category,res.Parent[i],"changeId",res.ChangeId) {
             Log(context, ERROR, "Failed propagating a changeId to /%s/%s from /%s/%s",category,res.Parent[i],o_category,res.Id)
             return false
@@ -294,6 +325,13 @@ func (handler *DELETEHandler) Handle(w http.ResponseWriter, r *http.Request, con
 		return
 	}
 
+	// the ancestors of the deleted resource changed. The deletion itself
+	// succeeded, so a failure here is only logged.
+	resource.Super().ChangeId = NewBase64Id()
+	if !propagateChangeId(context, resource.Super()) {
+		Log(context, ERROR, "Failed to propagate changeId %s of deleted %s", resource.Super().ChangeId, r.RequestURI)
+	}
+
 	RenderJsonResponse(w, context, 204, nil)
 }
 
@@ -0,0 +1,81 @@
+//    Copyright 2015 Cloud Security Alliance EMEA (cloudsecurityalliance.org)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ctp
+
+import (
+	"errors"
+)
+
+// ErrNotFound is returned by a Storage when no resource matches a request.
+var ErrNotFound = errors.New("Resource not found")
+
+// A Selector describes the resources of a category that a query applies to.
+// Each key is the name of a property, or a dotted path such as "parent.0",
+// which must be equal to the associated value. As in MongoDB, an array
+// property matches if one of its elements is equal to the value.
+// A value of type AnyOf matches if the property is equal to any of the
+// listed values. A value of type Range matches if the property lies within
+// its bounds.
+type Selector map[string]interface{}
+
+type AnyOf []interface{}
+
+// A Range holds inclusive bounds on a string or a number, such as a
+// Timestamp. A nil bound is ignored.
+type Range struct {
+	Min interface{}
+	Max interface{}
+}
+
+// An Iterator walks through the results of a query.
+type Iterator interface {
+	Next(result interface{}) bool
+	Close() error
+}
+
+// Storage abstracts the persistence of CTP resources, which are grouped in
+// categories (e.g. "serviceViews", "measurements", ...). Resources are
+// encoded with their bson tags, whatever the implementation.
+type Storage interface {
+	Load(category string, id Base64Id, resource interface{}) error
+	Create(category string, resource interface{}) error
+	Update(category string, id Base64Id, resource interface{}) error
+	UpdateParts(category string, id Base64Id, parts map[string]interface{}) error
+	Delete(category string, id Base64Id) error
+	Count(category string, selector Selector) (int, error)
+	FindOne(category string, selector Selector, result interface{}) error
+	// Find returns the resources matching selector in insertion order, or sorted by the
+	// property sort if it is not empty, in descending order if it starts with '-'. It skips
+	// the first skip resources and returns at most limit resources, unless limit is 0.
+	Find(category string, selector Selector, sort string, skip int, limit int) Iterator
+	Close()
+}
+
+// openStorage returns the storage used for the duration of a request, as
+// selected by the 'storage' configuration entry.
+func openStorage(conf Configuration) (Storage, error) {
+	if conf["storage"] == "memory" {
+		if memoryStore == nil {
+			return nil, errors.New("In-memory storage is not initialized")
+		}
+		return memoryStore, nil
+	}
+
+	session, err := copyDatabaseSession(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &mongoStorage{session, conf["db_reconnect"] != "no"}, nil
+}
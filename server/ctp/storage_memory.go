@@ -0,0 +1,495 @@
+//    Copyright 2015 Cloud Security Alliance EMEA (cloudsecurityalliance.org)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ctp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// memoryCollection holds the bson encoding of resources, in insertion order.
+type memoryCollection struct {
+	order []Base64Id
+	docs  map[Base64Id][]byte
+}
+
+// memoryStorage keeps all resources in memory and is lost when ctpd stops.
+// Resources are stored bson encoded, so they are decoded exactly as they
+// would be if they were read from MongoDB.
+type memoryStorage struct {
+	mutex       sync.RWMutex
+	collections map[string]*memoryCollection
+}
+
+var memoryStore *memoryStorage
+
+func NewMemoryStorage() Storage {
+	return &memoryStorage{collections: make(map[string]*memoryCollection)}
+}
+
+// OpenMemoryStorage creates the in-memory storage used by all requests when
+// the 'storage' configuration entry is "memory". If 'storage_seed' is set, it
+// names a JSON file holding an object that maps each category to an array of
+// initial resources.
+func OpenMemoryStorage(conf Configuration) error {
+	store := NewMemoryStorage().(*memoryStorage)
+
+	if conf["storage_seed"] != "" {
+		var seed map[string][]map[string]interface{}
+
+		data, err := ioutil.ReadFile(conf["storage_seed"])
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &seed); err != nil {
+			return fmt.Errorf("Could not parse %s: %s", conf["storage_seed"], err.Error())
+		}
+		for category, resources := range seed {
+			for _, resource := range resources {
+				if err := store.Create(category, resource); err != nil {
+					return err
+				}
+			}
+		}
+		Log(nil, INFO, "Loaded in-memory storage from %s.", conf["storage_seed"])
+	}
+	memoryStore = store
+	return nil
+}
+
+func (s *memoryStorage) collection(category string) *memoryCollection {
+	c, ok := s.collections[category]
+	if !ok {
+		c = &memoryCollection{docs: make(map[Base64Id][]byte)}
+		s.collections[category] = c
+	}
+	return c
+}
+
+// memoryEncode returns the bson encoding of resource, with its _id set to id
+// unless id is empty.
+func memoryEncode(resource interface{}, id Base64Id) ([]byte, bson.M, error) {
+	var doc bson.M
+
+	data, err := bson.Marshal(resource)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+	if id != "" {
+		doc["_id"] = string(id)
+		data, err = bson.Marshal(doc)
+	}
+	return data, doc, err
+}
+
+// memoryNormalize converts a value to the form it has in a decoded bson document.
+func memoryNormalize(v interface{}) (interface{}, error) {
+	var doc bson.M
+
+	data, err := bson.Marshal(bson.M{"v": v})
+	if err != nil {
+		return nil, err
+	}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc["v"], nil
+}
+
+func memoryLookup(doc bson.M, path string) (interface{}, bool) {
+	var cur interface{} = doc
+
+	for _, key := range strings.Split(path, ".") {
+		switch c := cur.(type) {
+		case bson.M:
+			v, ok := c[key]
+			if !ok {
+				return nil, false
+			}
+			cur = v
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil, false
+			}
+			cur = c[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func memoryMatchValue(got interface{}, found bool, want interface{}) bool {
+	if !found {
+		return want == nil
+	}
+	if values, ok := got.([]interface{}); ok {
+		for _, v := range values {
+			if reflect.DeepEqual(v, want) {
+				return true
+			}
+		}
+	}
+	return reflect.DeepEqual(got, want)
+}
+
+// memoryCompare returns -1, 0 or 1 as a is less than, equal to or greater
+// than b, if both are strings or both are numbers.
+func memoryCompare(a, b interface{}) (int, bool) {
+	if sa, ok := a.(string); ok {
+		sb, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(sa, sb), true
+	}
+	fa, ok := memoryNumber(a)
+	if !ok {
+		return 0, false
+	}
+	fb, ok := memoryNumber(b)
+	if !ok {
+		return 0, false
+	}
+	switch {
+	case fa < fb:
+		return -1, true
+	case fa > fb:
+		return 1, true
+	}
+	return 0, true
+}
+
+func memoryNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func memoryMatchRange(got interface{}, found bool, bounds Range) (bool, error) {
+	if !found {
+		return false, nil
+	}
+	for _, bound := range []struct {
+		value interface{}
+		sign  int
+	}{{bounds.Min, -1}, {bounds.Max, 1}} {
+		if bound.value == nil {
+			continue
+		}
+		want, err := memoryNormalize(bound.value)
+		if err != nil {
+			return false, err
+		}
+		if c, ok := memoryCompare(got, want); !ok || c == bound.sign {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func memoryMatch(doc bson.M, selector Selector) (bool, error) {
+	for path, value := range selector {
+		got, found := memoryLookup(doc, path)
+
+		if bounds, ok := value.(Range); ok {
+			match, err := memoryMatchRange(got, found, bounds)
+			if !match || err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		wanted := AnyOf{value}
+		if values, ok := value.(AnyOf); ok {
+			wanted = values
+		}
+
+		match := false
+		for _, w := range wanted {
+			want, err := memoryNormalize(w)
+			if err != nil {
+				return false, err
+			}
+			if memoryMatchValue(got, found, want) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// selectLocked returns the resources of a category that match selector. The
+// caller must hold the mutex.
+func (s *memoryStorage) selectLocked(category string, selector Selector) ([][]byte, error) {
+	var result [][]byte
+
+	c, ok := s.collections[category]
+	if !ok {
+		return nil, nil
+	}
+	for _, id := range c.order {
+		var doc bson.M
+
+		if err := bson.Unmarshal(c.docs[id], &doc); err != nil {
+			return nil, err
+		}
+		match, err := memoryMatch(doc, selector)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			result = append(result, c.docs[id])
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryStorage) Load(category string, id Base64Id, resource interface{}) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	c, ok := s.collections[category]
+	if !ok {
+		return ErrNotFound
+	}
+	data, ok := c.docs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	return bson.Unmarshal(data, resource)
+}
+
+func (s *memoryStorage) Create(category string, resource interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, doc, err := memoryEncode(resource, "")
+	if err != nil {
+		return err
+	}
+
+	var id Base64Id
+	switch v := doc["_id"].(type) {
+	case nil:
+		id = NewBase64Id()
+		if data, _, err = memoryEncode(doc, id); err != nil {
+			return err
+		}
+	case string:
+		id = Base64Id(v)
+	default:
+		return errors.New("Resource id must be a string")
+	}
+
+	c := s.collection(category)
+	if _, exists := c.docs[id]; exists {
+		return fmt.Errorf("Duplicate key %s in %s", id, category)
+	}
+	c.order = append(c.order, id)
+	c.docs[id] = data
+	return nil
+}
+
+func (s *memoryStorage) Update(category string, id Base64Id, resource interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c := s.collection(category)
+	if _, ok := c.docs[id]; !ok {
+		return ErrNotFound
+	}
+	data, _, err := memoryEncode(resource, id)
+	if err != nil {
+		return err
+	}
+	c.docs[id] = data
+	return nil
+}
+
+func (s *memoryStorage) UpdateParts(category string, id Base64Id, parts map[string]interface{}) error {
+	var doc bson.M
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c := s.collection(category)
+	data, ok := c.docs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	for k, v := range parts {
+		doc[k] = v
+	}
+	data, _, err := memoryEncode(doc, id)
+	if err != nil {
+		return err
+	}
+	c.docs[id] = data
+	return nil
+}
+
+func (s *memoryStorage) Delete(category string, id Base64Id) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c := s.collection(category)
+	if _, ok := c.docs[id]; !ok {
+		return ErrNotFound
+	}
+	delete(c.docs, id)
+	for i, v := range c.order {
+		if v == id {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memoryStorage) Count(category string, selector Selector) (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	docs, err := s.selectLocked(category, selector)
+	return len(docs), err
+}
+
+func (s *memoryStorage) FindOne(category string, selector Selector, result interface{}) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	docs, err := s.selectLocked(category, selector)
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return ErrNotFound
+	}
+	return bson.Unmarshal(docs[0], result)
+}
+
+func (s *memoryStorage) Find(category string, selector Selector, order string, skip int, limit int) Iterator {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	docs, err := s.selectLocked(category, selector)
+	if err == nil && order != "" {
+		err = memorySort(docs, order)
+	}
+	if skip >= len(docs) {
+		docs = nil
+	} else {
+		docs = docs[skip:]
+	}
+	if limit > 0 && limit < len(docs) {
+		docs = docs[:limit]
+	}
+	return &memoryIterator{docs: docs, err: err}
+}
+
+// memorySort sorts docs by property, in descending order if it starts with
+// '-'. Missing properties sort first, as in MongoDB, and equal
+// properties keep their insertion order, reversed in descending order.
+func memorySort(docs [][]byte, property string) error {
+	type sortItem struct {
+		key  interface{}
+		data []byte
+	}
+	path := strings.TrimPrefix(property, "-")
+	descending := path != property
+
+	items := make([]sortItem, len(docs))
+	for i, data := range docs {
+		var doc bson.M
+
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		if descending {
+			i = len(docs) - 1 - i
+		}
+		items[i].key, _ = memoryLookup(doc, path)
+		items[i].data = data
+	}
+
+	less := func(a, b interface{}) bool {
+		if c, ok := memoryCompare(a, b); ok {
+			return c < 0
+		}
+		return a == nil && b != nil
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if descending {
+			return less(items[j].key, items[i].key)
+		}
+		return less(items[i].key, items[j].key)
+	})
+
+	for i := range items {
+		docs[i] = items[i].data
+	}
+	return nil
+}
+
+// Close does nothing: the in-memory storage is shared by all requests.
+func (s *memoryStorage) Close() {
+}
+
+// memoryIterator walks through a snapshot of the resources matched by a query.
+type memoryIterator struct {
+	docs [][]byte
+	err  error
+}
+
+func (it *memoryIterator) Next(result interface{}) bool {
+	if it.err != nil || len(it.docs) == 0 {
+		return false
+	}
+	if it.err = bson.Unmarshal(it.docs[0], result); it.err != nil {
+		return false
+	}
+	it.docs = it.docs[1:]
+	return true
+}
+
+func (it *memoryIterator) Close() error {
+	return it.err
+}
@@ -0,0 +1,111 @@
+package ctp
+
+import (
+	"testing"
+)
+
+type testResource struct {
+	NamedResource `bson:",inline"`
+	Status        BoolErr   `bson:"status"`
+	UpdateTime    Timestamp `bson:"updateTime"`
+}
+
+func TestMemoryStorage(t *testing.T) {
+	storage := NewMemoryStorage()
+
+	a := &testResource{NamedResource: NamedResource{Resource: Resource{Id: "a", Parent: []Base64Id{"p1", "p0"}}, Name: "first"}}
+	b := &testResource{NamedResource: NamedResource{Resource: Resource{Id: "b", Parent: []Base64Id{"p0"}}, Name: "second"}}
+	for _, r := range []*testResource{a, b} {
+		if err := storage.Create("things", r); err != nil {
+			t.Fatal("Create failed", err)
+		}
+	}
+	if err := storage.Create("things", a); err == nil {
+		t.Error("Expected an error when creating a duplicate")
+	}
+
+	var r testResource
+	if err := storage.Load("things", "a", &r); err != nil || r.Name != "first" || len(r.Parent) != 2 {
+		t.Error("Load failed", err, r)
+	}
+	if err := storage.Load("things", "c", &r); err != ErrNotFound {
+		t.Error("Expected ErrNotFound", err)
+	}
+
+	counts := []struct {
+		selector Selector
+		count    int
+	}{
+		{Selector{}, 2},
+		{Selector{"parent": Base64Id("p0")}, 2},
+		{Selector{"parent.0": Base64Id("p0")}, 1},
+		{Selector{"name": AnyOf{"first", "third"}}, 1},
+		{Selector{"name": "second", "parent": "p1"}, 0},
+		{Selector{"missing": nil}, 2},
+	}
+	for _, c := range counts {
+		if n, err := storage.Count("things", c.selector); err != nil || n != c.count {
+			t.Error("Count", c.selector, "returned", n, err, "expected", c.count)
+		}
+	}
+
+	now := Now()
+	if err := storage.UpdateParts("things", "b", map[string]interface{}{"status": Ttrue, "updateTime": now}); err != nil {
+		t.Fatal("UpdateParts failed", err)
+	}
+	if err := storage.FindOne("things", Selector{"status": Ttrue}, &r); err != nil || r.Id != "b" || r.UpdateTime != now {
+		t.Error("FindOne after UpdateParts failed", err, r)
+	}
+
+	counts = []struct {
+		selector Selector
+		count    int
+	}{
+		{Selector{"updateTime": Range{Min: now}}, 1},
+		{Selector{"updateTime": Range{Min: now - 60, Max: now}}, 1},
+		{Selector{"updateTime": Range{Max: now - 1}}, 1},
+		{Selector{"name": Range{Min: "first", Max: "second"}}, 2},
+		{Selector{"name": Range{Min: "g"}}, 1},
+		{Selector{"name": Range{Min: 1}}, 0},
+	}
+	for _, c := range counts {
+		if n, err := storage.Count("things", c.selector); err != nil || n != c.count {
+			t.Error("Count", c.selector, "returned", n, err, "expected", c.count)
+		}
+	}
+
+	finds := []struct {
+		sort  string
+		limit int
+		ids   string
+	}{
+		{"", 0, "ab"},
+		{"name", 0, "ab"},
+		{"-name", 0, "ba"},
+		{"-updateTime", 1, "b"},
+		{"missing", 0, "ab"},
+		{"-missing", 0, "ba"},
+	}
+	for _, f := range finds {
+		ids := ""
+		iter := storage.Find("things", Selector{}, f.sort, 0, f.limit)
+		for iter.Next(&r) {
+			ids += string(r.Id)
+		}
+		if err := iter.Close(); err != nil || ids != f.ids {
+			t.Error("Find sorted by", f.sort, "returned", ids, err, "expected", f.ids)
+		}
+	}
+
+	if err := storage.Delete("things", "a"); err != nil {
+		t.Fatal("Delete failed", err)
+	}
+	var ids []Base64Id
+	iter := storage.Find("things", Selector{}, "", 0, 0)
+	for iter.Next(&r) {
+		ids = append(ids, r.Id)
+	}
+	if err := iter.Close(); err != nil || len(ids) != 1 || ids[0] != "b" {
+		t.Error("Find after Delete returned", ids, err)
+	}
+}
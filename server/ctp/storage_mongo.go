@@ -0,0 +1,118 @@
+//    Copyright 2015 Cloud Security Alliance EMEA (cloudsecurityalliance.org)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ctp
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mongoStorage stores resources in the "ctp" database of a MongoDB server,
+// with one collection per category. Unless reconnect is false, the master
+// session is refreshed when an operation fails with a socket error.
+type mongoStorage struct {
+	session   *mgo.Session
+	reconnect bool
+}
+
+// mongoIterator refreshes the master session when a query fails with a
+// socket error.
+type mongoIterator struct {
+	*mgo.Iter
+	storage *mongoStorage
+}
+
+func (it *mongoIterator) Close() error {
+	return it.storage.check(it.Iter.Close())
+}
+
+func mongoError(err error) error {
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *mongoStorage) check(err error) error {
+	if s.reconnect {
+		refreshDatabase(err)
+	}
+	return mongoError(err)
+}
+
+func mongoSelector(selector Selector) bson.M {
+	query := make(bson.M, len(selector))
+	for k, v := range selector {
+		if values, ok := v.(AnyOf); ok {
+			query[k] = bson.M{"$in": []interface{}(values)}
+		} else if bounds, ok := v.(Range); ok {
+			cond := bson.M{}
+			if bounds.Min != nil {
+				cond["$gte"] = bounds.Min
+			}
+			if bounds.Max != nil {
+				cond["$lte"] = bounds.Max
+			}
+			query[k] = cond
+		} else {
+			query[k] = v
+		}
+	}
+	return query
+}
+
+func (s *mongoStorage) collection(category string) *mgo.Collection {
+	return s.session.DB("ctp").C(category)
+}
+
+func (s *mongoStorage) Load(category string, id Base64Id, resource interface{}) error {
+	return s.check(s.collection(category).FindId(id).One(resource))
+}
+
+func (s *mongoStorage) Create(category string, resource interface{}) error {
+	return s.check(s.collection(category).Insert(resource))
+}
+
+func (s *mongoStorage) Update(category string, id Base64Id, resource interface{}) error {
+	return s.check(s.collection(category).UpdateId(id, resource))
+}
+
+func (s *mongoStorage) UpdateParts(category string, id Base64Id, parts map[string]interface{}) error {
+	return s.check(s.collection(category).UpdateId(id, bson.M{"$set": bson.M(parts)}))
+}
+
+func (s *mongoStorage) Delete(category string, id Base64Id) error {
+	return s.check(s.collection(category).RemoveId(id))
+}
+
+func (s *mongoStorage) Count(category string, selector Selector) (int, error) {
+	count, err := s.collection(category).Find(mongoSelector(selector)).Count()
+	return count, s.check(err)
+}
+
+func (s *mongoStorage) FindOne(category string, selector Selector, result interface{}) error {
+	return s.check(s.collection(category).Find(mongoSelector(selector)).One(result))
+}
+
+func (s *mongoStorage) Find(category string, selector Selector, sort string, skip int, limit int) Iterator {
+	if sort == "" {
+		sort = "$natural"
+	}
+	return &mongoIterator{s.collection(category).Find(mongoSelector(selector)).Sort(sort).Skip(skip).Limit(limit).Iter(), s}
+}
+
+func (s *mongoStorage) Close() {
+	s.session.Close()
+}
@@ -0,0 +1,106 @@
+//    Copyright 2015 Cloud Security Alliance EMEA (cloudsecurityalliance.org)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/cloudsecurityalliance/ctpd/server/ctp"
+	"github.com/cloudsecurityalliance/ctpd/server/jsmm"
+	"strconv"
+	"time"
+)
+
+// MachineLimitOptions lists the configuration entries that bound the
+// resources used to evaluate an objective or a trigger condition. A value of 0
+// removes the corresponding limit. vm_timeout is in milliseconds.
+var MachineLimitOptions = []string{"vm_max_instructions", "vm_max_stack", "vm_max_values", "vm_max_string_bytes", "vm_timeout"}
+
+func machineLimits(conf ctp.Configuration) jsmm.Limits {
+	limits := jsmm.DefaultLimits
+
+	for _, key := range MachineLimitOptions {
+		v, err := strconv.Atoi(conf[key])
+		if err != nil || v < 0 {
+			continue
+		}
+		switch key {
+		case "vm_max_instructions":
+			limits.MaxInstructions = v
+		case "vm_max_stack":
+			limits.MaxStackSize = v
+		case "vm_max_values":
+			limits.MaxValues = v
+		case "vm_max_string_bytes":
+			limits.MaxStringBytes = v
+		case "vm_timeout":
+			limits.Timeout = time.Duration(v) * time.Millisecond
+		}
+	}
+	return limits
+}
+
+// programCache holds the compiled objectives and trigger conditions, shared
+// by all requests. Its size is set by the vm_cache_size configuration entry.
+var programCache = jsmm.NewProgramCache(defaultProgramCacheSize)
+
+const defaultProgramCacheSize = 1024
+
+// programCacheLogInterval is the number of program cache lookups between two
+// reports of the cache statistics in the logs.
+const programCacheLogInterval = 1000
+
+func programCacheSize(conf ctp.Configuration) int {
+	if v, err := strconv.Atoi(conf["vm_cache_size"]); err == nil && v >= 0 {
+		return v
+	}
+	return defaultProgramCacheSize
+}
+
+// newMachine returns a machine ready to evaluate expr with the builtin
+// functions and those of the given set, compiling expr only if it is not
+// found in the program cache.
+func newMachine(context *ctp.ApiContext, expr string, set jsmm.FunctionSet) (*jsmm.Machine, error) {
+	program, err := programCache.Get(expr)
+
+	hits, misses, size := programCache.Stats()
+	if (hits+misses)%programCacheLogInterval == 0 {
+		ctp.Log(context, ctp.INFO, "CTPScript cache: %d hits, %d misses, %d programs", hits, misses, size)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	machine := program.NewMachine()
+	machine.EnableFunctions(set)
+	if context.DebugVM {
+		machine.DebugMode(true)
+	}
+	machine.SetLimits(machineLimits(context.Configuration))
+	return machine, nil
+}
+
+// scriptErrorf returns a bad request error that locates err in the source of
+// the expression, with the "position" and "excerpt" properties of the error
+// response, if err is a jsmm.SourceError.
+func scriptErrorf(err error, format string, args ...interface{}) *ctp.HttpError {
+	httpErr := ctp.NewBadRequestErrorf(format, args...)
+
+	if serr, ok := err.(jsmm.SourceError); ok {
+		if pos, located := serr.Position(); located {
+			httpErr.WithDetail("position", pos).WithDetail("excerpt", serr.Excerpt())
+		}
+	}
+	return httpErr
+}
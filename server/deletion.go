@@ -17,12 +17,28 @@ package server
 
 import (
     "github.com/cloudsecurityalliance/ctpd/server/ctp"
-    "gopkg.in/mgo.v2/bson"
 )
 
 type deletecb func(*ctp.ApiContext, ctp.Base64Id) bool
 
+func logDelete(context *ctp.ApiContext, id ctp.Base64Id) bool {
+    return ctp.DeleteResource(context, "logs", id)
+}
+
+// triggerLogsDelete removes the log entries created by a trigger.
+// Older log entries refer to their trigger with an expanded link rather than a short one.
+func triggerLogsDelete(context *ctp.ApiContext, id ctp.Base64Id) bool {
+    link := ctp.NewLink(context.CtpBase, "@/triggers/$", id)
+    if !IterateChildrenDelete(context, "logs", "trigger", ctp.ShortenLink(context.CtpBase, link), logDelete) {
+        return false
+    }
+    return IterateChildrenDelete(context, "logs", "trigger", link, logDelete)
+}
+
 func measurementDelete(context *ctp.ApiContext, id ctp.Base64Id) bool {
+    if !measurementResultsDelete(context, id) {
+        return false
+    }
     return ctp.DeleteResource(context, "measurements", id)
 }
 
@@ -40,18 +56,33 @@ func assetDelete(context *ctp.ApiContext, id ctp.Base64Id) bool {
     return ctp.DeleteResource(context, "assets", id)
 }
 
+func dependencyDeleteOne(context *ctp.ApiContext, id ctp.Base64Id) bool {
+    return ctp.DeleteResource(context, "dependencies", id)
+}
+
+// dependencyDelete removes a dependency along with all the dependencies nested in it.
+// Since nested dependencies list all their ancestors in "parent", they are all selected at once.
+func dependencyDelete(context *ctp.ApiContext, id ctp.Base64Id) bool {
+    if !IterateChildrenDelete(context, "dependencies", "parent", id, dependencyDeleteOne) {
+        return false
+    }
+    return ctp.DeleteResource(context, "dependencies", id)
+}
+
 func serviceViewDelete(context *ctp.ApiContext, id ctp.Base64Id) bool {
     if !IterateChildrenDelete(context, "assets", "parent", id, assetDelete) {
         return false
     }
+    if !IterateChildrenDelete(context, "dependencies", "parent", id, dependencyDeleteOne) {
+        return false
+    }
     return ctp.DeleteResource(context, "serviceViews", id)
 }
 
-func IterateChildrenDelete(context *ctp.ApiContext, category string, selectorkey string, selectorvalue ctp.Base64Id, fn deletecb) bool {
+func IterateChildrenDelete(context *ctp.ApiContext, category string, selectorkey string, selectorvalue interface{}, fn deletecb) bool {
     var item ctp.Resource
 
-    query := context.Session.DB("ctp").C(category).Find(bson.M{selectorkey: string(selectorvalue)})
-    iter := query.Iter()
+    iter := context.Storage.Find(category, ctp.Selector{selectorkey: selectorvalue}, "", 0, 0)
     for iter.Next(&item) {
         if !fn(context, item.Id) {
             iter.Close()
@@ -0,0 +1,164 @@
+//    Copyright 2015 Cloud Security Alliance EMEA (cloudsecurityalliance.org)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/cloudsecurityalliance/ctpd/server/ctp"
+	"net/http"
+)
+
+// A Dependency is encoded like a service-view, except for its scope, which
+// is either a service-view or another dependency. When the supplementary
+// service-view is also exposed by this server, ServiceView refers to it.
+type Dependency struct {
+	ctp.NamedResource `bson:",inline"`
+	Provider          string    `json:"provider"              bson:"provider"`
+	Dependencies      ctp.Link  `json:"dependencies"          bson:"-"`
+	Assets            ctp.Link  `json:"assets,omitempty"      bson:"-"`
+	ServiceClass      *string   `json:"serviceClass"          bson:"serviceClass"`
+	Logs              ctp.Link  `json:"logs,omitempty"        bson:"-"`
+	Triggers          ctp.Link  `json:"triggers,omitempty"    bson:"-"`
+	ServiceView       *ctp.Link `json:"serviceView,omitempty" bson:"serviceView,omitempty"`
+}
+
+func (dependency *Dependency) BuildLinks(context *ctp.ApiContext) {
+	dependency.Self = ctp.NewLink(context.CtpBase, "@/dependencies/$", dependency.Id)
+	if len(dependency.Parent) == 1 {
+		dependency.Scope = ctp.NewLink(context.CtpBase, "@/serviceViews/$", dependency.Parent[0])
+	} else {
+		dependency.Scope = ctp.NewLink(context.CtpBase, "@/dependencies/$", dependency.Parent[0])
+	}
+	dependency.Dependencies = ctp.NewLink(context.CtpBase, "@/dependencies/$/dependencies", dependency.Id)
+	if dependency.ServiceView != nil {
+		*dependency.ServiceView = ctp.ExpandLink(context.CtpBase, *dependency.ServiceView)
+		dependency.Assets = *dependency.ServiceView + "/assets"
+		dependency.Logs = *dependency.ServiceView + "/logs"
+		dependency.Triggers = *dependency.ServiceView + "/triggers"
+	}
+}
+
+func (dependency *Dependency) Load(context *ctp.ApiContext) *ctp.HttpError {
+	if !ctp.LoadResource(context, "dependencies", ctp.Base64Id(context.Params[1]), dependency) {
+		return ctp.NewHttpError(http.StatusNotFound, "Not Found")
+	}
+	dependency.BuildLinks(context)
+	return nil
+}
+
+func (dependency *Dependency) Create(context *ctp.ApiContext) *ctp.HttpError {
+	var parent ctp.Resource
+
+	// POST /dependencies has no scope in its URL, so the scope is taken from the request body.
+	if params, ok := ctp.ParseLink(context.CtpBase, "@/serviceViews/$", dependency.Scope); ok {
+		if !ctp.LoadResource(context, "serviceViews", ctp.Base64Id(params[0]), &parent) {
+			return ctp.NewBadRequestErrorf("Service view %s does not exist", dependency.Scope)
+		}
+	} else if params, ok := ctp.ParseLink(context.CtpBase, "@/dependencies/$", dependency.Scope); ok {
+		if !ctp.LoadResource(context, "dependencies", ctp.Base64Id(params[0]), &parent) {
+			return ctp.NewBadRequestErrorf("Dependency %s does not exist", dependency.Scope)
+		}
+	} else {
+		return ctp.NewBadRequestError("Dependency scope must be a service view or another dependency")
+	}
+
+	if !ctp.MatchTags(context.AccountTags, parent.AccessTags) {
+		return ctp.NewHttpError(http.StatusUnauthorized, "You do not have permission to access this resource")
+	}
+
+	dependency.Parent = append([]ctp.Base64Id{parent.Id}, parent.Parent...)
+	if dependency.AccessTags == nil {
+		dependency.AccessTags = parent.AccessTags
+	}
+
+	if dependency.ServiceView != nil {
+		if err := dependencyCheckServiceView(context, dependency); err != nil {
+			return err
+		}
+		*dependency.ServiceView = ctp.ShortenLink(context.CtpBase, *dependency.ServiceView)
+	}
+
+	if !ctp.CreateResource(context, "dependencies", dependency) {
+		return ctp.NewHttpError(http.StatusInternalServerError, "Could not save dependency")
+	}
+	dependency.BuildLinks(context)
+	return nil
+}
+
+func (dependency *Dependency) Delete(context *ctp.ApiContext) *ctp.HttpError {
+	if !dependencyDelete(context, dependency.Id) {
+		return ctp.NewHttpError(http.StatusInternalServerError, "Could not delete dependency")
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////
+
+// dependencyCheckServiceView verifies that the service view referenced by a
+// dependency exists and is not one of the service views the dependency is
+// already attached to, since a service view cannot depend on itself.
+func dependencyCheckServiceView(context *ctp.ApiContext, dependency *Dependency) *ctp.HttpError {
+	var serviceview ServiceView
+
+	params, ok := ctp.ParseLink(context.CtpBase, "@/serviceViews/$", *dependency.ServiceView)
+	if !ok {
+		return ctp.NewBadRequestError("Invalid service view URL in dependency")
+	}
+	if !ctp.LoadResource(context, "serviceViews", ctp.Base64Id(params[0]), &serviceview) {
+		return ctp.NewBadRequestErrorf("Service view %s does not exist", *dependency.ServiceView)
+	}
+
+	root := dependency.Parent[len(dependency.Parent)-1]
+	if serviceview.Id == root {
+		return ctp.NewBadRequestError("A service view cannot depend on itself")
+	}
+
+	for _, ancestorId := range dependency.Parent[:len(dependency.Parent)-1] {
+		var ancestor Dependency
+
+		if !ctp.LoadResource(context, "dependencies", ancestorId, &ancestor) {
+			return ctp.NewInternalServerErrorf("Dependency %s is missing", ancestorId)
+		}
+		if ancestor.ServiceView != nil && ctp.ExpandLink(context.CtpBase, *ancestor.ServiceView) == ctp.ExpandLink(context.CtpBase, *dependency.ServiceView) {
+			return ctp.NewBadRequestError("A service view cannot depend on itself")
+		}
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////
+
+func HandleGETDependency(w http.ResponseWriter, r *http.Request, context *ctp.ApiContext) {
+	var dependency Dependency
+
+	handler := ctp.NewGETHandler(ctp.UserRoleTag)
+
+	handler.Handle(w, r, context, &dependency)
+}
+
+func HandlePOSTDependency(w http.ResponseWriter, r *http.Request, context *ctp.ApiContext) {
+	var dependency Dependency
+
+	handler := ctp.NewPOSTHandler(ctp.AdminRoleTag)
+
+	handler.Handle(w, r, context, &dependency)
+}
+
+func HandleDELETEDependency(w http.ResponseWriter, r *http.Request, context *ctp.ApiContext) {
+	var dependency Dependency
+
+	handler := ctp.NewDELETEHandler(ctp.AdminRoleTag)
+
+	handler.Handle(w, r, context, &dependency)
+}
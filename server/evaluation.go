@@ -0,0 +1,211 @@
+//    Copyright 2015 Cloud Security Alliance EMEA (cloudsecurityalliance.org)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/cloudsecurityalliance/ctpd/server/ctp"
+	"github.com/cloudsecurityalliance/ctpd/server/jsmm"
+	"net/http"
+)
+
+// maxEvaluationTrace bounds the number of instructions reported in the trace
+// of an evaluation.
+const maxEvaluationTrace = 1000
+
+// An EvaluationRequest is the body of POST /measurements/{id}?x=evaluate,
+// which evaluates an objective or a trigger condition against a measurement
+// without storing anything. If Result is set, it is evaluated instead of
+// the current result of the measurement.
+type EvaluationRequest struct {
+	Expression string  `json:"expression"`
+	Kind       string  `json:"kind"` // "objective" or "trigger"
+	Result     *Result `json:"result"`
+	Trace      bool    `json:"trace"`
+}
+
+// An EvaluationException describes an exception raised by an expression.
+type EvaluationException struct {
+	Message  string         `json:"message"`
+	Kind     string         `json:"kind"` // "error" or "limit"
+	Position *jsmm.Position `json:"position,omitempty"`
+	Excerpt  string         `json:"excerpt,omitempty"`
+}
+
+// An Evaluation reports the outcome of an EvaluationRequest: the status the
+// objective would get, or whether the trigger would fire, which is "error"
+// if the expression raised an exception. Note explains an outcome that was
+// decided without running the expression.
+type Evaluation struct {
+	Measurement    ctp.Link             `json:"measurement"`
+	Expression     string               `json:"expression"`
+	Kind           string               `json:"kind"`
+	Result         *Result              `json:"result"`
+	Value          interface{}          `json:"value"`
+	Outcome        ctp.BoolErr          `json:"outcome"`
+	Exception      *EvaluationException `json:"exception,omitempty"`
+	Note           string               `json:"note,omitempty"`
+	Trace          []jsmm.TraceStep     `json:"trace,omitempty"`
+	TraceTruncated bool                 `json:"traceTruncated,omitempty"`
+}
+
+func newEvaluationException(exception *jsmm.MachineException) *EvaluationException {
+	e := &EvaluationException{Message: exception.Message(), Kind: "error"}
+
+	if exception.Kind() == jsmm.ExceptionLimit {
+		e.Kind = "limit"
+	}
+	if pos, located := exception.Position(); located {
+		e.Position = &pos
+		e.Excerpt = exception.Excerpt()
+	}
+	return e
+}
+
+// measurementEvaluate evaluates an expression as measurementObjectiveEvaluate
+// or triggerCheckCondition would, but only reports the outcome.
+func measurementEvaluate(context *ctp.ApiContext, measurement *Measurement, request *EvaluationRequest) (*Evaluation, *ctp.HttpError) {
+	var set jsmm.FunctionSet
+
+	switch request.Kind {
+	case "", "objective":
+		request.Kind = "objective"
+		set = jsmm.ObjectiveFunctions
+	case "trigger":
+		set = jsmm.TriggerFunctions
+	default:
+		return nil, ctp.NewBadRequestError("kind must be either 'objective' or 'trigger'")
+	}
+
+	if request.Expression == "" {
+		return nil, ctp.NewBadRequestError("Missing expression")
+	}
+
+	machine, err := newMachine(context, request.Expression, set)
+	if err != nil {
+		return nil, scriptErrorf(err, "Error in expression - %s", err.Error())
+	}
+	machine.SetHostData(measurement)
+
+	if request.Result != nil {
+		metric, err := measurementLoadMetric(context, measurement)
+		if err != nil {
+			return nil, err
+		}
+		if err := resultCheckFormat(request.Result, metric); err != nil {
+			return nil, err
+		}
+		if request.Result.UpdateTime.IsZero() {
+			request.Result.UpdateTime = ctp.Now()
+		}
+		// the current result, if any, precedes the hypothetical one.
+		if machine.UsesGlobal("history") {
+			measurement.ResultId = ""
+			if _, err := measurementHistory(context, measurement, historyDepth(context.Configuration)); err != nil {
+				return nil, ctp.NewInternalServerErrorf("Error in evaluation while importing history - %s", err.Error())
+			}
+		}
+		measurement.Result = request.Result
+	}
+
+	evaluation := &Evaluation{
+		Measurement: measurement.Self,
+		Expression:  request.Expression,
+		Kind:        request.Kind,
+		Result:      measurement.Result,
+		Outcome:     ctp.Terror,
+	}
+
+	if request.Kind == "trigger" && measurement.State != "activated" {
+		evaluation.Outcome = ctp.Tfalse
+		evaluation.Note = "Measurement is not activated"
+		return evaluation, nil
+	}
+	if measurement.Result == nil {
+		evaluation.Outcome = ctp.ToBoolErr(request.Kind == "objective")
+		evaluation.Note = "Measurement has no result"
+		return evaluation, nil
+	}
+
+	if err := ImportMeasurementResultInJSMM(machine, measurement.Result); err != nil {
+		return nil, ctp.NewBadRequestErrorf("Error in evaluation while importing result - %s", err.Error())
+	}
+	if err := ImportMeasurementParametersInJSMM(machine, measurement.Parameters); err != nil {
+		return nil, ctp.NewBadRequestErrorf("Error in evaluation while importing parameters - %s", err.Error())
+	}
+	if err := importMeasurementHistoryInJSMM(context, machine, measurement); err != nil {
+		return nil, ctp.NewInternalServerErrorf("Error in evaluation while importing history - %s", err.Error())
+	}
+
+	if request.Trace {
+		machine.SetTracer(func(step jsmm.TraceStep) {
+			if len(evaluation.Trace) < maxEvaluationTrace {
+				evaluation.Trace = append(evaluation.Trace, step)
+			} else {
+				evaluation.TraceTruncated = true
+			}
+		})
+	}
+
+	v, exception := machine.Execute()
+	if exception != nil {
+		evaluation.Exception = newEvaluationException(exception)
+		return evaluation, nil
+	}
+	if v != nil {
+		evaluation.Value = jsmm.Export(v)
+		evaluation.Outcome = ctp.ToBoolErr(v.ToBoolean())
+	}
+	return evaluation, nil
+}
+
+// HandlePOSTMeasurementEvaluation serves POST /measurements/{id}?x=evaluate.
+// It is open to the accounts that can read the measurement.
+func HandlePOSTMeasurementEvaluation(w http.ResponseWriter, r *http.Request, context *ctp.ApiContext) {
+	var measurement Measurement
+	var request EvaluationRequest
+
+	if !context.AuthenticateClient(w, r) {
+		ctp.Log(context, ctp.WARNING, "Missing access tags")
+		return
+	}
+
+	if !context.VerifyAccessTags(w, ctp.UserRoleTag) {
+		ctp.Log(context, ctp.WARNING, "Mismatched access tags for API signature")
+		return
+	}
+
+	if err := measurement.Load(context); err != nil {
+		ctp.RenderErrorResponse(w, context, err)
+		return
+	}
+
+	if !context.VerifyAccessTags(w, measurement.AccessTags) {
+		ctp.Log(context, ctp.WARNING, "Mismatched access tags for resource")
+		return
+	}
+
+	if err := ctp.ParseResource(r.Body, &request); err != nil {
+		ctp.RenderErrorResponse(w, context, ctp.NewBadRequestErrorf("Failed to parse evaluation request, %s", err.Error()))
+		return
+	}
+
+	evaluation, err := measurementEvaluate(context, &measurement, &request)
+	if err != nil {
+		ctp.RenderErrorResponse(w, context, err)
+		return
+	}
+
+	ctp.RenderJsonResponse(w, context, 200, evaluation)
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/cloudsecurityalliance/ctpd/server/ctp"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testEvaluationMeasurement(t *testing.T, context *ctp.ApiContext, id string) *Measurement {
+	measurement, err := measurementBatchLoad(context, ctp.Link("@/measurements/"+id))
+	if err != nil {
+		t.Fatal("Could not load measurement", id, err)
+	}
+	return measurement
+}
+
+func TestMeasurementEvaluate(t *testing.T) {
+	context := testBatchContext(t)
+	context.AccountTags = ctp.NewTags("role:agent", "tag:a", "tag:b")
+
+	tests := []struct {
+		measurement string
+		state       ctp.MeasurementState
+		request     EvaluationRequest
+		outcome     ctp.BoolErr
+		note        string
+	}{
+		{"m1", "activated", EvaluationRequest{Expression: "value.length > 0"}, ctp.Ttrue, "Measurement has no result"},
+		{"m1", "activated", EvaluationRequest{Expression: "value.length > 0", Kind: "trigger"}, ctp.Tfalse, "Measurement has no result"},
+		{"m2", "deactivated", EvaluationRequest{Expression: "true", Kind: "trigger", Result: &Result{Value: []ResultRow{{"v": 1.0}}}}, ctp.Tfalse, "Measurement is not activated"},
+		{"m2", "deactivated", EvaluationRequest{Expression: "value[0].v > 0", Kind: "objective", Result: &Result{Value: []ResultRow{{"v": 1.0}}}}, ctp.Ttrue, ""},
+		{"m1", "activated", EvaluationRequest{Expression: "value[0].v > 5", Kind: "trigger", Result: &Result{Value: []ResultRow{{"v": 1.0}}}}, ctp.Tfalse, ""},
+	}
+	for _, test := range tests {
+		measurement := testEvaluationMeasurement(t, context, test.measurement)
+		measurement.State = test.state
+
+		evaluation, err := measurementEvaluate(context, measurement, &test.request)
+		if err != nil {
+			t.Errorf("Evaluation of %q failed: %s", test.request.Expression, err.Error())
+			continue
+		}
+		if evaluation.Outcome != test.outcome || evaluation.Note != test.note || evaluation.Exception != nil {
+			t.Errorf("Evaluation of %q as %s returned %s (%q), expected %s (%q)", test.request.Expression, test.request.Kind, evaluation.Outcome, evaluation.Note, test.outcome, test.note)
+		}
+	}
+
+	measurement := testEvaluationMeasurement(t, context, "m1")
+	for _, request := range []EvaluationRequest{
+		{Expression: "true", Kind: "condition"},
+		{Expression: ""},
+		{Expression: "1 +"},
+		{Expression: "true", Result: &Result{Value: []ResultRow{{"v": "x"}}}},
+	} {
+		if _, err := measurementEvaluate(context, measurement, &request); err == nil || err.StatusCode() != http.StatusBadRequest {
+			t.Errorf("Evaluation of %q as %q should fail with 400, got %v", request.Expression, request.Kind, err)
+		}
+	}
+}
+
+func TestMeasurementEvaluateHistory(t *testing.T) {
+	context := testBatchContext(t)
+	context.AccountTags = ctp.NewTags("role:agent", "tag:a")
+
+	measurementsAcceptBatch(context, &ResultBatch{Results: []BatchResult{{"@/measurements/m1", &Result{Value: []ResultRow{{"v": 7.0}}}}}})
+	measurement := testEvaluationMeasurement(t, context, "m1")
+
+	// the current result precedes the hypothetical one.
+	request := &EvaluationRequest{Expression: "history.length == 1 && history[0].value[0].v == 7 && value[0].v == 1", Result: &Result{Value: []ResultRow{{"v": 1.0}}}}
+	evaluation, err := measurementEvaluate(context, measurement, request)
+	if err != nil || evaluation.Outcome != ctp.Ttrue {
+		t.Error("Evaluation against history returned", evaluation, err)
+	}
+}
+
+func TestMeasurementEvaluateException(t *testing.T) {
+	context := testBatchContext(t)
+	context.AccountTags = ctp.NewTags("role:agent", "tag:a")
+	measurement := testEvaluationMeasurement(t, context, "m1")
+
+	request := &EvaluationRequest{Expression: "value.length > 0 &&\n value[0].v.x.y > 1", Result: &Result{Value: []ResultRow{{"v": 1.0}}}}
+	evaluation, err := measurementEvaluate(context, measurement, request)
+	if err != nil {
+		t.Fatal("Evaluation failed:", err.Error())
+	}
+	if evaluation.Outcome != ctp.Terror || evaluation.Exception == nil {
+		t.Fatal("Expected an exception, got", evaluation.Outcome)
+	}
+	if evaluation.Exception.Kind != "error" || evaluation.Exception.Position == nil || evaluation.Exception.Position.Line != 2 || evaluation.Exception.Excerpt == "" {
+		t.Errorf("Exception is not located: %+v", evaluation.Exception)
+	}
+}
+
+func TestMeasurementEvaluateTrace(t *testing.T) {
+	context := testBatchContext(t)
+	context.AccountTags = ctp.NewTags("role:agent", "tag:a")
+	result := &Result{Value: []ResultRow{{"v": 1.0}}}
+
+	measurement := testEvaluationMeasurement(t, context, "m1")
+	evaluation, err := measurementEvaluate(context, measurement, &EvaluationRequest{Expression: "value[0].v > 0", Result: result, Trace: true})
+	if err != nil || len(evaluation.Trace) == 0 || evaluation.TraceTruncated {
+		t.Error("Short evaluation has a trace of", len(evaluation.Trace), "steps", err)
+	}
+
+	measurement = testEvaluationMeasurement(t, context, "m1")
+	long := strings.Repeat("value[0].v + ", maxEvaluationTrace) + "1 > 0"
+	evaluation, err = measurementEvaluate(context, measurement, &EvaluationRequest{Expression: long, Result: result, Trace: true})
+	if err != nil || len(evaluation.Trace) != maxEvaluationTrace || !evaluation.TraceTruncated {
+		t.Error("Long evaluation has a trace of", len(evaluation.Trace), "steps", evaluation.TraceTruncated, err)
+	}
+	if evaluation.Outcome != ctp.Ttrue {
+		t.Error("Long evaluation returned", evaluation.Outcome)
+	}
+}
+
+func TestHandlePOSTMeasurementEvaluation(t *testing.T) {
+	context := testBatchContext(t)
+	context.Params = []string{"measurements", "m1"}
+
+	account := &ctp.Account{AccountTags: ctp.NewTags("role:user", "tag:a"), Token: "user"}
+	account.Id = "account2"
+	if !ctp.CreateResource(context, "accounts", account) {
+		t.Fatal("Could not create account")
+	}
+
+	counts := func() []int {
+		var n []int
+		for _, category := range []string{"logs", "results", "measurements", "triggers"} {
+			count, _ := context.Storage.Count(category, ctp.Selector{})
+			n = append(n, count)
+		}
+		return n
+	}
+	before := counts()
+
+	tests := []struct {
+		token string
+		body  string
+		code  int
+	}{
+		{"user", `{"expression":"value[0].v > 5","kind":"trigger","result":{"value":[{"v":7}]},"trace":true}`, http.StatusOK},
+		{"user", `{"expression":"value[0].v > 5","result":{"value":[{"v":"7"}]}}`, http.StatusBadRequest},
+		{"user", `{"expression":`, http.StatusBadRequest},
+		{"agent", `{"expression":"true"}`, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/measurements/m1?x=evaluate", strings.NewReader(test.body))
+		r.Header.Set("Authorization", "Bearer "+test.token)
+		w := httptest.NewRecorder()
+
+		HandlePOSTMeasurementEvaluation(w, r, context)
+		if w.Code != test.code {
+			t.Errorf("POST %s returned %d, expected %d: %s", test.body, w.Code, test.code, w.Body.String())
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+
+		var evaluation Evaluation
+		if err := json.Unmarshal(w.Body.Bytes(), &evaluation); err != nil {
+			t.Fatal("Invalid response body:", err, w.Body.String())
+		}
+		if evaluation.Outcome != ctp.Ttrue || len(evaluation.Trace) == 0 || evaluation.Measurement != "https://localhost/api/1.0/measurements/m1" {
+			t.Error("Unexpected response body:", w.Body.String())
+		}
+	}
+
+	after := counts()
+	for i := range before {
+		if before[i] != after[i] {
+			t.Errorf("Evaluation changed the number of stored resources from %v to %v", before, after)
+			break
+		}
+	}
+
+	var measurement Measurement
+	var trigger Trigger
+	if !ctp.LoadResource(context, "measurements", "m1", &measurement) || measurement.Result != nil || measurement.ChangeId != "" {
+		t.Error("Evaluation changed the measurement:", measurement.Result, measurement.ChangeId)
+	}
+	if !ctp.LoadResource(context, "triggers", "trigger1", &trigger) || trigger.Status != ctp.Tfalse {
+		t.Error("Evaluation changed the trigger status to", trigger.Status)
+	}
+}
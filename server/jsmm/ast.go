@@ -21,6 +21,17 @@ import (
 type Expression interface {
 	String() string
 	Compile(m *Machine)
+	Pos() Position
+}
+
+// node holds the position of an expression in the source, which is the
+// position of its operator, or of its first token if it has none.
+type node struct {
+	pos Position
+}
+
+func (n *node) Pos() Position {
+	return n.pos
 }
 
 //
@@ -28,10 +39,11 @@ type Expression interface {
 //
 type literalNumberExpr struct {
 	value string
+	node
 }
 
 func (e *literalNumberExpr) Compile(m *Machine) {
-	m.AddIParam(i_load_const, m.AddConst(NewNumberString(e.value)))
+	m.Mark(e.pos).AddIParam(i_load_const, m.AddConst(NewNumberString(e.value)))
 }
 func (l *literalNumberExpr) String() string {
 	return l.value
@@ -42,10 +54,11 @@ func (l *literalNumberExpr) String() string {
 //
 type literalStringExpr struct {
 	value string
+	node
 }
 
 func (e *literalStringExpr) Compile(m *Machine) {
-	m.AddIParam(i_load_const, m.AddConst(NewString(e.value)))
+	m.Mark(e.pos).AddIParam(i_load_const, m.AddConst(NewString(e.value)))
 }
 func (e *literalStringExpr) String() string {
 	return fmt.Sprintf("\"%s\"", e.value)
@@ -56,10 +69,11 @@ func (e *literalStringExpr) String() string {
 //
 type literalBooleanExpr struct {
 	value string
+	node
 }
 
 func (e *literalBooleanExpr) Compile(m *Machine) {
-	m.AddIParam(i_load_const, m.AddConst(NewBooleanString(e.value)))
+	m.Mark(e.pos).AddIParam(i_load_const, m.AddConst(NewBooleanString(e.value)))
 }
 func (e *literalBooleanExpr) String() string {
 	return e.value
@@ -68,10 +82,12 @@ func (e *literalBooleanExpr) String() string {
 //
 // Literal null
 //
-type literalNullExpr struct  {}
+type literalNullExpr struct  {
+	node
+}
 
 func (n *literalNullExpr) Compile(m *Machine) {
-	m.AddIParam(i_load_const, m.AddConst(NewNull()))
+	m.Mark(n.pos).AddIParam(i_load_const, m.AddConst(NewNull()))
 }
 func (n *literalNullExpr) String() string {
 	return "null"
@@ -112,6 +128,7 @@ type functionCallExpr struct {
 	base      Expression
 	fname     Expression
 	arguments ExpressionList
+	node
 }
 
 func (e *functionCallExpr) Compile(m *Machine) {
@@ -120,7 +137,7 @@ func (e *functionCallExpr) Compile(m *Machine) {
     }
 	e.base.Compile(m)
 	e.fname.Compile(m)
-	m.AddIParam(i_call, e.arguments.Length()+1)
+	m.Mark(e.pos).AddIParam(i_call, e.arguments.Length()+1)
 }
 
 func (e *functionCallExpr) String() string {
@@ -134,12 +151,18 @@ func (e *functionCallExpr) String() string {
 type attributeSelectionExpr struct {
 	base      Expression
 	selection Expression
+	node
 }
 
 func (e *attributeSelectionExpr) Compile(m *Machine) {
+	if _, ok := e.base.(*getGlobalObjectExpr); ok {
+		if name, ok := e.selection.(*literalStringExpr); ok {
+			m.globals[name.value] = true
+		}
+	}
 	e.base.Compile(m)
 	e.selection.Compile(m)
-	m.AddI(i_get_index)
+	m.Mark(e.pos).AddI(i_get_index)
 }
 
 func (e *attributeSelectionExpr) String() string {
@@ -150,10 +173,12 @@ func (e *attributeSelectionExpr) String() string {
 // Attribute base
 //
 
-type getGlobalObjectExpr struct{}
+type getGlobalObjectExpr struct{
+	node
+}
 
 func (e *getGlobalObjectExpr) Compile(m *Machine) {
-	m.AddI(i_get_global)
+	m.Mark(e.pos).AddI(i_get_global)
 }
 
 func (e *getGlobalObjectExpr) String() string {
@@ -166,10 +191,11 @@ func (e *getGlobalObjectExpr) String() string {
 
 type arrayDefExpr struct {
 	value ExpressionList
+	node
 }
 
 func (e *arrayDefExpr) Compile(m *Machine) {
-	m.AddI(i_newarray)
+	m.Mark(e.pos).AddI(i_newarray)
     for i:=0; i<e.value.Length(); i++ {
         e.value.Get(i).Compile(m)
     }
@@ -184,10 +210,11 @@ func (e *arrayDefExpr) String() string {
 
 type objectDefExpr struct {
 	value ExpressionList
+	node
 }
 
 func (e *objectDefExpr) Compile(m *Machine) {
-	m.AddI(i_newobject)
+	m.Mark(e.pos).AddI(i_newobject)
     for i:=0; i<e.value.Length(); i++ {
         e.value.Get(i).Compile(m)
     }
@@ -243,6 +270,7 @@ type binExpr struct {
 	op int
 	x  Expression
 	y  Expression
+	node
 }
 
 func (e *binExpr) String() string {
@@ -251,7 +279,62 @@ func (e *binExpr) String() string {
 func (e *binExpr) Compile(m *Machine) {
 	e.x.Compile(m)
 	e.y.Compile(m)
-	m.AddI(byte(e.op))
+	m.Mark(e.pos).AddI(byte(e.op))
+}
+
+//
+// Logical expression (&&,||)
+//
+// As in javascript, the right operand is only evaluated if the left operand
+// does not determine the result, and the result is the value of the last
+// evaluated operand.
+//
+
+type logicalExpr struct {
+	op int // i_jump_if_false_or_pop for &&, i_jump_if_true_or_pop for ||
+	x  Expression
+	y  Expression
+	node
+}
+
+func (e *logicalExpr) String() string {
+	if e.op == i_jump_if_false_or_pop {
+		return fmt.Sprintf("(&& %s %s)", e.x.String(), e.y.String())
+	}
+	return fmt.Sprintf("(|| %s %s)", e.x.String(), e.y.String())
+}
+func (e *logicalExpr) Compile(m *Machine) {
+	e.x.Compile(m)
+	jump := len(m.code)
+	m.Mark(e.pos).AddIParam(byte(e.op), 0)
+	e.y.Compile(m)
+	m.SetIParamAt(jump, len(m.code)-jump-Ops[e.op].length)
+}
+
+//
+// Conditional expression (cond ? x : y)
+//
+
+type conditionalExpr struct {
+	cond Expression
+	x    Expression
+	y    Expression
+	node
+}
+
+func (e *conditionalExpr) String() string {
+	return fmt.Sprintf("(? %s %s %s)", e.cond.String(), e.x.String(), e.y.String())
+}
+func (e *conditionalExpr) Compile(m *Machine) {
+	e.cond.Compile(m)
+	jumpElse := len(m.code)
+	m.Mark(e.pos).AddIParam(i_jump_if_false, 0)
+	e.x.Compile(m)
+	jumpEnd := len(m.code)
+	m.Mark(e.pos).AddIParam(i_jump, 0)
+	m.SetIParamAt(jumpElse, len(m.code)-jumpElse-Ops[i_jump_if_false].length)
+	e.y.Compile(m)
+	m.SetIParamAt(jumpEnd, len(m.code)-jumpEnd-Ops[i_jump].length)
 }
 
 //
@@ -261,6 +344,7 @@ func (e *binExpr) Compile(m *Machine) {
 type unaryExpr struct {
 	op int
 	x  Expression
+	node
 }
 
 func (e *unaryExpr) String() string {
@@ -268,7 +352,7 @@ func (e *unaryExpr) String() string {
 }
 func (e *unaryExpr) Compile(m *Machine) {
 	e.x.Compile(m)
-	m.AddI(byte(e.op))
+	m.Mark(e.pos).AddI(byte(e.op))
 }
 
 /*
@@ -17,8 +17,8 @@ package jsmm
 
 import (
 	"reflect"
-    "strconv"
     "errors"
+	"math"
 )
 
 const (
@@ -45,13 +45,13 @@ func importValue(val reflect.Value) (MachineValue, error) {
     case reflect.String:
         return NewString(val.String()), nil
     case reflect.Slice, reflect.Array:
-        array := NewObject()
+        array := NewArray()
         for i := 0; i< val.Len(); i++ {
             v, e := importValue(val.Index(i))
             if e!=nil {
                 return NewNull(), e
             }
-            array.SetProperty(strconv.Itoa(i),v)
+            array.Push(v)
         }
         return array, nil
     case reflect.Struct:
@@ -93,12 +93,18 @@ func importValue(val reflect.Value) (MachineValue, error) {
         }
         return NewNull(), errors.New("Cannot import maps with non-string indices")
     case reflect.Interface:
+        if val.IsNil() {
+            return NewNull(), nil
+        }
         return importValue(val.Elem())
     }
     return NewNull(), errors.New("Cannot import " + typ.String())
 }
 
 func Import(item interface{}) (MachineValue, error) {
+	if item == nil {
+		return NewNull(), nil
+	}
 	return importValue(reflect.ValueOf(item))
 }
 
@@ -110,3 +116,44 @@ func ImportGlobal(m *Machine, name string, item interface{}) error {
     m.GlobalObject().SetProperty(name,v)
     return nil
 }
+
+// Export converts a value of the machine to the Go value that encodes the
+// same JSON: nil, bool, float64, string, []interface{} or
+// map[string]interface{}. As in JavaScript, NaN, infinities and functions
+// become nil, and functions are left out of objects.
+func Export(v MachineValue) interface{} {
+	switch v.Type() {
+	case TypeBoolean:
+		return v.ToBoolean()
+	case TypeNumber:
+		n := v.ToNumber()
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil
+		}
+		return n
+	case TypeString:
+		return v.ToString()
+	case TypeArray:
+		var i uint32
+
+		a := v.(*Array)
+		result := make([]interface{}, a.length)
+		for i = 0; i < a.length; i++ {
+			if item, err := a.GetUInt32Property(i); err == nil {
+				result[i] = Export(item)
+			}
+		}
+		return result
+	case TypeObject:
+		if o, ok := v.(*Object); ok {
+			result := make(map[string]interface{}, len(o.value))
+			for key, item := range o.value {
+				if item.Type() != TypeFunction {
+					result[key] = Export(item)
+				}
+			}
+			return result
+		}
+	}
+	return nil
+}
@@ -15,7 +15,9 @@
 package jsmm
 
 import (
+	"math"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
@@ -50,7 +52,11 @@ func ToArray(m *Machine, fn *Function, paramCount int) (int, *MachineException)
 	case TypeArray:
 		m.Push(objref)
 	case TypeString:
-		reader := strings.NewReader(objref.ToString())
+		str := objref.ToString()
+		if err := m.Allocate(len(str), len(str)); err != nil {
+			return 0, err
+		}
+		reader := strings.NewReader(str)
 		a := NewArray()
 		index := uint32(0)
 		for {
@@ -103,38 +109,62 @@ func MatchRegexp(m *Machine, fn *Function, paramCount int) (int, *MachineExcepti
 	objref := m.Get(-3)
 
 	if reref.Type() != TypeString {
-		m.Push(NewNull())
-		return 1, nil
+		return 0, NewMachineException("matchRegexp expects a regular expression string, got %s instead", TypeOf(reref))
 	}
 
+	// Go regexps match in linear time, so a pattern cannot take the machine
+	// hostage. The deadline is still checked between elements of an array.
 	re, err := regexp.CompilePOSIX(reref.ToString())
 	if err != nil {
-		return 0, NewMachineException("matchRegex failed, " + err.Error())
+		return 0, NewMachineException("matchRegexp failed, " + err.Error())
 	}
 
-	switch objref.Type() {
+	match, merr := matchRegexp(m, re, objref)
+	if merr != nil {
+		return 0, merr
+	}
+	m.Push(NewBoolean(match))
+	return 1, nil
+}
+
+// matchRegexp tells if a string, or all the elements of an array, match re.
+func matchRegexp(m *Machine, re *regexp.Regexp, v MachineValue) (bool, *MachineException) {
+	switch v.Type() {
 	case TypeString:
-		m.Push(NewBoolean(re.MatchString(objref.ToString())))
+		return re.MatchString(v.ToString()), nil
 	case TypeArray:
 		var i uint32
 
-		array := objref.(*Array)
-		retval := false
-
+		array := v.(*Array)
 		for i = 0; i < array.length; i++ {
+			if merr := m.CheckDeadline(); merr != nil {
+				return false, merr
+			}
 			val, err := array.GetUInt32Property(i)
-			if err == nil && val.Type() == TypeString {
-				retval = re.MatchString(val.ToString())
-				if !retval {
-				    break
-                }
+			if err != nil {
+				return false, err
+			}
+			match, merr := matchRegexp(m, re, val)
+			if merr != nil || !match {
+				return false, merr
 			}
 		}
-		m.Push(NewBoolean(retval))
-	default:
-		return 0, NewMachineException("matchRegex expects a string or an array as parameters")
+		return true, nil
 	}
-	return 1, nil
+	return false, NewMachineException("matchRegexp expects a string or an array of strings, got %s instead", TypeOf(v))
+}
+
+// getField returns the property prop of an object or an array, or null if
+// v has no such property.
+func getField(v MachineValue, prop string) MachineValue {
+	if v.Type() != TypeObject && v.Type() != TypeArray {
+		return NullConst
+	}
+	val, err := v.GetProperty(prop)
+	if err != nil {
+		return NullConst
+	}
+	return val
 }
 
 func Select(m *Machine, fn *Function, paramCount int) (int, *MachineException) {
@@ -144,84 +174,321 @@ func Select(m *Machine, fn *Function, paramCount int) (int, *MachineException) {
 	keyref := m.Get(-2)
 	objref := m.Get(-3)
 
-	if keyref.Type() != TypeString || objref.Type() != TypeArray {
+	if (keyref.Type() != TypeString && keyref.Type() != TypeNumber) || objref.Type() != TypeArray {
 		return 0, NewMachineException("select expects a string key and an array as parameters, got (%s,%s) instead", TypeOf(keyref), TypeOf(objref))
 	}
 
 	var i uint32
 	result := NewArray()
 	array := objref.(*Array)
-	key := keyref.ToString()
+	key := propertyKey(keyref)
 
+	if merr := m.Allocate(int(array.length), 0); merr != nil {
+		return 0, merr
+	}
 	for i = 0; i < array.length; i++ {
 		val, err := array.GetUInt32Property(i)
-		if err == nil {
-			val2, err2 := val.GetProperty(key)
-			if err2 == nil {
-				result.Push(val2)
-			}
+		if err != nil {
+			val = NullConst
 		}
+		result.Push(getField(val, key))
 	}
 	m.Push(result)
 	return 1, nil
 }
 
+// arrayExtreme returns the element t[i] of the array a method is called on
+// such that before(t[i], t[j]) for every other element t[j], or null if
+// there is none. If several elements qualify, the first one is returned,
+// unless last is true.
+func arrayExtreme(m *Machine, before func(a, b MachineValue) bool, last bool) (int, *MachineException) {
+	// stack -1: table object
+	array, ok := m.Get(-1).(*Array)
+	if !ok {
+		return 0, NewMachineException("Array method called on non-array object")
+	}
+
+	var i uint32
+	var ref MachineValue
+
+	// a single pass finds the element when before is a total order, the
+	// second one checks it when it is not, e.g. with NaN or mixed types.
+	ref = NullConst
+	index := uint32(0)
+	for i = 0; i < array.length; i++ {
+		val, err := array.GetUInt32Property(i)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case i == 0:
+			ref = val
+		case last && before(val, ref), !last && !before(ref, val):
+			ref, index = val, i
+		}
+	}
+	for i = 0; i < array.length; i++ {
+		val, _ := array.GetUInt32Property(i)
+		if i != index && !before(ref, val) {
+			m.Push(NullConst)
+			return 1, nil
+		}
+	}
+	m.Push(ref)
+	return 1, nil
+}
+
+func lessThanOrEqual(a, b MachineValue) bool {
+	return lessThan(a, b) || equal(a, b)
+}
+
+func greaterThanOrEqual(a, b MachineValue) bool {
+	return lessThan(b, a) || equal(a, b)
+}
+
 func ArrayMin(m *Machine, fn *Function, paramCount int) (int, *MachineException) {
+	return arrayExtreme(m, lessThanOrEqual, false)
+}
+
+func ArrayMax(m *Machine, fn *Function, paramCount int) (int, *MachineException) {
+	return arrayExtreme(m, greaterThanOrEqual, true)
+}
+
+// arrayNumbers returns the numbers among the elements of the array a method
+// is called on, or among the property key of its elements if the first
+// parameter is a string key. Other values, including null, are ignored.
+// Besides the optional key, the method expects extra parameters, which
+// follow the key.
+func arrayNumbers(m *Machine, name string, paramCount int, extra int) ([]float64, *MachineException) {
 	// stack -1: table object
-	arrayref := m.Get(-1)
+	// stack -2: optional key
+	array, ok := m.Get(-1).(*Array)
+	if !ok {
+		return nil, NewMachineException("Array method called on non-array object")
+	}
 
-	if array, ok := arrayref.(*Array); ok {
-		var i uint32
-		var ref MachineValue
+	var key string
+	byKey := paramCount == 2+extra
+	switch paramCount {
+	case 1 + extra:
+	case 2 + extra:
+		if m.Get(-2).Type() != TypeString {
+			return nil, NewMachineException("%s() expects a string key, got %s", name, TypeOf(m.Get(-2)))
+		}
+		key = m.Get(-2).ToString()
+	default:
+		return nil, NewMachineException("Wrong number of parameters in call to %s()", name)
+	}
 
-		ref = NullConst
+	if merr := m.Allocate(int(array.length), 0); merr != nil {
+		return nil, merr
+	}
 
-		for i = 0; i < array.length; i++ {
+	var i uint32
+	numbers := make([]float64, 0, array.length)
 
-			val, err := array.GetUInt32Property(i)
-			if err == nil && val.Type() != TypeNull {
-				if ref == NullConst {
-					ref = val
-				} else {
-					if lessThan(val, ref) {
-						ref = val
-					}
-				}
-			}
+	for i = 0; i < array.length; i++ {
+		if merr := m.CheckDeadline(); merr != nil {
+			return nil, merr
 		}
-		m.Push(ref)
-	} else {
-		return 0, NewMachineException("Array method called on non-array object")
+		val, err := array.GetUInt32Property(i)
+		if err != nil {
+			continue
+		}
+		if byKey {
+			val = getField(val, key)
+		}
+		if val.Type() == TypeNumber {
+			numbers = append(numbers, val.ToNumber())
+		}
+	}
+	return numbers, nil
+}
+
+// percentile returns the p-th percentile of sorted numbers, interpolating
+// linearly between the closest ranks.
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := math.Floor(rank)
+	if lower >= float64(len(sorted)-1) {
+		return sorted[len(sorted)-1]
 	}
+	i := int(lower)
+	return sorted[i] + (rank-lower)*(sorted[i+1]-sorted[i])
+}
+
+func ArraySum(m *Machine, fn *Function, paramCount int) (int, *MachineException) {
+	numbers, err := arrayNumbers(m, "sum", paramCount, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	sum := 0.0
+	for _, n := range numbers {
+		sum += n
+	}
+	m.Push(NewNumber(sum))
 	return 1, nil
 }
 
-func ArrayMax(m *Machine, fn *Function, paramCount int) (int, *MachineException) {
+// ArrayAvg returns the mean of the numbers, or null if there are none.
+func ArrayAvg(m *Machine, fn *Function, paramCount int) (int, *MachineException) {
+	numbers, err := arrayNumbers(m, "avg", paramCount, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(numbers) == 0 {
+		m.Push(NullConst)
+		return 1, nil
+	}
+
+	sum := 0.0
+	for _, n := range numbers {
+		sum += n
+	}
+	m.Push(NewNumber(sum / float64(len(numbers))))
+	return 1, nil
+}
+
+// ArrayStddev returns the population standard deviation of the numbers, or
+// null if there are none.
+func ArrayStddev(m *Machine, fn *Function, paramCount int) (int, *MachineException) {
+	numbers, err := arrayNumbers(m, "stddev", paramCount, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(numbers) == 0 {
+		m.Push(NullConst)
+		return 1, nil
+	}
+
+	mean := 0.0
+	for _, n := range numbers {
+		mean += n
+	}
+	mean /= float64(len(numbers))
+
+	variance := 0.0
+	for _, n := range numbers {
+		variance += (n - mean) * (n - mean)
+	}
+	m.Push(NewNumber(math.Sqrt(variance / float64(len(numbers)))))
+	return 1, nil
+}
+
+func ArrayMedian(m *Machine, fn *Function, paramCount int) (int, *MachineException) {
+	numbers, err := arrayNumbers(m, "median", paramCount, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(numbers) == 0 {
+		m.Push(NullConst)
+		return 1, nil
+	}
+
+	sort.Float64s(numbers)
+	m.Push(NewNumber(percentile(numbers, 50)))
+	return 1, nil
+}
+
+func ArrayPercentile(m *Machine, fn *Function, paramCount int) (int, *MachineException) {
 	// stack -1: table object
-	arrayref := m.Get(-1)
+	// stack -2: optional key
+	// stack -2 or -3: percentile, between 0 and 100
+	if paramCount < 2 {
+		return 0, NewMachineException("Missing percentile in call to percentile()")
+	}
+	p := m.Get(-paramCount).ToNumber()
+	if m.Get(-paramCount).Type() != TypeNumber || math.IsNaN(p) || p < 0 || p > 100 {
+		return 0, NewMachineException("percentile() expects a number between 0 and 100, got %s", m.Get(-paramCount).ToString())
+	}
 
-	if array, ok := arrayref.(*Array); ok {
-		var i uint32
-		var ref MachineValue
+	numbers, err := arrayNumbers(m, "percentile", paramCount, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(numbers) == 0 {
+		m.Push(NullConst)
+		return 1, nil
+	}
 
-		ref = NullConst
+	sort.Float64s(numbers)
+	m.Push(NewNumber(percentile(numbers, p)))
+	return 1, nil
+}
 
-		for i = 0; i < array.length; i++ {
-			val, err := array.GetUInt32Property(i)
-			if err == nil && val.Type() != TypeNull {
-				if ref == NullConst {
-					ref = val
-				} else {
-					if !lessThan(val, ref) {
-						ref = val
-					}
-				}
+// arrayMatches calls match on each element of the array a method is called
+// on, that is not null and, if a key and a value are given, whose property
+// key is equal to value.
+func arrayMatches(m *Machine, paramCount int, match func(MachineValue)) *MachineException {
+	// stack -1: table object
+	// stack -2: optional key
+	// stack -3: value of key
+	array, ok := m.Get(-1).(*Array)
+	if !ok {
+		return NewMachineException("Array method called on non-array object")
+	}
+
+	var key string
+	var value MachineValue
+	byKey := paramCount > 1
+	if byKey {
+		if paramCount < 3 || m.Get(-2).Type() != TypeString {
+			return NewMachineException("Expected a string key and a value as parameters")
+		}
+		key = m.Get(-2).ToString()
+		value = m.Get(-3)
+	}
+
+	var i uint32
+	for i = 0; i < array.length; i++ {
+		if merr := m.CheckDeadline(); merr != nil {
+			return merr
+		}
+		val, err := array.GetUInt32Property(i)
+		if err != nil || val.Type() == TypeNull {
+			continue
+		}
+		if byKey {
+			if val.Type() != TypeObject && val.Type() != TypeArray {
+				continue
+			}
+			prop, err := val.GetProperty(key)
+			if err != nil || prop.Type() != value.Type() || !equal(prop, value) {
+				continue
 			}
 		}
-		m.Push(ref)
-	} else {
-		return 0, NewMachineException("Array method called on non-array object")
+		match(val)
 	}
+	return nil
+}
+
+// ArrayCount returns the number of elements that are not null, or with a key
+// and a value, the number of elements whose property key is equal to value.
+func ArrayCount(m *Machine, fn *Function, paramCount int) (int, *MachineException) {
+	count := 0
+	if err := arrayMatches(m, paramCount, func(MachineValue) { count++ }); err != nil {
+		return 0, err
+	}
+	m.Push(NewNumber(float64(count)))
+	return 1, nil
+}
+
+// ArrayFilter returns the elements whose property key is equal to value.
+func ArrayFilter(m *Machine, fn *Function, paramCount int) (int, *MachineException) {
+	if paramCount < 3 {
+		return 0, NewMachineException("filter expects a string key and a value as parameters")
+	}
+	if array, ok := m.Get(-1).(*Array); ok {
+		if merr := m.Allocate(int(array.length), 0); merr != nil {
+			return 0, merr
+		}
+	}
+	result := NewArray()
+	if err := arrayMatches(m, paramCount, func(val MachineValue) { result.Push(val) }); err != nil {
+		return 0, err
+	}
+	m.Push(result)
 	return 1, nil
 }
 
@@ -1,7 +1,9 @@
 package jsmm
 
 import (
+	"runtime"
 	"testing"
+	"time"
 )
 
 func Expect(t *testing.T, val MachineValue, expr string) {
@@ -43,7 +45,7 @@ func CompileAndRun(t *testing.T, expr string, extra interface{}) MachineValue {
 func TestSimple(t *testing.T) {
 	v := CompileAndRun(t, "0 + 1 * 2 * (3 - 4) / -5 + 6", nil)
 
-	Expect(t, v, "6.4")
+	Expect(t, v, "6.400000e+00")
 }
 
 func TestSimple2(t *testing.T) {
@@ -55,13 +57,13 @@ func TestSimple2(t *testing.T) {
 func TestSimple3(t *testing.T) {
 	v := CompileAndRun(t, "[1,2,3][1]+[4,5,6][2]", nil)
 
-	Expect(t, v, "8")
+	Expect(t, v, "8.000000e+00")
 }
 
 func TestSimple4(t *testing.T) {
 	v := CompileAndRun(t, `{a: "b", "c": [1,8]}.c[0]+[1,2,3].length`, nil)
 
-	Expect(t, v, "4")
+	Expect(t, v, "4.000000e+00")
 }
 
 func TestSimple5(t *testing.T) {
@@ -73,7 +75,7 @@ func TestSimple5(t *testing.T) {
 func TestSimple6(t *testing.T) {
 	v := CompileAndRun(t, `[1,2,3].min()+[7,6,5,4].max()`, nil)
 
-	Expect(t, v, "8")
+	Expect(t, v, "8.000000e+00")
 }
 
 func TestVar(t *testing.T) {
@@ -81,7 +83,7 @@ func TestVar(t *testing.T) {
 
 	v := CompileAndRun(t, "test[0]+test[1]+test[2]", val)
 
-	Expect(t, v, "6")
+	Expect(t, v, "6.000000e+00")
 }
 
 func TestVar2(t *testing.T) {
@@ -89,7 +91,7 @@ func TestVar2(t *testing.T) {
 
 	v := CompileAndRun(t, "test.A[0]+test.A[1]+test.A[2]", val)
 
-	Expect(t, v, "6")
+	Expect(t, v, "6.000000e+00")
 }
 
 func TestTime1(t *testing.T) {
@@ -101,7 +103,7 @@ func TestTime1(t *testing.T) {
 func TestTime2(t *testing.T) {
 	v := CompileAndRun(t, `timeUTC("1969-12-31T00:00:00Z")`, nil)
 
-	Expect(t, v, "-86400")
+	Expect(t, v, "-8.640000e+04")
 }
 
 func TestSelect1(t *testing.T) {
@@ -143,6 +145,559 @@ func TestMatchRegexp5(t *testing.T) {
 func TestToString(t *testing.T) {
     v := CompileAndRun(t, `toString([toString(matchRegexp), toString(true), toString(3.1415), toString(null)])`, nil)
 
-    Expect(t, v, "function matchRegex(){ [Native code] },true,3.1415,")
+    Expect(t, v, "function matchRegexp() { [Native code] },true,3.141500e+00,")
 }
  
+
+func CompileAndFail(t *testing.T, expr string, limits Limits) *MachineException {
+	machine, err := Compile(expr)
+	if err != nil {
+		t.Error("Compile failed", err.Error())
+		return nil
+	}
+	machine.SetLimits(limits)
+	_, exception := machine.Execute()
+	if exception == nil {
+		t.Error("Execute succeeded, but was expected to fail: " + expr)
+	}
+	return exception
+}
+
+func TestLimitInstructions(t *testing.T) {
+	exception := CompileAndFail(t, "1+2+3+4+5+6+7+8", Limits{MaxInstructions: 10})
+
+	if exception != nil && exception.Kind() != ExceptionLimit {
+		t.Error("Expected a limit exception, but got " + exception.Error())
+	}
+}
+
+func TestLimitStack(t *testing.T) {
+	exception := CompileAndFail(t, "1+(2+(3+(4+(5+(6+7)))))", Limits{MaxStackSize: 4})
+
+	if exception != nil && exception.Kind() != ExceptionLimit {
+		t.Error("Expected a limit exception, but got " + exception.Error())
+	}
+}
+
+func TestLimitStringBytes(t *testing.T) {
+	exception := CompileAndFail(t, `"0123456789"+"0123456789"+"0123456789"`, Limits{MaxStringBytes: 40})
+
+	if exception != nil && exception.Kind() != ExceptionLimit {
+		t.Error("Expected a limit exception, but got " + exception.Error())
+	}
+}
+
+func TestLimitTimeout(t *testing.T) {
+	exception := CompileAndFail(t, `matchRegexp("a+", ["a", "aa", "aaa"])`, Limits{Timeout: time.Nanosecond})
+
+	if exception != nil && exception.Kind() != ExceptionLimit {
+		t.Error("Expected a limit exception, but got " + exception.Error())
+	}
+}
+
+func TestLimitArrayMethods(t *testing.T) {
+	for _, expr := range []string{`[1, 2, 3, 4].sum()`, `[{a: 1}, {a: 1}, {a: 2}].filter("a", 1)`} {
+		exception := CompileAndFail(t, expr, Limits{Timeout: time.Nanosecond})
+
+		if exception != nil && exception.Kind() != ExceptionLimit {
+			t.Error("Expected a limit exception, but got " + exception.Error())
+		}
+	}
+
+	// the limits leave room for the literals, not for the arrays copied by
+	// the methods.
+	for expr, max := range map[string]int{`[1, 2, 3, 4].percentile(50)`: 10, `[{a: 1}, {a: 1}, {a: 2}].filter("a", 1)`: 16} {
+		exception := CompileAndFail(t, expr, Limits{MaxValues: max})
+
+		if exception != nil && exception.Kind() != ExceptionLimit {
+			t.Error("Expected a limit exception, but got " + exception.Error())
+		}
+	}
+}
+
+func TestNotALimit(t *testing.T) {
+	exception := CompileAndFail(t, `timeUTC(1)`, DefaultLimits)
+
+	if exception != nil && exception.Kind() != ExceptionError {
+		t.Error("Expected an error exception, but got " + exception.Error())
+	}
+}
+
+func TestShortCircuitAnd(t *testing.T) {
+	v := CompileAndRun(t, `test.length > 0 && test[0].x > 3`, []struct{ x float64 }{})
+
+	Expect(t, v, "false")
+}
+
+func TestShortCircuitOr(t *testing.T) {
+	v := CompileAndRun(t, `test.A == null || test.A.b`, struct{ A *struct{} }{nil})
+
+	Expect(t, v, "true")
+}
+
+func TestLogicalValue(t *testing.T) {
+	v := CompileAndRun(t, `toString([0 && 1, 2 && 3, 0 || "x", 4 || 5])`, nil)
+
+	Expect(t, v, "0.000000e+00,3.000000e+00,x,4.000000e+00")
+}
+
+func TestLogicalPrecedence(t *testing.T) {
+	v := CompileAndRun(t, `false && false || true`, nil)
+
+	Expect(t, v, "true")
+}
+
+func TestConditional(t *testing.T) {
+	v := CompileAndRun(t, `toString([test > 2 ? "big" : "small", test < 2 ? "big" : test == 3 ? "three" : "other"])`, 3)
+
+	Expect(t, v, "big,three")
+}
+
+func TestConditionalGuard(t *testing.T) {
+	v := CompileAndRun(t, `test.A != null ? test.A.b : {o: 1 ? 2 : 3}.o`, struct{ A *struct{} }{nil})
+
+	Expect(t, v, "2.000000e+00")
+}
+
+func TestProgramReuse(t *testing.T) {
+	program, err := CompileProgram("test * 2")
+	if err != nil {
+		t.Fatal("Compile failed", err.Error())
+	}
+	for i := 1; i <= 3; i++ {
+		machine := program.NewMachine()
+		if err := ImportGlobal(machine, "test", i); err != nil {
+			t.Fatal("Failed to import global 'test' variable")
+		}
+		v, exception := machine.Execute()
+		if exception != nil {
+			t.Fatal("Execute failed", exception.Error())
+		}
+		Expect(t, v, []string{"2.000000e+00", "4.000000e+00", "6.000000e+00"}[i-1])
+	}
+}
+
+func TestProgramCache(t *testing.T) {
+	cache := NewProgramCache(2)
+
+	for _, expr := range []string{"1", "2", "1", "3", "2"} {
+		if _, err := cache.Get(expr); err != nil {
+			t.Fatal("Compile failed", err.Error())
+		}
+	}
+	if _, err := cache.Get("1+"); err == nil {
+		t.Error("Expected a compilation error")
+	}
+	// "2" was evicted by "3", since "1" was used more recently.
+	hits, misses, size := cache.Stats()
+	if hits != 1 || misses != 5 || size != 2 {
+		t.Errorf("Expected 1 hit, 5 misses and 2 programs, got %d, %d and %d", hits, misses, size)
+	}
+
+	cache.Resize(0)
+	if _, _, size = cache.Stats(); size != 0 {
+		t.Errorf("Expected an empty cache, got %d programs", size)
+	}
+}
+
+func TestParseErrorNoLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for _, expr := range []string{"1 +", "(1", "[1, 2", "a.", "1 ) 2 + 3 + 4 + 5", "\"abc", "12a", "1 # 2"} {
+		if _, err := Parse(expr); err == nil {
+			t.Error("Expected a parse error for " + expr)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines left running after parsing", after-before)
+	}
+}
+
+const benchmarkExpr = `value.length > 0 && select("country", value).length == 3 && matchRegexp("^[A-Z]+$", value[0].country) ? timeUTC(updateTime) > 1443428707 : {a: [1, 2.5, "x"], b: null}.a[1] * 3 - -4 / 2 % 7 <= 12`
+
+func BenchmarkParse(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(benchmarkExpr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// channelLexer runs the lexer the way it did before Lex pulled tokens
+// synchronously: the state functions run in a goroutine, which sends the
+// tokens on a channel. It is only kept so that benchmarks can compare both.
+type channelLexer struct {
+	*lexer
+	ch chan token
+}
+
+func (cl *channelLexer) Lex(lval *yySymType) int {
+	tk, ok := <-cl.ch
+	if !ok {
+		tk = token{tokenEOF, "", cl.startPos}
+	}
+	lval.stringValue = tk.value
+	lval.position = tk.pos
+	cl.lastPos = tk.pos
+	return tk.ident
+}
+
+// benchLexChannel parses s with a channelLexer. The AST is only kept by the
+// parser when it uses a *lexer, so only the error is returned.
+func benchLexChannel(s string) error {
+	cl := &channelLexer{newLexer(s), make(chan token, 2)}
+	go func() {
+		l := cl.lexer
+		for l.state != nil {
+			l.state = l.state(l)
+			for _, tk := range l.tokens {
+				cl.ch <- tk
+			}
+			l.tokens = l.tokens[:0]
+		}
+		close(cl.ch)
+	}()
+	yyParse(cl)
+
+	// drain the channel so that the goroutine ends before lastError is read.
+	for range cl.ch {
+	}
+	if cl.lastError != nil {
+		return cl.lastError
+	}
+	return nil
+}
+
+func BenchmarkParseChannel(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if err := benchLexChannel(benchmarkExpr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompile(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := CompileProgram(benchmarkExpr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func ExpectPosition(t *testing.T, err SourceError, line int, column int, excerpt string) {
+	pos, ok := err.Position()
+	if !ok {
+		t.Error("Expected a position in error: " + err.Error())
+		return
+	}
+	if pos.Line != line || pos.Column != column {
+		t.Errorf("Expected error at line %d, column %d, but got %s", line, column, pos)
+	}
+	if err.Excerpt() != excerpt {
+		t.Errorf("Expected excerpt %q, but got %q", excerpt, err.Excerpt())
+	}
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	_, err := Parse("value.length > 0 &&\n\tvalue[0].x > > 3")
+	if err == nil {
+		t.Fatal("Expected a parse error")
+	}
+	ExpectPosition(t, err.(SourceError), 2, 15, "\tvalue[0].x > > 3\n\t             ^")
+}
+
+func TestLexerErrorPosition(t *testing.T) {
+	_, err := Parse(`1 + 2 # 3`)
+	if err == nil {
+		t.Fatal("Expected a parse error")
+	}
+	ExpectPosition(t, err.(SourceError), 1, 7, "1 + 2 # 3\n      ^")
+}
+
+func TestRuntimeErrorPosition(t *testing.T) {
+	machine, err := Compile("test.A != 1 &&\n  test.A.b.c == 2")
+	if err != nil {
+		t.Fatal("Compile failed", err.Error())
+	}
+	if err = ImportGlobal(machine, "test", struct{ A *struct{} }{nil}); err != nil {
+		t.Fatal("Failed to import global 'test' variable")
+	}
+	_, exception := machine.Execute()
+	if exception == nil {
+		t.Fatal("Expected a runtime error")
+	}
+	ExpectPosition(t, exception, 2, 10, "  test.A.b.c == 2\n         ^")
+}
+
+type latencyRow struct {
+	Region  string
+	Latency interface{}
+}
+
+var latencyRows = []latencyRow{
+	{"eu", 120.0}, {"us", 80.0}, {"eu", nil}, {"eu", 300.0}, {"us", "100"}, {"asia", true},
+}
+
+func TestAggregates(t *testing.T) {
+	v := CompileAndRun(t, `toString([[1, null, 2, "3", true].sum(), [2, 4, null].avg(), [].avg(), [null, 1, 0, false].count(), [{a: 1}].avg()])`, nil)
+
+	Expect(t, v, "3.000000e+00,3.000000e+00,,3.000000e+00,")
+}
+
+func TestAggregatesByKey(t *testing.T) {
+	v := CompileAndRun(t, `toString([test.sum("Latency"), test.avg("Latency"), test.median("Latency"), test.percentile("Latency", 0), test.stddev("Region"), test.sum("Missing")])`, latencyRows)
+
+	Expect(t, v, "5.000000e+02,1.666667e+02,1.200000e+02,8.000000e+01,,0.000000e+00")
+}
+
+func TestAggregatesParameters(t *testing.T) {
+	for _, expr := range []string{`[1].sum(1)`, `[1].avg("a", 2)`, `[1].percentile("a", 50, 1)`, `[1].median(null)`} {
+		machine, err := Compile(expr)
+		if err != nil {
+			t.Fatal("Compile failed", err.Error())
+		}
+		if _, exception := machine.Execute(); exception == nil {
+			t.Errorf("Expected an exception for %s", expr)
+		}
+	}
+}
+
+func TestMedian(t *testing.T) {
+	v := CompileAndRun(t, `toString([[3, 1, null, 2].median(), [4, 1, 3, 2].median(), [null].median()])`, nil)
+
+	Expect(t, v, "2.000000e+00,2.500000e+00,")
+}
+
+func TestPercentile(t *testing.T) {
+	v := CompileAndRun(t, `toString([[1,2,3,4,5,6,7,8,9,10,11].percentile(95), [5, 1].percentile(0), [5, 1].percentile(100), [7].percentile(50)])`, nil)
+
+	Expect(t, v, "1.050000e+01,1.000000e+00,5.000000e+00,7.000000e+00")
+}
+
+func TestPercentileRange(t *testing.T) {
+	machine, _ := Compile(`[1, 2].percentile(101)`)
+	if _, exception := machine.Execute(); exception == nil {
+		t.Error("Expected an exception for a percentile out of range")
+	}
+}
+
+func TestStddev(t *testing.T) {
+	v := CompileAndRun(t, `[2, 4, 4, null, 4, 5, 5, 7, 9].stddev()`, nil)
+
+	Expect(t, v, "2.000000e+00")
+}
+
+func TestFilterAndCount(t *testing.T) {
+	v := CompileAndRun(t, `toString([test.filter("Region", "eu").length, test.count("Region", "us"), test.count("Latency", "100"), test.count("Latency", 100), test.count()])`, latencyRows)
+
+	Expect(t, v, "3.000000e+00,2.000000e+00,1.000000e+00,0.000000e+00,6.000000e+00")
+}
+
+func TestLatencyObjective(t *testing.T) {
+	v := CompileAndRun(t, `select("Latency", test).percentile(95) < 200 && select("Latency", test.filter("Region", "eu")).max() <= 300`, latencyRows)
+
+	Expect(t, v, "false")
+}
+
+func TestUsesGlobal(t *testing.T) {
+	program, err := CompileProgram(`value.length > 0 && history[0].value.length > 0 && toString(select("a", value)) != ""`)
+	if err != nil {
+		t.Fatal("Compile failed", err.Error())
+	}
+	machine := program.NewMachine()
+	if !machine.UsesGlobal("value") || !machine.UsesGlobal("history") || machine.UsesGlobal("updateTime") || machine.UsesGlobal("a") {
+		t.Error("Wrong set of global variables used by the program")
+	}
+}
+
+func TestHostFunction(t *testing.T) {
+	registry := NewRegistry()
+	double := func(m *Machine, fn *Function, paramCount int) (int, *MachineException) {
+		m.Push(NewNumber(m.Get(-2).ToNumber() * 2))
+		return 1, nil
+	}
+	if err := registry.Register(ObjectiveFunctions, HostFunction{"double", 1, "double(x) returns 2*x.", double}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register(ObjectiveFunctions, HostFunction{"double", 1, "", double}); err == nil {
+		t.Error("Expected duplicate registration to fail")
+	}
+
+	machine, err := Compile("double(21)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.Enable(machine, TriggerFunctions)
+	if _, exception := machine.Execute(); exception == nil {
+		t.Error("Expected double() to be unavailable in the trigger set")
+	}
+
+	registry.Enable(machine, ObjectiveFunctions)
+	v, exception := machine.Execute()
+	if exception != nil {
+		t.Fatal(exception)
+	}
+	Expect(t, v, "4.200000e+01")
+
+	if fns := registry.Functions(ObjectiveFunctions); len(fns) != 1 || fns[0].Doc != "double(x) returns 2*x." {
+		t.Errorf("Unexpected functions %v", fns)
+	}
+}
+
+func TestHostFunctionArity(t *testing.T) {
+	CompileAndFail(t, "select(\"a\")", DefaultLimits)
+	CompileAndFail(t, "timeUTC()", DefaultLimits)
+	Expect(t, CompileAndRun(t, "matchRegexp(\"^a\", \"abc\")", nil), "true")
+}
+
+func TestHostData(t *testing.T) {
+	registry := NewRegistry()
+	registry.MustRegister(AdminFunctions, HostFunction{"unit", 0, "", func(m *Machine, fn *Function, paramCount int) (int, *MachineException) {
+		m.Push(NewString(m.HostData().(string)))
+		return 1, nil
+	}})
+	machine, err := Compile("unit()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.Enable(machine, AdminFunctions)
+	machine.SetHostData("ms")
+	v, exception := machine.Execute()
+	if exception != nil {
+		t.Fatal(exception)
+	}
+	Expect(t, v, "ms")
+}
+
+func TestTracer(t *testing.T) {
+	var steps []TraceStep
+
+	machine, err := Compile("1 +\n  2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine.SetTracer(func(step TraceStep) { steps = append(steps, step) })
+	if _, exception := machine.Execute(); exception != nil {
+		t.Fatal(exception)
+	}
+	if len(steps) != 3 {
+		t.Fatalf("Expected 3 steps, got %d", len(steps))
+	}
+	last := steps[2]
+	if last.Op != "add" || last.Top != "3.000000e+00" || last.Depth != 1 || last.Position.Line != 1 {
+		t.Errorf("Unexpected last step %+v", last)
+	}
+	if steps[1].Position.Line != 2 {
+		t.Errorf("Expected the second constant on line 2, got %+v", steps[1])
+	}
+}
+
+func TestExport(t *testing.T) {
+	v := CompileAndRun(t, `{a: [1, "x", null, true], b: 0/0, c: toString}`, nil)
+	if v == nil {
+		return
+	}
+	exported := Export(v).(map[string]interface{})
+	a := exported["a"].([]interface{})
+	if len(a) != 4 || a[0] != 1.0 || a[1] != "x" || a[2] != nil || a[3] != true {
+		t.Errorf("Unexpected export of array %v", a)
+	}
+	if b, ok := exported["b"]; !ok || b != nil {
+		t.Errorf("Expected NaN to be exported as nil, got %v", b)
+	}
+	if _, ok := exported["c"]; ok {
+		t.Error("Expected functions to be left out")
+	}
+}
+
+// specConformance pairs expressions with the JSON encoding of their value,
+// following section 5.4 of the CTP data model and API specification.
+var specConformance = []struct {
+	expr string
+	want string
+}{
+	// literals
+	{`'single' + "double"`, `"singledouble"`},
+	{`"tab\thereé\x41\\\"\'"`, `"tab\thereéA\\\"'"`},
+	{`"😀"`, `"😀"`},
+	{`[1e3, .5, 0x10, 2.5E-1]`, `[1000,0.5,16,0.25]`},
+	{`0x10000000000000000 > 1 && 0x10000000000000000 == 18446744073709551616`, `true`},
+	{`1e999 == 1/0 && -1e999 == -1/0 && 1e-999 == 0`, `true`},
+	{`{_a: 1, $b: 2, c_d: 3}`, `{"$b":2,"_a":1,"c_d":3}`},
+	// toString
+	{`toString(1.5)`, `"1.500000e+00"`},
+	{`toString(-0.001)`, `"-1.000000e-03"`},
+	{`toString([1, "a", null, []])`, `"1.000000e+00,a,,"`},
+	{`toString(null) + toString([])`, `""`},
+	{`toString({a: 1})`, `"[Object Undefined]"`},
+	{`toString(toString)`, `"function toString() { [Native code] }"`},
+	// toBoolean
+	{`[toBoolean(""), toBoolean("0"), toBoolean(0), toBoolean(-0), toBoolean(0/0), toBoolean(null), toBoolean([]), toBoolean({})]`, `[false,true,false,false,false,false,true,true]`},
+	// toNumber
+	{`[toNumber(" 12abc"), toNumber("abc"), toNumber("0x10"), toNumber("-1.5e2"), toNumber(true), toNumber(null)]`, `[12,0,16,-150,1,0]`},
+	{`toNumber("inf") > 1e308 && toNumber([]) != toNumber([])`, `true`},
+	// comparisons
+	{`[0/0 < 1, 0/0 > 1, 0/0 <= 1, 0/0 >= 1, 0/0 == 0/0, 0/0 != 0/0]`, `[false,false,false,false,false,true]`},
+	{`["a" < "b", "b" < "a", "10" < "9", "10" < 9, "a" == "a", "" == 0, null == 0]`, `[true,false,true,false,true,true,true]`},
+	{`["abc" <= "abd", 2 >= 2, 1 > "0.5", true == 1]`, `[true,true,true,true]`},
+	// arithmetic
+	{`["a" + 1, 1 + true, null + 1, "2" * 3, [] - 1]`, `[null,null,null,null,null]`},
+	{`[1/0, -1/0, 0/0, 7 % 3, -7 % 3, 7.5 % 2]`, `[null,null,null,1,-1,1.5]`},
+	{`1/0 > 1e308 && -1/0 < -1e308`, `true`},
+	// boolean operators
+	{`[0 || "x", "y" || 0, 0 && "x", "y" && 0, null || null]`, `["x","y",0,0,null]`},
+	// min and max
+	{`[[3, 1, 2].min(), [3, 1, 2].max(), [].min(), [].max()]`, `[1,3,null,null]`},
+	{`[[1, "1", true].min(), [1, "1", true].max()]`, `[1,true]`},
+	{`[["b", "a", "c"].min(), ["b", "a", "c"].max()]`, `["a","c"]`},
+	// matchRegexp
+	{`[matchRegexp("^a", "abc"), matchRegexp("^a", ["ab", "ac"]), matchRegexp("^a", ["ab", "b"]), matchRegexp("^a", [])]`, `[true,true,false,true]`},
+	// select
+	{`select("a", [{a: 1}, {b: 2}, 3])`, `[1,null,null]`},
+	{`select(1, [[1, 2], [3]])`, `[2,null]`},
+	// timeUTC
+	{`[timeUTC("1970-01-01T00:00:00Z"), timeUTC("1969-12-31T23:59:00Z"), timeUTC("2015-07-20T12:34:56+02:00")]`, `[0,-60,1437388496]`},
+	// toJSON
+	{`toJSON({b: "\"\n<", a: [1.5, null]})`, `"{\"a\":[1.5,null],\"b\":\"\\\"\\n<\"}"`},
+}
+
+func TestSpecConformance(t *testing.T) {
+	for _, c := range specConformance {
+		v := CompileAndRun(t, c.expr, nil)
+		if v == nil {
+			t.Errorf("No value for %s", c.expr)
+			continue
+		}
+		if got := v.ToJSON(); got != c.want {
+			t.Errorf("%s: expected %s, but got %s", c.expr, c.want, got)
+		}
+	}
+}
+
+func TestSpecExceptions(t *testing.T) {
+	for _, expr := range []string{
+		`matchRegexp(1, "a")`,
+		`matchRegexp("(", "a")`,
+		`matchRegexp("a", 1)`,
+		`matchRegexp("a", ["a", 1])`,
+		`select("a", {a: 1})`,
+		`timeUTC("yesterday")`,
+	} {
+		CompileAndFail(t, expr, DefaultLimits)
+	}
+}
+
+func TestSpecExamples(t *testing.T) {
+	result := map[string]interface{}{
+		"value": []interface{}{
+			map[string]interface{}{"percentage": 99.5, "country": "UK"},
+		},
+	}
+	for _, expr := range []string{
+		`test.value[0].percentage >= 99.0`,
+		`matchRegexp("UK", select("country", test.value))`,
+		`timeUTC("now") - timeUTC("2015-01-01T00:00:00Z") > 3600`,
+	} {
+		Expect(t, CompileAndRun(t, expr, result), "true")
+	}
+}
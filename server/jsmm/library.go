@@ -12,7 +12,156 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-
 package jsmm
 
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A HostFunction is a native function offered to CTPScript expressions as a
+// property of the global object.
+type HostFunction struct {
+	Name  string
+	Arity int // number of required arguments, or -1 to skip the check
+	Doc   string
+	Call  JSFunction
+}
+
+// A FunctionSet names a group of host functions that are enabled together
+// on a machine, depending on what the expression is evaluated for.
+type FunctionSet string
+
+const (
+	BuiltinFunctions   FunctionSet = "builtin"   // enabled on every machine
+	ObjectiveFunctions FunctionSet = "objective" // measurement objectives
+	TriggerFunctions   FunctionSet = "trigger"   // trigger conditions
+	AdminFunctions     FunctionSet = "admin"     // expressions evaluated on behalf of an administrator
+)
+
+type hostEntry struct {
+	HostFunction
+	function *Function
+}
+
+// A Registry holds host functions, grouped by FunctionSet. Functions are
+// meant to be registered once, at initialization, and then enabled on each
+// machine that needs them. It is safe for concurrent use.
+type Registry struct {
+	mutex sync.RWMutex
+	sets  map[FunctionSet]map[string]*hostEntry
+}
+
+func NewRegistry() *Registry {
+	return &Registry{sets: make(map[FunctionSet]map[string]*hostEntry)}
+}
+
+// DefaultRegistry holds the builtin functions of CTPScript. NewMachine
+// enables its BuiltinFunctions set.
+var DefaultRegistry = NewRegistry()
+
+// Register adds fn to set. It fails if fn has no name or no implementation,
+// or if set already has a function with the same name.
+func (r *Registry) Register(set FunctionSet, fn HostFunction) error {
+	if fn.Name == "" {
+		return fmt.Errorf("Missing name of host function in set '%s'", set)
+	}
+	if fn.Call == nil {
+		return fmt.Errorf("Missing implementation of host function '%s'", fn.Name)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	functions, ok := r.sets[set]
+	if !ok {
+		functions = make(map[string]*hostEntry)
+		r.sets[set] = functions
+	}
+	if _, exists := functions[fn.Name]; exists {
+		return fmt.Errorf("Host function '%s' is already registered in set '%s'", fn.Name, set)
+	}
+	functions[fn.Name] = &hostEntry{fn, NewFunction(fn.Name, checkArity(fn))}
+	return nil
+}
+
+// MustRegister is like Register but panics if fn cannot be registered. It
+// is meant for package initialization.
+func (r *Registry) MustRegister(set FunctionSet, fns ...HostFunction) {
+	for _, fn := range fns {
+		if err := r.Register(set, fn); err != nil {
+			panic(err.Error())
+		}
+	}
+}
+
+// Functions returns the functions of the listed sets, sorted by name.
+func (r *Registry) Functions(sets ...FunctionSet) []HostFunction {
+	var result []HostFunction
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, set := range sets {
+		for _, entry := range r.sets[set] {
+			result = append(result, entry.HostFunction)
+		}
+	}
+	sort.Sort(byFunctionName(result))
+	return result
+}
+
+// Enable makes the functions of the listed sets available as globals of m.
+// Sets that have no registered function are ignored. If two sets hold a
+// function with the same name, the one of the last set wins.
+func (r *Registry) Enable(m *Machine, sets ...FunctionSet) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, set := range sets {
+		for name, entry := range r.sets[set] {
+			m.context.SetProperty(name, entry.function)
+		}
+	}
+}
+
+// EnableFunctions makes the functions of the listed sets of the
+// DefaultRegistry available as globals of m.
+func (m *Machine) EnableFunctions(sets ...FunctionSet) {
+	DefaultRegistry.Enable(m, sets...)
+}
+
+// checkArity wraps the implementation of fn so that it fails instead of
+// reading past its arguments on the stack.
+func checkArity(fn HostFunction) JSFunction {
+	if fn.Arity <= 0 {
+		return fn.Call
+	}
+	return func(m *Machine, f *Function, paramCount int) (int, *MachineException) {
+		// paramCount includes the object the function is called on.
+		if paramCount-1 < fn.Arity {
+			return 0, NewMachineException("TypeError: %s() expects %d argument(s), got %d", fn.Name, fn.Arity, paramCount-1)
+		}
+		return fn.Call(m, f, paramCount)
+	}
+}
+
+type byFunctionName []HostFunction
+
+func (s byFunctionName) Len() int           { return len(s) }
+func (s byFunctionName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byFunctionName) Less(i, j int) bool { return s[i].Name < s[j].Name }
 
+func init() {
+	DefaultRegistry.MustRegister(BuiltinFunctions,
+		HostFunction{"toString", 1, "toString(x) converts x to a string, writing numbers as the C format \"%e\" does.", ToString},
+		HostFunction{"toBoolean", 1, "toBoolean(x) converts x to a boolean.", ToBoolean},
+		HostFunction{"toNumber", 1, "toNumber(x) converts x to a number, parsing strings as the C function atof() does.", ToNumber},
+		HostFunction{"toArray", 1, "toArray(x) returns x if it is an array, the array of the characters of x if it is a string, or an array holding x.", ToArray},
+		HostFunction{"toJSON", 1, "toJSON(x) returns the JSON encoding of x.", ToJSON},
+		HostFunction{"timeUTC", 1, "timeUTC(t) returns the number of seconds since the Unix epoch of the RFC 3339 time t, or of the current time if t is \"now\".", TimeUTC},
+		HostFunction{"matchRegexp", 2, "matchRegexp(re, s) tells if the string s, or every string in the array s, matches the POSIX regular expression re.", MatchRegexp},
+		HostFunction{"select", 2, "select(key, a) returns the array of the values of property key of the objects in array a.", Select},
+	)
+}
@@ -18,20 +18,88 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"time"
+)
+
+// ExceptionKind distinguishes errors in the evaluated expression from the
+// interruption of an expression that exceeded the limits of the machine.
+type ExceptionKind int
+
+const (
+	ExceptionError ExceptionKind = iota
+	ExceptionLimit
 )
 
 type MachineException struct {
-	msg string
+	msg     string
+	kind    ExceptionKind
+	pos     Position
+	located bool
+	source  string
 }
 
 func NewMachineException(format string, args ...interface{}) *MachineException {
-	return &MachineException{fmt.Sprintf(format, args...)}
+	return &MachineException{msg: fmt.Sprintf(format, args...), kind: ExceptionError}
+}
+
+// NewLimitException reports that the execution was stopped because it
+// exceeded one of the Limits of the machine.
+func NewLimitException(format string, args ...interface{}) *MachineException {
+	return &MachineException{msg: fmt.Sprintf(format, args...), kind: ExceptionLimit}
 }
 
 func (e *MachineException) Error() string {
+	if e.located {
+		return fmt.Sprintf("%s (%s)", e.msg, e.pos)
+	}
 	return e.msg
 }
 
+// Message returns the description of the exception, without its position.
+func (e *MachineException) Message() string {
+	return e.msg
+}
+
+// Position returns the position, in the source of the expression, of the
+// operation that raised the exception.
+func (e *MachineException) Position() (Position, bool) {
+	return e.pos, e.located
+}
+
+func (e *MachineException) Excerpt() string {
+	if !e.located {
+		return ""
+	}
+	return Excerpt(e.source, e.pos)
+}
+
+func (e *MachineException) Kind() ExceptionKind {
+	return e.kind
+}
+
+// Limits bounds the resources used by a single call to Execute. A zero
+// value in any field means that the corresponding resource is not limited.
+type Limits struct {
+	MaxInstructions int           // number of executed instructions
+	MaxStackSize    int           // number of values on the stack
+	MaxValues       int           // number of values created by the program
+	MaxStringBytes  int           // total size of the strings created by the program
+	Timeout         time.Duration // wall-clock execution time
+}
+
+// DefaultLimits are the limits of a new machine. They are far above what a
+// sensible trigger condition or objective requires.
+var DefaultLimits = Limits{
+	MaxInstructions: 100000,
+	MaxStackSize:    1024,
+	MaxValues:       100000,
+	MaxStringBytes:  1 << 20,
+	Timeout:         time.Second,
+}
+
+// the deadline is only checked every deadlineInterval instructions.
+const deadlineInterval = 256
+
 type Machine struct {
 	constants           []MachineValue
 	constantStringTable map[string]int
@@ -40,8 +108,33 @@ type Machine struct {
 	pc                  int
 	context             Object
 	debug_mode          bool
+	limits              Limits
+	instructions        int
+	values              int
+	stringBytes         int
+	deadline            time.Time
+	source              string
+	sourceMap           sourceMap
+	mark                Position
+	globals             map[string]bool // global variables read by the code
+	hostData            interface{}
+	tracer              func(TraceStep)
+}
+
+// A TraceStep describes an instruction executed by a machine that has a
+// tracer, and the value it left on top of the stack, if any.
+type TraceStep struct {
+	PC       int      `json:"pc"`
+	Op       string   `json:"op"`
+	Position Position `json:"position"`
+	Depth    int      `json:"depth"`
+	Type     string   `json:"type,omitempty"`
+	Top      string   `json:"top,omitempty"`
 }
 
+// NewMachine returns an empty machine whose global object holds the
+// BuiltinFunctions of the DefaultRegistry. Other sets of host functions are
+// added with EnableFunctions.
 func NewMachine() *Machine {
 	m := &Machine{
 		constants:           make([]MachineValue, 0, 10),
@@ -51,30 +144,95 @@ func NewMachine() *Machine {
 		pc:                  -1,
 		context:             CreateObjectWithPrototype("GlobalObject", NewNull()),
 		debug_mode:          false,
+		limits:              DefaultLimits,
+		globals:             make(map[string]bool),
 	}
-	m.context.SetProperty("toString", NewFunction("toString", ToString))
-	m.context.SetProperty("toBoolean", NewFunction("toBoolean", ToString))
-	m.context.SetProperty("toNumber", NewFunction("toNumber", ToString))
-	m.context.SetProperty("timeUTC", NewFunction("timeUTC", TimeUTC))
-	m.context.SetProperty("matchRegexp", NewFunction("matchRegex", MatchRegexp))
-	m.context.SetProperty("select", NewFunction("select", Select))
+	m.EnableFunctions(BuiltinFunctions)
 	return m
 }
 
 func Compile(expr string) (*Machine, error) {
-	ast, err := Parse(expr)
+	p, err := CompileProgram(expr)
 	if err != nil {
 		return nil, err
 	}
-	m := NewMachine()
-	ast.Compile(m)
-	return m, nil
+	return p.NewMachine(), nil
 }
 
 func (m *Machine) DebugMode(debug bool) {
 	m.debug_mode = debug
 }
 
+// SetHostData attaches a value of the embedding application to the machine,
+// typically the resource an expression is evaluated for, so that host
+// functions can retrieve it with HostData.
+func (m *Machine) SetHostData(data interface{}) {
+	m.hostData = data
+}
+
+func (m *Machine) HostData() interface{} {
+	return m.hostData
+}
+
+// SetTracer sets a function called after each instruction executed by the
+// machine, or removes it if tracer is nil.
+func (m *Machine) SetTracer(tracer func(TraceStep)) {
+	m.tracer = tracer
+}
+
+func (m *Machine) SetLimits(limits Limits) {
+	m.limits = limits
+}
+
+func (m *Machine) Limits() Limits {
+	return m.limits
+}
+
+// Allocate accounts for values and string bytes created outside of the
+// stack, for example by native functions that build arrays.
+func (m *Machine) Allocate(values int, stringBytes int) *MachineException {
+	m.values += values
+	m.stringBytes += stringBytes
+	return m.checkAllocations()
+}
+
+func (m *Machine) checkAllocations() *MachineException {
+	if m.limits.MaxValues > 0 && m.values > m.limits.MaxValues {
+		return NewLimitException("Limit exceeded: more than %d values allocated", m.limits.MaxValues)
+	}
+	if m.limits.MaxStringBytes > 0 && m.stringBytes > m.limits.MaxStringBytes {
+		return NewLimitException("Limit exceeded: more than %d bytes of strings allocated", m.limits.MaxStringBytes)
+	}
+	return nil
+}
+
+// CheckDeadline returns a limit exception if the execution time of the
+// machine is exceeded. Native functions that iterate over large arrays
+// should call it regularly.
+func (m *Machine) CheckDeadline() *MachineException {
+	if !m.deadline.IsZero() && time.Now().After(m.deadline) {
+		return NewLimitException("Limit exceeded: execution took more than %s", m.limits.Timeout)
+	}
+	return nil
+}
+
+func (m *Machine) checkLimits() *MachineException {
+	m.instructions++
+	if m.limits.MaxInstructions > 0 && m.instructions > m.limits.MaxInstructions {
+		return NewLimitException("Limit exceeded: more than %d instructions executed", m.limits.MaxInstructions)
+	}
+	if m.limits.MaxStackSize > 0 && len(m.stack) > m.limits.MaxStackSize {
+		return NewLimitException("Limit exceeded: stack holds more than %d values", m.limits.MaxStackSize)
+	}
+	if err := m.checkAllocations(); err != nil {
+		return err
+	}
+	if m.instructions%deadlineInterval == 0 {
+		return m.CheckDeadline()
+	}
+	return nil
+}
+
 func (m *Machine) AddConst(c MachineValue) int {
 	if c.Type() == TypeString {
 		str := c.ToString()
@@ -95,6 +253,10 @@ func (m *Machine) Push(e MachineValue) int {
 	if e == nil {
 		panic("Pushing a nil on the stack")
 	}
+	m.values++
+	if e.Type() == TypeString {
+		m.stringBytes += len(e.ToString())
+	}
 	m.stack = append(m.stack, e)
 	return m.Top()
 }
@@ -118,12 +280,43 @@ func (m *Machine) Top() int {
 	return len(m.stack) - 1
 }
 
+// Mark sets the position in the source of the expression of the
+// instructions added next.
+func (m *Machine) Mark(pos Position) *Machine {
+	m.mark = pos
+	return m
+}
+
+func (m *Machine) addToSourceMap() {
+	if n := len(m.sourceMap); n == 0 || m.sourceMap[n-1].pos != m.mark {
+		m.sourceMap = append(m.sourceMap, sourceMapEntry{len(m.code), m.mark})
+	}
+}
+
+// SourcePosition returns the position in the source of the expression from
+// which the instruction at pc was compiled.
+func (m *Machine) SourcePosition(pc int) (Position, bool) {
+	return m.sourceMap.lookup(pc)
+}
+
+// UsesGlobal returns true if the code reads the global variable name, so
+// that costly globals need only be imported when they are used.
+func (m *Machine) UsesGlobal(name string) bool {
+	return m.globals[name]
+}
+
+func (m *Machine) Source() string {
+	return m.source
+}
+
 func (m *Machine) AddI(i byte) *Machine {
+	m.addToSourceMap()
 	m.code = append(m.code, i)
 	return m
 }
 
 func (m *Machine) AddIParam(i byte, p int) *Machine {
+	m.addToSourceMap()
 	m.code = append(m.code, i)
 	m.code = append(m.code, byte((p>>16)&0xff))
 	m.code = append(m.code, byte((p>>8)&0xff))
@@ -131,6 +324,14 @@ func (m *Machine) AddIParam(i byte, p int) *Machine {
 	return m
 }
 
+// SetIParamAt changes the parameter of the instruction at index, which is
+// used to resolve forward jumps once their target is compiled.
+func (m *Machine) SetIParamAt(index int, p int) {
+	m.code[index+1] = byte((p >> 16) & 0xff)
+	m.code[index+2] = byte((p >> 8) & 0xff)
+	m.code[index+3] = byte(p & 0xff)
+}
+
 func (m *Machine) GetIParamAt(index int) int {
 	var compl uint32 = 0xFF000000
 	var param uint32 = (uint32(m.code[index+1]) << 16) | (uint32(m.code[index+2]) << 8) | uint32(m.code[index+3])
@@ -149,11 +350,15 @@ func (m *Machine) Call(pc int) *MachineException {
 	m.pc = pc
 	for m.pc < len(m.code) {
 		op := m.code[m.pc]
+		pc := m.pc
 		if m.debug_mode {
 			log.Printf("pc=%d, st=%d, opcode=%d, opname=%s\n", m.pc, m.Top(), op, Ops[op].name)
 		}
 		if err := Ops[op].exec(m); err != nil {
-			return err
+			return m.locate(err)
+		}
+		if err := m.checkLimits(); err != nil {
+			return m.locate(err)
 		}
 		if m.debug_mode {
 			if m.Top() >= 0 {
@@ -161,6 +366,9 @@ func (m *Machine) Call(pc int) *MachineException {
 				log.Printf("st -> %s: %s", TypeOf(top), top.ToString())
 			}
 		}
+		if m.tracer != nil {
+			m.trace(pc, op)
+		}
 		m.pc += Ops[op].length
 	}
 	if m.pc >= len(m.code) {
@@ -170,7 +378,37 @@ func (m *Machine) Call(pc int) *MachineException {
 	return nil
 }
 
+func (m *Machine) trace(pc int, op byte) {
+	step := TraceStep{PC: pc, Op: Ops[op].name, Depth: m.Top() + 1}
+	step.Position, _ = m.SourcePosition(pc)
+	if m.Top() >= 0 {
+		top := m.Get(m.Top())
+		step.Type = TypeOf(top)
+		step.Top = top.ToString()
+	}
+	m.tracer(step)
+}
+
+// locate sets the position of an exception raised at the current pc.
+func (m *Machine) locate(err *MachineException) *MachineException {
+	if !err.located {
+		if pos, ok := m.SourcePosition(m.pc); ok {
+			err.pos = pos
+			err.located = true
+			err.source = m.source
+		}
+	}
+	return err
+}
+
 func (m *Machine) Execute() (MachineValue, *MachineException) {
+	m.instructions = 0
+	m.values = 0
+	m.stringBytes = 0
+	m.deadline = time.Time{}
+	if m.limits.Timeout > 0 {
+		m.deadline = time.Now().Add(m.limits.Timeout)
+	}
 	if err := m.Call(0); err != nil {
 		return nil, err
 	}
@@ -198,6 +436,9 @@ func DumpStack(w io.Writer, m *Machine) {
 		}
 	}
 }
+// DumpCode writes the constants and the instructions of the machine. Each
+// instruction that starts the code of a new expression is followed by its
+// position in the source.
 func DumpCode(w io.Writer, m *Machine) {
 	fmt.Fprintf(w, "constants:\n")
 	for i := 0; i < len(m.constants); i++ {
@@ -207,16 +448,22 @@ func DumpCode(w io.Writer, m *Machine) {
 			fmt.Fprintf(w, "%4d: %s\n", i, m.GetConst(i).ToString())
 		}
 	}
-	fmt.Println("code:")
+	fmt.Fprintln(w, "code:")
 	i := 0
+	entry := 0
 	for i < len(m.code) {
 		op := m.code[i]
+		location := ""
+		if entry < len(m.sourceMap) && m.sourceMap[entry].pc == i {
+			location = fmt.Sprintf("    ; %d:%d", m.sourceMap[entry].pos.Line, m.sourceMap[entry].pos.Column)
+			entry++
+		}
 		// FIXME: check code index
 		if Ops[op].length == 1 {
-			fmt.Printf("%4d: %02x             %s\n", i, op, Ops[op].name)
+			fmt.Fprintf(w, "%4d: %02x             %s%s\n", i, op, Ops[op].name, location)
 			i++
 		} else {
-			fmt.Printf("%4d: %02x %02x %02x %02x    %s %d\n", i, op, m.code[i+1], m.code[i+2], m.code[i+3], Ops[op].name, m.GetIParamAt(i))
+			fmt.Fprintf(w, "%4d: %02x %02x %02x %02x    %s %d%s\n", i, op, m.code[i+1], m.code[i+2], m.code[i+3], Ops[op].name, m.GetIParamAt(i), location)
 			i += 4
 		}
 	}
@@ -35,8 +35,10 @@ const (
 	i_gt
 	i_lte
 	i_gte
-	i_and
-	i_or
+	i_jump
+	i_jump_if_false
+	i_jump_if_false_or_pop
+	i_jump_if_true_or_pop
 	i_not
 	i_neg
 	i_call
@@ -66,7 +68,7 @@ var Ops = [I_COUNT]Op{
 	{"get_index", 1,
 		func(m *Machine) *MachineException {
 			objectref := m.Get(-2)
-			key := m.Get(-1).ToString()
+			key := propertyKey(m.Get(-1))
 			m.Pop(2)
             r, err := objectref.GetProperty(key)
             if err!=nil {
@@ -78,7 +80,7 @@ var Ops = [I_COUNT]Op{
 	{"set_index", 1,
 		func(m *Machine) *MachineException {
 			objectref := m.Get(-3)
-			key := m.Get(-2).ToString()
+			key := propertyKey(m.Get(-2))
 			val := m.Get(-1)
 			m.Pop(2)
 		    return objectref.SetProperty(key, val)
@@ -100,51 +102,59 @@ var Ops = [I_COUNT]Op{
 			b := m.Get(-1)
 			m.Pop(2)
 
-			if a.Type() == TypeString || b.Type() == TypeString {
+			switch {
+			case a.Type() == TypeString && b.Type() == TypeString:
 				m.Push(NewString(a.ToString() + b.ToString()))
-			} else {
+			case a.Type() == TypeNumber && b.Type() == TypeNumber:
 				m.Push(NewNumber(a.ToNumber() + b.ToNumber()))
+			default:
+				m.Push(NewNumber(math.NaN()))
 			}
 			return nil
 		}},
 	{"sub", 1,
 		func(m *Machine) *MachineException {
-			a := m.Get(-2).ToNumber()
-			b := m.Get(-1).ToNumber()
+			a, b, ok := numberOperands(m)
 			m.Pop(2)
-			m.Push(NewNumber(a - b))
+			if !ok {
+				m.Push(NewNumber(math.NaN()))
+			} else {
+				m.Push(NewNumber(a - b))
+			}
 			return nil
 		}},
 	{"mul", 1,
 		func(m *Machine) *MachineException {
-			a := m.Get(-2).ToNumber()
-			b := m.Get(-1).ToNumber()
+			a, b, ok := numberOperands(m)
 			m.Pop(2)
-			m.Push(NewNumber(a * b))
+			if !ok {
+				m.Push(NewNumber(math.NaN()))
+			} else {
+				m.Push(NewNumber(a * b))
+			}
 			return nil
 		}},
 	{"div", 1,
 		func(m *Machine) *MachineException {
-			a := m.Get(-2).ToNumber()
-			b := m.Get(-1).ToNumber()
+			a, b, ok := numberOperands(m)
 			m.Pop(2)
-			if b == 0 {
-				if a == 0 {
-					m.Push(NewNumber(math.NaN()))
-				} else {
-					m.Push(NewNumber(math.Inf(int(a))))
-				}
+			if !ok {
+				m.Push(NewNumber(math.NaN()))
 			} else {
+				// IEEE 754: division by zero gives an infinity or NaN.
 				m.Push(NewNumber(a / b))
 			}
 			return nil
 		}},
 	{"mod", 1,
 		func(m *Machine) *MachineException {
-			a := m.Get(-2).ToNumber()
-			b := m.Get(-1).ToNumber()
+			a, b, ok := numberOperands(m)
 			m.Pop(2)
-			m.Push(NewNumber(math.Mod(a, b)))
+			if !ok {
+				m.Push(NewNumber(math.NaN()))
+			} else {
+				m.Push(NewNumber(math.Mod(a, b)))
+			}
 			return nil
 		}},
 	{"equ", 1,
@@ -171,12 +181,14 @@ var Ops = [I_COUNT]Op{
 			m.Push(NewBoolean(lessThan(a, b)))
 			return nil
 		}},
+	// a > b is evaluated as b < a: negating a < b, as the wording of the
+	// specification suggests, would make comparisons with NaN true.
 	{"gt", 1,
 		func(m *Machine) *MachineException {
 			a := m.Get(-2)
 			b := m.Get(-1)
 			m.Pop(2)
-			m.Push(NewBoolean(!equal(a, b) && !lessThan(a, b)))
+			m.Push(NewBoolean(lessThan(b, a)))
 			return nil
 		}},
 	{"lte", 1,
@@ -192,30 +204,39 @@ var Ops = [I_COUNT]Op{
 			a := m.Get(-2)
 			b := m.Get(-1)
 			m.Pop(2)
-			m.Push(NewBoolean(!lessThan(a, b)))
+			m.Push(NewBoolean(lessThan(b, a) || equal(a, b)))
 			return nil
 		}},
-	{"and", 1,
+	// The parameter of jumps is relative to the next instruction.
+	{"jump", 4,
 		func(m *Machine) *MachineException {
-			a := m.Get(-2)
-			b := m.Get(-1)
-			m.Pop(2)
-			if a.ToBoolean() == false {
-				m.Push(a)
+			m.pc += m.GetIParam()
+			return nil
+		}},
+	{"jump_if_false", 4,
+		func(m *Machine) *MachineException {
+			a := m.Get(-1).ToBoolean()
+			m.Pop(1)
+			if a == false {
+				m.pc += m.GetIParam()
+			}
+			return nil
+		}},
+	{"jump_if_false_or_pop", 4,
+		func(m *Machine) *MachineException {
+			if m.Get(-1).ToBoolean() == false {
+				m.pc += m.GetIParam()
 			} else {
-				m.Push(b)
+				m.Pop(1)
 			}
 			return nil
 		}},
-	{"or", 1,
+	{"jump_if_true_or_pop", 4,
 		func(m *Machine) *MachineException {
-			a := m.Get(-2)
-			b := m.Get(-1)
-			m.Pop(2)
-			if a.ToBoolean() == true {
-				m.Push(a)
+			if m.Get(-1).ToBoolean() == true {
+				m.pc += m.GetIParam()
 			} else {
-				m.Push(b)
+				m.Pop(1)
 			}
 			return nil
 		}},
@@ -236,7 +257,7 @@ var Ops = [I_COUNT]Op{
 	{"call", 4,
 		func(m *Machine) *MachineException {
 			objectref := m.Get(-2)
-			key := m.Get(-1).ToString()
+			key := propertyKey(m.Get(-1))
 			paramcount := m.GetIParam()
 			m.Pop(1)
 
@@ -291,22 +312,12 @@ func equalAsNumbers(a, b MachineValue) bool {
 	}
 	return false
 }
+// equal and lessThan compare strings by code point, which is the byte order
+// of UTF-8, and any other values as numbers.
 func equal(a, b MachineValue) bool {
-	if a.Type() == b.Type() {
-		switch a.Type() {
-		case TypeNull:
-			return true
-		case TypeNumber:
-			return equalAsNumbers(a, b)
-		case TypeString:
-			return a.ToString() == b.ToString()
-		case TypeBoolean:
-			return a.ToBoolean() == b.ToBoolean()
-		default:
-			return a == b
-		}
+	if a.Type() == TypeString && b.Type() == TypeString {
+		return a.ToString() == b.ToString()
 	}
-	// Note: Simplified
 	return equalAsNumbers(a, b)
 }
 func lessThanAsNumbers(a, b MachineValue) bool {
@@ -321,22 +332,23 @@ func lessThanAsNumbers(a, b MachineValue) bool {
 	return false
 }
 func lessThan(a, b MachineValue) bool {
-	if a.Type() == b.Type() {
-		switch a.Type() {
-		case TypeNumber:
-			return lessThanAsNumbers(a, b)
-		case TypeString:
-			return a.ToString() < b.ToString()
-		case TypeBoolean:
-			return (a.ToBoolean() == false) && (b.ToBoolean() == true)
-		default:
-			return false
-		}
+	if a.Type() == TypeString && b.Type() == TypeString {
+		return a.ToString() < b.ToString()
 	}
-	// Note: Simplified
 	return lessThanAsNumbers(a, b)
 }
 
+// numberOperands returns the operands of an arithmetic operator, which are
+// only defined on numbers.
+func numberOperands(m *Machine) (float64, float64, bool) {
+	a := m.Get(-2)
+	b := m.Get(-1)
+	if a.Type() != TypeNumber || b.Type() != TypeNumber {
+		return 0, 0, false
+	}
+	return a.ToNumber(), b.ToNumber(), true
+}
+
 /*
 func (op loadOp) exec(m *Machine) *MachineException {
 	m.Push(m.Get(int(op)))
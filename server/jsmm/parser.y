@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strings"
 	"unicode"
+	"unicode/utf16"
 	"unicode/utf8"
 )
 
@@ -14,6 +15,7 @@ import (
     stringValue    string
     expression     Expression
     list           ExpressionList
+    position       Position
 }
 
 %token tokenString tokenIdentifier tokenInteger tokenFloat tokenBoolean tokenNull 
@@ -26,7 +28,9 @@ import (
 /*%type <list> listDecl*/
 /* %type <call> fc fcall */
 
-%right tokenOr tokenAnd
+%right '?' ':'
+%left tokenOr
+%left tokenAnd
 %right tokenEqu tokenNeq tokenLte tokenGte tokenLt tokenGt
 %right '!'
 %left '+' '-'
@@ -37,31 +41,34 @@ import (
 
 %%
 
+/* $<position>n is the position of the first token of the n-th symbol */
+
 final: expr tokenEOF { if l,ok:=yylex.(*lexer); ok { l.ast=$1 }; return 1 }
      | tokenEOF      { return 1 }
      ;
 
-expr: expr '+' expr             { $$=&binExpr{i_add,$1,$3} }
-    | expr '-' expr             { $$=&binExpr{i_sub,$1,$3} }
-    | expr '/' expr             { $$=&binExpr{i_div,$1,$3} }
-    | expr '*' expr             { $$=&binExpr{i_mul,$1,$3} }
-    | expr '%' expr             { $$=&binExpr{i_mod,$1,$3} }
-    | expr tokenEqu expr        { $$=&binExpr{i_equ,$1,$3} }
-    | expr tokenNeq expr        { $$=&binExpr{i_neq,$1,$3} }
-    | expr tokenLt expr         { $$=&binExpr{i_lt,$1,$3} }
-    | expr tokenGt expr         { $$=&binExpr{i_gt,$1,$3} }
-    | expr tokenLte expr        { $$=&binExpr{i_lte,$1,$3} }
-    | expr tokenGte expr        { $$=&binExpr{i_gte,$1,$3} }
-    | expr tokenAnd expr        { $$=&binExpr{i_and,$1,$3} }
-    | expr tokenOr expr         { $$=&binExpr{i_or,$1,$3} }
-    | '!' expr                  { $$=&unaryExpr{i_not,$2} }
-    | '-' expr  %prec UNARY     { $$=&unaryExpr{i_neg,$2} }
+expr: expr '+' expr             { $$=&binExpr{i_add,$1,$3,node{$<position>2}} }
+    | expr '-' expr             { $$=&binExpr{i_sub,$1,$3,node{$<position>2}} }
+    | expr '/' expr             { $$=&binExpr{i_div,$1,$3,node{$<position>2}} }
+    | expr '*' expr             { $$=&binExpr{i_mul,$1,$3,node{$<position>2}} }
+    | expr '%' expr             { $$=&binExpr{i_mod,$1,$3,node{$<position>2}} }
+    | expr tokenEqu expr        { $$=&binExpr{i_equ,$1,$3,node{$<position>2}} }
+    | expr tokenNeq expr        { $$=&binExpr{i_neq,$1,$3,node{$<position>2}} }
+    | expr tokenLt expr         { $$=&binExpr{i_lt,$1,$3,node{$<position>2}} }
+    | expr tokenGt expr         { $$=&binExpr{i_gt,$1,$3,node{$<position>2}} }
+    | expr tokenLte expr        { $$=&binExpr{i_lte,$1,$3,node{$<position>2}} }
+    | expr tokenGte expr        { $$=&binExpr{i_gte,$1,$3,node{$<position>2}} }
+    | expr tokenAnd expr        { $$=&logicalExpr{i_jump_if_false_or_pop,$1,$3,node{$<position>2}} }
+    | expr tokenOr expr         { $$=&logicalExpr{i_jump_if_true_or_pop,$1,$3,node{$<position>2}} }
+    | expr '?' expr ':' expr    { $$=&conditionalExpr{$1,$3,$5,node{$<position>2}} }
+    | '!' expr                  { $$=&unaryExpr{i_not,$2,node{$<position>1}} }
+    | '-' expr  %prec UNARY     { $$=&unaryExpr{i_neg,$2,node{$<position>1}} }
     | '(' expr ')'              { $$=$2 }
-    | tokenInteger              { $$=&literalNumberExpr{$1} }
-    | tokenFloat                { $$=&literalNumberExpr{$1} }
-    | tokenString               { $$=&literalStringExpr{$1} }
-    | tokenBoolean              { $$=&literalBooleanExpr{$1} }
-    | tokenNull                 { $$=&literalNullExpr{} }
+    | tokenInteger              { $$=&literalNumberExpr{$1,node{$<position>1}} }
+    | tokenFloat                { $$=&literalNumberExpr{$1,node{$<position>1}} }
+    | tokenString               { $$=&literalStringExpr{$1,node{$<position>1}} }
+    | tokenBoolean              { $$=&literalBooleanExpr{$1,node{$<position>1}} }
+    | tokenNull                 { $$=&literalNullExpr{node{$<position>1}} }
     | attribute                 { $$=$1 }
     | arraydef                  { $$=$1 }
     | objectdef                 { $$=$1 }
@@ -69,52 +76,73 @@ expr: expr '+' expr             { $$=&binExpr{i_add,$1,$3} }
     ;
 
 
-attribute: expr '.' tokenIdentifier    { $$=&attributeSelectionExpr{$1,&literalStringExpr{$3}} }
-         | expr '[' expr ']'           { $$=&attributeSelectionExpr{$1,$3} }
-         | tokenIdentifier             { $$=&attributeSelectionExpr{&getGlobalObjectExpr{},&literalStringExpr{$1}} }
+attribute: expr '.' tokenIdentifier    { $$=&attributeSelectionExpr{$1,&literalStringExpr{$3,node{$<position>3}},node{$<position>3}} }
+         | expr '[' expr ']'           { $$=&attributeSelectionExpr{$1,$3,node{$<position>2}} }
+         | tokenIdentifier             { $$=&attributeSelectionExpr{&getGlobalObjectExpr{node{$<position>1}},&literalStringExpr{$1,node{$<position>1}},node{$<position>1}} }
          ;
 
-call:   expr '.' tokenIdentifier '(' clist ')'   { $$=&functionCallExpr{$1,&literalStringExpr{$3},$5} }
-    |   expr '.' tokenIdentifier '(' ')'         { $$=&functionCallExpr{$1,&literalStringExpr{$3},NewExpressionList()} }
-    |   expr '[' expr ']' '(' clist ')'          { $$=&functionCallExpr{$1,$3,$6} }
-    |   expr '[' expr ']' '(' ')'                { $$=&functionCallExpr{$1,$3,NewExpressionList()} }
-    |   tokenIdentifier '(' clist ')'            { $$=&functionCallExpr{&getGlobalObjectExpr{},&literalStringExpr{$1},$3} }
-    |   tokenIdentifier '(' ')'                  { $$=&functionCallExpr{&getGlobalObjectExpr{},&literalStringExpr{$1},NewExpressionList()} }
+call:   expr '.' tokenIdentifier '(' clist ')'   { $$=&functionCallExpr{$1,&literalStringExpr{$3,node{$<position>3}},$5,node{$<position>3}} }
+    |   expr '.' tokenIdentifier '(' ')'         { $$=&functionCallExpr{$1,&literalStringExpr{$3,node{$<position>3}},NewExpressionList(),node{$<position>3}} }
+    |   expr '[' expr ']' '(' clist ')'          { $$=&functionCallExpr{$1,$3,$6,node{$<position>2}} }
+    |   expr '[' expr ']' '(' ')'                { $$=&functionCallExpr{$1,$3,NewExpressionList(),node{$<position>2}} }
+    |   tokenIdentifier '(' clist ')'            { $$=&functionCallExpr{&getGlobalObjectExpr{node{$<position>1}},&literalStringExpr{$1,node{$<position>1}},$3,node{$<position>1}} }
+    |   tokenIdentifier '(' ')'                  { $$=&functionCallExpr{&getGlobalObjectExpr{node{$<position>1}},&literalStringExpr{$1,node{$<position>1}},NewExpressionList(),node{$<position>1}} }
     ;
 
 clist: expr               { $$=NewExpressionList().Append($1) }
      | clist ',' expr     { $$=$1.Append($3) }
      ;
 
-arraydef:   '[' alist ']'       { $$=&arrayDefExpr{$2} }
-        |   '[' ']'             { $$=&arrayDefExpr{nil} }
+arraydef:   '[' alist ']'       { $$=&arrayDefExpr{$2,node{$<position>1}} }
+        |   '[' ']'             { $$=&arrayDefExpr{nil,node{$<position>1}} }
         ;
 
-alist: expr               { $$=NewExpressionList().Append(&unaryExpr{i_array_append,$1}) }
-     | alist ',' expr     { $$=$1.Append(&unaryExpr{i_array_append,$3}) }
+alist: expr               { $$=NewExpressionList().Append(&unaryExpr{i_array_append,$1,node{$<position>1}}) }
+     | alist ',' expr     { $$=$1.Append(&unaryExpr{i_array_append,$3,node{$<position>3}}) }
      ;
 
-objectdef:  '{' olist '}'       { $$=&objectDefExpr{$2} }
-         |  '{' '}'             { $$=&objectDefExpr{nil} }
+objectdef:  '{' olist '}'       { $$=&objectDefExpr{$2,node{$<position>1}} }
+         |  '{' '}'             { $$=&objectDefExpr{nil,node{$<position>1}} }
          ;
 
-olist: tokenString ':' expr                 { $$=NewExpressionList().Append(&binExpr{i_set_index,&literalStringExpr{$1},$3}) }
-     | tokenIdentifier ':' expr             { $$=NewExpressionList().Append(&binExpr{i_set_index,&literalStringExpr{$1},$3}) }
-     | olist ',' tokenString ':' expr       { $$=$1.Append(&binExpr{i_set_index,&literalStringExpr{$3},$5}) }
-     | olist ',' tokenIdentifier ':' expr   { $$=$1.Append(&binExpr{i_set_index,&literalStringExpr{$3},$5}) }
+olist: tokenString ':' expr                 { $$=NewExpressionList().Append(&binExpr{i_set_index,&literalStringExpr{$1,node{$<position>1}},$3,node{$<position>1}}) }
+     | tokenIdentifier ':' expr             { $$=NewExpressionList().Append(&binExpr{i_set_index,&literalStringExpr{$1,node{$<position>1}},$3,node{$<position>1}}) }
+     | olist ',' tokenString ':' expr       { $$=$1.Append(&binExpr{i_set_index,&literalStringExpr{$3,node{$<position>3}},$5,node{$<position>3}}) }
+     | olist ',' tokenIdentifier ':' expr   { $$=$1.Append(&binExpr{i_set_index,&literalStringExpr{$3,node{$<position>3}},$5,node{$<position>3}}) }
      ;
 
 
 %%
 
 type ParseError struct {
-    emsg string
+    emsg    string
+    pos     Position
+    located bool
+    source  string
 }
 func (e *ParseError)Error() string {
+    if e.located {
+        return fmt.Sprintf("%s (%s)", e.emsg, e.pos)
+    }
+    return e.emsg
+}
+func (e *ParseError)Message() string {
     return e.emsg
 }
+func (e *ParseError)Position() (Position, bool) {
+    return e.pos, e.located
+}
+func (e *ParseError)Excerpt() string {
+    if !e.located {
+        return ""
+    }
+    return Excerpt(e.source, e.pos)
+}
 func NewParseError(format string, args ...interface{}) *ParseError {
-    return &ParseError{fmt.Sprintf(format,args...)}
+    return &ParseError{emsg: fmt.Sprintf(format,args...)}
+}
+func newParseErrorAt(source string, pos Position, format string, args ...interface{}) *ParseError {
+    return &ParseError{fmt.Sprintf(format,args...), pos, true, source}
 }
 
 const eof = 0
@@ -122,6 +150,7 @@ const eof = 0
 type token struct {
 	ident int
 	value string
+	pos   Position
 }
 
 func (t token) String() string {
@@ -130,13 +159,20 @@ func (t token) String() string {
 
 type stateFn func(*lexer) stateFn
 
+// The lexer is a state machine: each stateFn scans part of the input and
+// returns the next state. States are run on demand by Lex, until they queue
+// at least one token for the parser.
 type lexer struct {
 	input       string
 	start       int
+	startPos    Position // position of input[start]
+	lastPos     Position // position of the last token read by the parser
 	pos         int
 	width       int
-	tokens      chan token
+	tokens      []token // queued tokens, from tokens[head] on
+	head        int
 	state       stateFn
+	quote       rune // quote of the string being scanned
     ast         Expression
     lastError   error
 }
@@ -163,13 +199,18 @@ func (l *lexer) backup() {
 }
 
 func (l *lexer) ignore() {
+	l.startPos = l.startPos.advance(l.input[l.start:l.pos])
 	l.start = l.pos
 }
 
 func (l *lexer) emit(t int) {
-    // fmt.Printf("Send %d\n",t)
-	l.tokens <- token{t, l.input[l.start:l.pos]}
-	l.start = l.pos
+	l.emitValue(t, l.input[l.start:l.pos])
+}
+
+// emitValue queues a token whose value differs from its text in the input.
+func (l *lexer) emitValue(t int, value string) {
+	l.tokens = append(l.tokens, token{t, value, l.startPos})
+	l.ignore()
 }
 
 func (l *lexer) accept(valid string) bool {
@@ -186,33 +227,102 @@ func (l *lexer) acceptRun(valid string) {
 	l.backup()
 }
 
+// errorf reports an error on the token that starts at l.start.
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.tokens <- token{
+	l.tokens = append(l.tokens, token{
 		tokenError,
 		fmt.Sprintf(format, args...),
-    }	
-    l.lastError = NewParseError(format, args...)
+		l.startPos,
+	})
+    l.lastError = newParseErrorAt(l.input, l.startPos, format, args...)
 	return nil
 }
 
+// lexString scans a string literal up to the closing l.quote, decoding the
+// escape sequences defined in ECMA 262 v5, clause 7.8.4.
 func lexString(l *lexer) stateFn {
+	var value strings.Builder
+
 	for {
 		switch r := l.next(); r {
 		case eof:
 			return l.errorf("Unterminated string")
 		case '\\':
-			if l.next() != '"' {
-				l.backup()
+			switch e := l.next(); e {
+			case eof:
+				return l.errorf("Unterminated string")
+			case 'b':
+				value.WriteByte('\b')
+			case 't':
+				value.WriteByte('\t')
+			case 'n':
+				value.WriteByte('\n')
+			case 'v':
+				value.WriteByte('\v')
+			case 'f':
+				value.WriteByte('\f')
+			case 'r':
+				value.WriteByte('\r')
+			case '0':
+				value.WriteByte(0)
+			case 'x':
+				c, ok := l.hexEscape(2)
+				if !ok {
+					return l.errorf("Invalid \\x escape sequence in string")
+				}
+				value.WriteRune(c)
+			case 'u':
+				c, ok := l.hexEscape(4)
+				if !ok {
+					return l.errorf("Invalid \\u escape sequence in string")
+				}
+				if utf16.IsSurrogate(c) && strings.HasPrefix(l.input[l.pos:], "\\u") {
+					save := l.pos
+					l.pos += 2
+					if c2, ok := l.hexEscape(4); ok && utf16.DecodeRune(c, c2) != utf8.RuneError {
+						c = utf16.DecodeRune(c, c2)
+					} else {
+						l.pos = save
+					}
+				}
+				value.WriteRune(c)
+			case '\r':
+				// a line continuation
+				l.accept("\n")
+			case '\n', '\u2028', '\u2029':
+			default:
+				value.WriteRune(e)
 			}
-		case '"':
+		case l.quote:
 			l.backup()
-			l.emit(tokenString)
+			l.emitValue(tokenString, value.String())
 			l.next()
 			l.ignore()
 			return lexDefault
+		default:
+			value.WriteRune(r)
 		}
 	}
-	return lexDefault
+}
+
+// hexEscape reads the n hexadecimal digits of an escape sequence.
+func (l *lexer) hexEscape(n int) (rune, bool) {
+	var c rune
+
+	for i := 0; i < n; i++ {
+		d := l.next()
+		switch {
+		case d >= '0' && d <= '9':
+			c = c*16 + d - '0'
+		case d >= 'a' && d <= 'f':
+			c = c*16 + d - 'a' + 10
+		case d >= 'A' && d <= 'F':
+			c = c*16 + d - 'A' + 10
+		default:
+			return 0, false
+		}
+	}
+	return c, true
 }
 
 func lexNumber(l *lexer) stateFn {
@@ -221,21 +331,27 @@ func lexNumber(l *lexer) stateFn {
 	digits := "0123456789"
 
 	if l.accept("0") && l.accept("xX") {
-		digits = "0123456789abcdefABCDEF"
-	}
-
-	l.acceptRun(digits)
-
-	if l.peek() == '.' {
-        l.next()
-		emitToken = tokenFloat
+		if !l.accept("0123456789abcdefABCDEF") {
+			return l.errorf("Missing digits in hexadecimal number")
+		}
+		l.acceptRun("0123456789abcdefABCDEF")
+	} else {
 		l.acceptRun(digits)
+		if l.accept(".") {
+			emitToken = tokenFloat
+			l.acceptRun(digits)
+		}
 		if l.accept("eE") {
+			emitToken = tokenFloat
 			l.accept("+-")
-			l.acceptRun("0123456789")
+			if !l.accept(digits) {
+				return l.errorf("Missing exponent in number")
+			}
+			l.acceptRun(digits)
 		}
 	}
-	if unicode.IsLetter(l.peek()) {
+	if r := l.peek(); unicode.IsLetter(r) || r == '_' || r == '$' {
+		l.ignore()
 		return l.errorf("Unexpected character in number: %c", l.peek())
 	}
 	l.emit(emitToken)
@@ -244,12 +360,12 @@ func lexNumber(l *lexer) stateFn {
 
 func lexIdentifier(l* lexer) stateFn {
     r := l.next()
-    if !unicode.IsLetter(r) && r!='_' {
+    if !unicode.IsLetter(r) && r!='_' && r!='$' {
         return l.errorf("Unexpected character '%c' in identifier",r)
     }
     for {
         r := l.next()
-        if !unicode.IsLetter(r) && !unicode.IsNumber(r) {
+        if !unicode.IsLetter(r) && !unicode.IsNumber(r) && r!='_' && r!='$' {
             l.backup()
             switch {
             case l.input[l.start:l.pos] == "true":
@@ -272,13 +388,14 @@ func lexDefault(l *lexer) stateFn {
 		switch r := l.next(); {
 		case unicode.IsSpace(r):
 			l.ignore()
-        case unicode.IsLetter(r), r=='_':
+        case unicode.IsLetter(r), r=='_', r=='$':
             l.backup()
             return lexIdentifier
-		case r == '"':
+		case r == '"', r == '\'':
 			l.ignore()
+			l.quote = r
 			return lexString
-		case r <= '9' && r >= '0':
+		case r <= '9' && r >= '0', r == '.' && l.peek() >= '0' && l.peek() <= '9':
 			l.backup()
 			return lexNumber
         case r== '=' && l.peek()=='=':
@@ -297,7 +414,7 @@ func lexDefault(l *lexer) stateFn {
             l.emit(tokenLt)
         case r== '>':
             l.emit(tokenGt)
-        case strings.IndexRune("!+-*/%[](),:.{}",r)>=0:
+        case strings.IndexRune("!+-*/%[](),:.{}?",r)>=0:
             l.emit(int(r))
         case r== '&' && l.peek()=='&':
             l.next()
@@ -309,6 +426,8 @@ func lexDefault(l *lexer) stateFn {
 			l.emit(tokenEOF)
             return nil 
 		default:
+            l.backup()
+            l.ignore()
             return l.errorf("Unexpected character '%c'",r)
         }
 	}
@@ -317,34 +436,41 @@ func lexDefault(l *lexer) stateFn {
 func newLexer(input string) *lexer {
     l := &lexer{
         input: input, 
-        tokens: make(chan token, 2), 
+        tokens: make([]token, 0, 8),
+        startPos: startPosition,
         state: lexDefault,
     }
-    go l.run()
     return l
 }
 
-func (l *lexer) run() {
-    for l.state!=nil {
+// nextToken runs the state machine until a token is available. Once the
+// input is exhausted or an error is found, it keeps returning tokenEOF.
+func (l *lexer) nextToken() token {
+    if l.head==len(l.tokens) {
+        l.tokens = l.tokens[:0]
+        l.head = 0
+    }
+    for len(l.tokens)==0 {
+        if l.state==nil {
+            return token{tokenEOF, "", l.startPos}
+        }
         l.state = l.state(l)
     }
+    tk := l.tokens[l.head]
+    l.head++
+    return tk
 }
 
 func (l *lexer)Lex(lval *yySymType) int {
-    //tk := l.nextToken()
-    tk := <-l.tokens
-    //if tk.ident==tokenError {
-    //    fmt.Println("Recv Error")
-    //} else {
-    //    fmt.Printf("Recv %d\n",tk.ident)
-    //}
-    //fmt.Println(tk)
+    tk := l.nextToken()
     lval.stringValue = tk.value
+    lval.position = tk.pos
+    l.lastPos = tk.pos
     return tk.ident
 }
 func (l *lexer)Error(e string) {
     if l.lastError==nil {
-        l.lastError = NewParseError(e)
+        l.lastError = newParseErrorAt(l.input, l.lastPos, "%s", e)
     }
 }
 
@@ -0,0 +1,135 @@
+//    Copyright 2015 Cloud Security Alliance EMEA (cloudsecurityalliance.org)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsmm
+
+import (
+	"container/list"
+	"sync"
+)
+
+// A Program is the compiled form of an expression. It is never modified
+// after compilation, so it can be shared by concurrent evaluations, each
+// running in its own Machine.
+type Program struct {
+	source    string
+	constants []MachineValue
+	code      []byte
+	sourceMap sourceMap
+	globals   map[string]bool
+}
+
+func CompileProgram(expr string) (*Program, error) {
+	ast, err := Parse(expr)
+	if err != nil {
+		return nil, err
+	}
+	m := NewMachine()
+	ast.Compile(m)
+	return &Program{expr, m.constants, m.code, m.sourceMap, m.globals}, nil
+}
+
+func (p *Program) Source() string {
+	return p.source
+}
+
+// NewMachine returns a machine ready to execute the program. The constants,
+// code, source map and globals of the program are shared, not copied: the
+// full slice expressions make sure that a later AddConst or AddI on the
+// machine reallocates them instead of writing into the program.
+func (p *Program) NewMachine() *Machine {
+	m := NewMachine()
+	m.constants = p.constants[:len(p.constants):len(p.constants)]
+	m.code = p.code[:len(p.code):len(p.code)]
+	m.sourceMap = p.sourceMap[:len(p.sourceMap):len(p.sourceMap)]
+	m.source = p.source
+	m.globals = p.globals
+	return m
+}
+
+// ProgramCache keeps the most recently used programs, indexed by their
+// source text. It is safe for concurrent use.
+type ProgramCache struct {
+	mutex    sync.Mutex
+	capacity int
+	order    *list.List // front is the most recently used program
+	entries  map[string]*list.Element
+	hits     uint64
+	misses   uint64
+}
+
+func NewProgramCache(capacity int) *ProgramCache {
+	return &ProgramCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get returns the program compiled from expr, compiling it on a cache miss.
+// Expressions that fail to compile are not cached.
+func (c *ProgramCache) Get(expr string) (*Program, error) {
+	c.mutex.Lock()
+	if e, ok := c.entries[expr]; ok {
+		c.order.MoveToFront(e)
+		c.hits++
+		c.mutex.Unlock()
+		return e.Value.(*Program), nil
+	}
+	c.misses++
+	c.mutex.Unlock()
+
+	// compile without holding the lock: two concurrent misses on the
+	// same expression both compile it, which is harmless.
+	p, err := CompileProgram(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.entries[expr]; ok {
+		return e.Value.(*Program), nil
+	}
+	if c.capacity > 0 {
+		c.entries[expr] = c.order.PushFront(p)
+		c.evict()
+	}
+	return p, nil
+}
+
+// Resize changes the maximum number of programs in the cache. A capacity
+// of 0 disables the cache.
+func (c *ProgramCache) Resize(capacity int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.capacity = capacity
+	c.evict()
+}
+
+func (c *ProgramCache) evict() {
+	for c.order.Len() > c.capacity {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(*Program).source)
+	}
+}
+
+// Stats returns the number of hits and misses since the cache was created,
+// and the number of programs it holds.
+func (c *ProgramCache) Stats() (hits uint64, misses uint64, size int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.hits, c.misses, c.order.Len()
+}
@@ -0,0 +1,101 @@
+//    Copyright 2015 Cloud Security Alliance EMEA (cloudsecurityalliance.org)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsmm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Position locates a character in the source of an expression. Offset is
+// counted in bytes from 0, Line and Column in characters from 1.
+type Position struct {
+	Offset int `json:"offset"`
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+var startPosition = Position{0, 1, 1}
+
+func (p Position) String() string {
+	return fmt.Sprintf("line %d, column %d", p.Line, p.Column)
+}
+
+// advance returns the position that follows text, if text starts at p.
+func (p Position) advance(text string) Position {
+	for _, r := range text {
+		p.Offset += utf8.RuneLen(r)
+		if r == '\n' {
+			p.Line++
+			p.Column = 1
+		} else {
+			p.Column++
+		}
+	}
+	return p
+}
+
+// Excerpt returns the line of source that holds pos, followed by a line
+// with a caret under the character at pos.
+func Excerpt(source string, pos Position) string {
+	if pos.Offset > len(source) {
+		pos.Offset = len(source)
+	}
+	start := strings.LastIndex(source[:pos.Offset], "\n") + 1
+	end := strings.IndexByte(source[pos.Offset:], '\n')
+	if end < 0 {
+		end = len(source)
+	} else {
+		end += pos.Offset
+	}
+
+	caret := make([]rune, 0, pos.Offset-start+1)
+	for _, r := range source[start:pos.Offset] {
+		if r == '\t' {
+			caret = append(caret, '\t')
+		} else {
+			caret = append(caret, ' ')
+		}
+	}
+	caret = append(caret, '^')
+	return source[start:end] + "\n" + string(caret)
+}
+
+// A SourceError is an error that may be located in the source of an
+// expression, either at compile time or at run time.
+type SourceError interface {
+	error
+	Position() (Position, bool)
+	Excerpt() string
+}
+
+// sourceMapEntry records that the instructions from pc on were compiled
+// from the expression at pos.
+type sourceMapEntry struct {
+	pc  int
+	pos Position
+}
+
+type sourceMap []sourceMapEntry
+
+func (s sourceMap) lookup(pc int) (Position, bool) {
+	i := sort.Search(len(s), func(i int) bool { return s[i].pc > pc })
+	if i == 0 {
+		return Position{}, false
+	}
+	return s[i-1].pos, true
+}
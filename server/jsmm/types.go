@@ -17,7 +17,10 @@ package jsmm
 import (
 	"fmt"
 	"math"
+	"sort"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 type MachineType int
@@ -100,8 +103,23 @@ func NewNumber(f float64) MachineValue {
 	return &Number{f}
 }
 func NewNumberString(v string) MachineValue {
+	if len(v) > 2 && v[0] == '0' && (v[1] == 'x' || v[1] == 'X') {
+		// hexadecimal literals of any length are accumulated in a float,
+		// as javascript does, rather than overflowing an integer.
+		f := 0.0
+		for _, c := range v[2:] {
+			d, err := strconv.ParseUint(string(c), 16, 8)
+			if err != nil {
+				panic("syntax error in number " + v)
+			}
+			f = f*16 + float64(d)
+		}
+		return NewNumber(f)
+	}
+	// out of range literals are rounded to ±Inf or 0 following IEEE 754,
+	// which ParseFloat already does while reporting ErrRange.
 	f, err := strconv.ParseFloat(v, 64)
-	if err != nil {
+	if err != nil && err.(*strconv.NumError).Err != strconv.ErrRange {
 		panic("syntax error in number " + v)
 	}
 	return NewNumber(f)
@@ -115,14 +133,27 @@ func (n *Number) ToBoolean() bool {
 	}
 	return true
 }
+// ToString formats the number as the "%e" specifier of the C function
+// sprintf() does.
 func (n *Number) ToString() string {
-	return fmt.Sprintf("%g", n.value)
+	switch {
+	case math.IsNaN(n.value):
+		return "nan"
+	case math.IsInf(n.value, 1):
+		return "inf"
+	case math.IsInf(n.value, -1):
+		return "-inf"
+	}
+	return fmt.Sprintf("%e", n.value)
 }
 func (n *Number) ToNumber() float64 {
 	return n.value
 }
 func (n *Number) ToJSON() string {
-	return n.ToString()
+	if math.IsNaN(n.value) || math.IsInf(n.value, 0) {
+		return "null"
+	}
+	return formatNumber(n.value)
 }
 
 func (n *Number) GetProperty(prop string) (MachineValue, *MachineException) {
@@ -150,18 +181,14 @@ func (s *String) ToString() string {
 	return s.value
 }
 func (s *String) ToNumber() float64 {
-	num, err := strconv.ParseFloat(s.value, 64)
-	if err != nil {
-		return math.NaN()
-	}
-	return num
+	return atof(s.value)
 }
 func (s *String) ToBoolean() bool {
 	return s.value != ""
 }
 
 func (s *String) ToJSON() string {
-	return `"` + s.ToString() + `"`
+	return quoteJSON(s.value)
 }
 func (s *String) GetProperty(prop string) (MachineValue, *MachineException) {
     return failGetProperty(s,prop)
@@ -240,7 +267,7 @@ func (u *Null) ToBoolean() bool {
 	return false
 }
 func (u *Null) ToJSON() string {
-	return u.ToString()
+	return "null"
 }
 func (u *Null) GetProperty(prop string) (MachineValue, *MachineException) {
     return failGetProperty(u,prop)
@@ -297,7 +324,7 @@ func (o *Object) Type() MachineType {
 	return TypeObject
 }
 func (o *Object) ToString() string {
-	return "[Object " + o.class + "]"
+	return "[Object Undefined]"
 }
 func (o *Object) ToNumber() float64 {
 	return math.NaN()
@@ -305,16 +332,23 @@ func (o *Object) ToNumber() float64 {
 func (o *Object) ToBoolean() bool {
 	return true
 }
+// ToJSON encodes the properties of the object sorted by name, leaving out
+// functions as JSON.stringify() does.
 func (o *Object) ToJSON() string {
-	s := "{"
-	first := true
+	keys := make([]string, 0, len(o.value))
 	for key, val := range o.value {
-		if !first {
+		if val.Type() != TypeFunction {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	s := "{"
+	for i, key := range keys {
+		if i > 0 {
 			s += ","
-		} else {
-			first = false
 		}
-		s += `"` + key + `":` + val.ToJSON()
+		s += quoteJSON(key) + ":" + o.value[key].ToJSON()
 	}
 	s += "}"
 	return s
@@ -333,6 +367,13 @@ func NewArray(init ...MachineValue) *Array {
 	a := &Array{CreateObjectWithPrototype("Array",&defaultObjectPrototype), 0}
 	a.Object.SetProperty("min", NewFunction("min",ArrayMin))
 	a.Object.SetProperty("max", NewFunction("max",ArrayMax))
+	a.Object.SetProperty("sum", NewFunction("sum",ArraySum))
+	a.Object.SetProperty("avg", NewFunction("avg",ArrayAvg))
+	a.Object.SetProperty("count", NewFunction("count",ArrayCount))
+	a.Object.SetProperty("median", NewFunction("median",ArrayMedian))
+	a.Object.SetProperty("percentile", NewFunction("percentile",ArrayPercentile))
+	a.Object.SetProperty("stddev", NewFunction("stddev",ArrayStddev))
+	a.Object.SetProperty("filter", NewFunction("filter",ArrayFilter))
 	for k, v := range init {
 		a.SetProperty(strconv.Itoa(k), v)
 	}
@@ -395,8 +436,10 @@ func (a *Array) ToJSON() string {
 			s += ","
 		}
 		val, err := a.GetUInt32Property(i)
-        if err!=nil {
+        if err==nil {
             s += val.ToJSON()
+        } else {
+            s += "null"
         }
 	}
 	s += "]"
@@ -426,7 +469,7 @@ func (f *Function) Type() MachineType {
 	return TypeFunction
 }
 func (f *Function) ToString() string {
-	return fmt.Sprintf("function %s(){ [Native code] }",f.name)
+	return fmt.Sprintf("function %s() { [Native code] }",f.name)
 }
 func (f *Function) ToNumber() float64 {
 	return math.NaN()
@@ -457,3 +500,142 @@ func IsUInt32(s string) (uint32, bool) {
 	r, e := strconv.ParseUint(s, 0, 32)
 	return uint32(r), e == nil
 }
+
+// propertyKey converts a value used to select a property, as in a[i], to the
+// name of the property. Numbers are written as in JavaScript, so that a[0]
+// selects the property "0".
+func propertyKey(v MachineValue) string {
+	if v.Type() == TypeNumber {
+		return formatNumber(v.ToNumber())
+	}
+	return v.ToString()
+}
+
+// formatNumber returns the shortest representation of f, without exponent
+// unless f is very small or very large, as JavaScript does.
+func formatNumber(f float64) string {
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// atof converts the longest prefix of s that forms a number, after leading
+// white space, as the C function atof() does. It returns 0 if s does not
+// start with a number.
+func atof(s string) float64 {
+	s = strings.TrimLeft(s, " \t\n\v\f\r")
+
+	i := 0
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		i++
+	}
+	rest := strings.ToLower(s[i:])
+	switch {
+	case strings.HasPrefix(rest, "infinity"):
+		i += len("infinity")
+	case strings.HasPrefix(rest, "inf"), strings.HasPrefix(rest, "nan"):
+		i += 3
+	case strings.HasPrefix(rest, "0x"):
+		return atofHex(s[:i], s[i+2:])
+	default:
+		digits := scanDigits(s, i, "0123456789")
+		j := digits
+		if j < len(s) && s[j] == '.' {
+			j = scanDigits(s, j+1, "0123456789")
+		}
+		if j == i || j == i+1 && s[i] == '.' {
+			return 0
+		}
+		i = j
+		if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+			j := i + 1
+			if j < len(s) && (s[j] == '+' || s[j] == '-') {
+				j++
+			}
+			if k := scanDigits(s, j, "0123456789"); k > j {
+				i = k
+			}
+		}
+	}
+	// ParseFloat reports out of range values as infinities or 0.
+	f, _ := strconv.ParseFloat(s[:i], 64)
+	return f
+}
+
+// atofHex converts the hexadecimal number at the start of digits, which
+// follows "0x" in the input of atof, with an optional fraction and binary
+// exponent.
+func atofHex(sign string, digits string) float64 {
+	const hex = "0123456789abcdefABCDEF"
+
+	i := scanDigits(digits, 0, hex)
+	j := i
+	if j < len(digits) && digits[j] == '.' {
+		j = scanDigits(digits, j+1, hex)
+	}
+	if i == 0 && j <= 1 {
+		return 0
+	}
+	exponent := "p0"
+	if j < len(digits) && (digits[j] == 'p' || digits[j] == 'P') {
+		k := j + 1
+		if k < len(digits) && (digits[k] == '+' || digits[k] == '-') {
+			k++
+		}
+		if l := scanDigits(digits, k, "0123456789"); l > k {
+			exponent = digits[j:l]
+		}
+	}
+	f, _ := strconv.ParseFloat(sign+"0x"+digits[:j]+exponent, 64)
+	return f
+}
+
+func scanDigits(s string, i int, digits string) int {
+	for i < len(s) && strings.IndexByte(digits, s[i]) >= 0 {
+		i++
+	}
+	return i
+}
+
+// quoteJSON returns s as a JSON string.
+func quoteJSON(s string) string {
+	const hex = "0123456789abcdef"
+
+	b := make([]byte, 0, len(s)+2)
+	b = append(b, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c >= 0x20 && c != '"' && c != '\\' && c < utf8.RuneSelf {
+			b = append(b, c)
+			i++
+			continue
+		}
+		switch c {
+		case '"', '\\':
+			b = append(b, '\\', c)
+		case '\n':
+			b = append(b, '\\', 'n')
+		case '\r':
+			b = append(b, '\\', 'r')
+		case '\t':
+			b = append(b, '\\', 't')
+		default:
+			if c < 0x20 {
+				b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+				break
+			}
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if r == utf8.RuneError && size == 1 {
+				b = append(b, "\\ufffd"...)
+			} else {
+				b = append(b, s[i:i+size]...)
+			}
+			i += size
+			continue
+		}
+		i++
+	}
+	b = append(b, '"')
+	return string(b)
+}
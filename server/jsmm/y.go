@@ -1,22 +1,27 @@
+// Code generated by goyacc -o y.go parser.y. DO NOT EDIT.
+
 //line parser.y:2
 package jsmm
 
 import __yyfmt__ "fmt"
 
 //line parser.y:2
+
 import (
 	"fmt"
 	"strings"
 	"unicode"
+	"unicode/utf16"
 	"unicode/utf8"
 )
 
-//line parser.y:13
+//line parser.y:14
 type yySymType struct {
 	yys         int
 	stringValue string
 	expression  Expression
 	list        ExpressionList
+	position    Position
 }
 
 const tokenString = 57346
@@ -37,7 +42,10 @@ const tokenLt = 57360
 const tokenGt = 57361
 const UNARY = 57362
 
-var yyToknames = []string{
+var yyToknames = [...]string{
+	"$end",
+	"error",
+	"$unk",
 	"tokenString",
 	"tokenIdentifier",
 	"tokenInteger",
@@ -48,6 +56,8 @@ var yyToknames = []string{
 	"tokenOr",
 	"tokenEOF",
 	"tokenError",
+	"'?'",
+	"':'",
 	"tokenEqu",
 	"tokenNeq",
 	"tokenLte",
@@ -63,24 +73,52 @@ var yyToknames = []string{
 	"'.'",
 	"'['",
 	"UNARY",
+	"'('",
+	"')'",
+	"']'",
+	"','",
+	"'{'",
+	"'}'",
 }
-var yyStatenames = []string{}
+
+var yyStatenames = [...]string{}
 
 const yyEofCode = 1
 const yyErrCode = 2
-const yyMaxDepth = 200
+const yyInitialStackSize = 16
 
-//line parser.y:108
+//line parser.y:115
 
 type ParseError struct {
-	emsg string
+	emsg    string
+	pos     Position
+	located bool
+	source  string
 }
 
 func (e *ParseError) Error() string {
+	if e.located {
+		return fmt.Sprintf("%s (%s)", e.emsg, e.pos)
+	}
+	return e.emsg
+}
+func (e *ParseError) Message() string {
 	return e.emsg
 }
+func (e *ParseError) Position() (Position, bool) {
+	return e.pos, e.located
+}
+func (e *ParseError) Excerpt() string {
+	if !e.located {
+		return ""
+	}
+	return Excerpt(e.source, e.pos)
+}
 func NewParseError(format string, args ...interface{}) *ParseError {
-	return &ParseError{fmt.Sprintf(format, args...)}
+	return &ParseError{emsg: fmt.Sprintf(format, args...)}
+}
+func newParseErrorAt(source string, pos Position, format string, args ...interface{}) *ParseError {
+	return &ParseError{fmt.Sprintf(format, args...), pos, true, source}
 }
 
 const eof = 0
@@ -88,6 +126,7 @@ const eof = 0
 type token struct {
 	ident int
 	value string
+	pos   Position
 }
 
 func (t token) String() string {
@@ -96,13 +135,20 @@ func (t token) String() string {
 
 type stateFn func(*lexer) stateFn
 
+// The lexer is a state machine: each stateFn scans part of the input and
+// returns the next state. States are run on demand by Lex, until they queue
+// at least one token for the parser.
 type lexer struct {
 	input     string
 	start     int
+	startPos  Position // position of input[start]
+	lastPos   Position // position of the last token read by the parser
 	pos       int
 	width     int
-	tokens    chan token
+	tokens    []token // queued tokens, from tokens[head] on
+	head      int
 	state     stateFn
+	quote     rune // quote of the string being scanned
 	ast       Expression
 	lastError error
 }
@@ -129,13 +175,18 @@ func (l *lexer) backup() {
 }
 
 func (l *lexer) ignore() {
+	l.startPos = l.startPos.advance(l.input[l.start:l.pos])
 	l.start = l.pos
 }
 
 func (l *lexer) emit(t int) {
-	// fmt.Printf("Send %d\n",t)
-	l.tokens <- token{t, l.input[l.start:l.pos]}
-	l.start = l.pos
+	l.emitValue(t, l.input[l.start:l.pos])
+}
+
+// emitValue queues a token whose value differs from its text in the input.
+func (l *lexer) emitValue(t int, value string) {
+	l.tokens = append(l.tokens, token{t, value, l.startPos})
+	l.ignore()
 }
 
 func (l *lexer) accept(valid string) bool {
@@ -152,33 +203,102 @@ func (l *lexer) acceptRun(valid string) {
 	l.backup()
 }
 
+// errorf reports an error on the token that starts at l.start.
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.tokens <- token{
+	l.tokens = append(l.tokens, token{
 		tokenError,
 		fmt.Sprintf(format, args...),
-	}
-	l.lastError = NewParseError(format, args...)
+		l.startPos,
+	})
+	l.lastError = newParseErrorAt(l.input, l.startPos, format, args...)
 	return nil
 }
 
+// lexString scans a string literal up to the closing l.quote, decoding the
+// escape sequences defined in ECMA 262 v5, clause 7.8.4.
 func lexString(l *lexer) stateFn {
+	var value strings.Builder
+
 	for {
 		switch r := l.next(); r {
 		case eof:
 			return l.errorf("Unterminated string")
 		case '\\':
-			if l.next() != '"' {
-				l.backup()
+			switch e := l.next(); e {
+			case eof:
+				return l.errorf("Unterminated string")
+			case 'b':
+				value.WriteByte('\b')
+			case 't':
+				value.WriteByte('\t')
+			case 'n':
+				value.WriteByte('\n')
+			case 'v':
+				value.WriteByte('\v')
+			case 'f':
+				value.WriteByte('\f')
+			case 'r':
+				value.WriteByte('\r')
+			case '0':
+				value.WriteByte(0)
+			case 'x':
+				c, ok := l.hexEscape(2)
+				if !ok {
+					return l.errorf("Invalid \\x escape sequence in string")
+				}
+				value.WriteRune(c)
+			case 'u':
+				c, ok := l.hexEscape(4)
+				if !ok {
+					return l.errorf("Invalid \\u escape sequence in string")
+				}
+				if utf16.IsSurrogate(c) && strings.HasPrefix(l.input[l.pos:], "\\u") {
+					save := l.pos
+					l.pos += 2
+					if c2, ok := l.hexEscape(4); ok && utf16.DecodeRune(c, c2) != utf8.RuneError {
+						c = utf16.DecodeRune(c, c2)
+					} else {
+						l.pos = save
+					}
+				}
+				value.WriteRune(c)
+			case '\r':
+				// a line continuation
+				l.accept("\n")
+			case '\n', '\u2028', '\u2029':
+			default:
+				value.WriteRune(e)
 			}
-		case '"':
+		case l.quote:
 			l.backup()
-			l.emit(tokenString)
+			l.emitValue(tokenString, value.String())
 			l.next()
 			l.ignore()
 			return lexDefault
+		default:
+			value.WriteRune(r)
 		}
 	}
-	return lexDefault
+}
+
+// hexEscape reads the n hexadecimal digits of an escape sequence.
+func (l *lexer) hexEscape(n int) (rune, bool) {
+	var c rune
+
+	for i := 0; i < n; i++ {
+		d := l.next()
+		switch {
+		case d >= '0' && d <= '9':
+			c = c*16 + d - '0'
+		case d >= 'a' && d <= 'f':
+			c = c*16 + d - 'a' + 10
+		case d >= 'A' && d <= 'F':
+			c = c*16 + d - 'A' + 10
+		default:
+			return 0, false
+		}
+	}
+	return c, true
 }
 
 func lexNumber(l *lexer) stateFn {
@@ -187,21 +307,27 @@ func lexNumber(l *lexer) stateFn {
 	digits := "0123456789"
 
 	if l.accept("0") && l.accept("xX") {
-		digits = "0123456789abcdefABCDEF"
-	}
-
-	l.acceptRun(digits)
-
-	if l.peek() == '.' {
-		l.next()
-		emitToken = tokenFloat
+		if !l.accept("0123456789abcdefABCDEF") {
+			return l.errorf("Missing digits in hexadecimal number")
+		}
+		l.acceptRun("0123456789abcdefABCDEF")
+	} else {
 		l.acceptRun(digits)
+		if l.accept(".") {
+			emitToken = tokenFloat
+			l.acceptRun(digits)
+		}
 		if l.accept("eE") {
+			emitToken = tokenFloat
 			l.accept("+-")
-			l.acceptRun("0123456789")
+			if !l.accept(digits) {
+				return l.errorf("Missing exponent in number")
+			}
+			l.acceptRun(digits)
 		}
 	}
-	if unicode.IsLetter(l.peek()) {
+	if r := l.peek(); unicode.IsLetter(r) || r == '_' || r == '$' {
+		l.ignore()
 		return l.errorf("Unexpected character in number: %c", l.peek())
 	}
 	l.emit(emitToken)
@@ -210,12 +336,12 @@ func lexNumber(l *lexer) stateFn {
 
 func lexIdentifier(l *lexer) stateFn {
 	r := l.next()
-	if !unicode.IsLetter(r) && r != '_' {
+	if !unicode.IsLetter(r) && r != '_' && r != '$' {
 		return l.errorf("Unexpected character '%c' in identifier", r)
 	}
 	for {
 		r := l.next()
-		if !unicode.IsLetter(r) && !unicode.IsNumber(r) {
+		if !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_' && r != '$' {
 			l.backup()
 			switch {
 			case l.input[l.start:l.pos] == "true":
@@ -238,13 +364,14 @@ func lexDefault(l *lexer) stateFn {
 		switch r := l.next(); {
 		case unicode.IsSpace(r):
 			l.ignore()
-		case unicode.IsLetter(r), r == '_':
+		case unicode.IsLetter(r), r == '_', r == '$':
 			l.backup()
 			return lexIdentifier
-		case r == '"':
+		case r == '"', r == '\'':
 			l.ignore()
+			l.quote = r
 			return lexString
-		case r <= '9' && r >= '0':
+		case r <= '9' && r >= '0', r == '.' && l.peek() >= '0' && l.peek() <= '9':
 			l.backup()
 			return lexNumber
 		case r == '=' && l.peek() == '=':
@@ -263,7 +390,7 @@ func lexDefault(l *lexer) stateFn {
 			l.emit(tokenLt)
 		case r == '>':
 			l.emit(tokenGt)
-		case strings.IndexRune("!+-*/%[](),:.{}", r) >= 0:
+		case strings.IndexRune("!+-*/%[](),:.{}?", r) >= 0:
 			l.emit(int(r))
 		case r == '&' && l.peek() == '&':
 			l.next()
@@ -275,6 +402,8 @@ func lexDefault(l *lexer) stateFn {
 			l.emit(tokenEOF)
 			return nil
 		default:
+			l.backup()
+			l.ignore()
 			return l.errorf("Unexpected character '%c'", r)
 		}
 	}
@@ -282,35 +411,42 @@ func lexDefault(l *lexer) stateFn {
 
 func newLexer(input string) *lexer {
 	l := &lexer{
-		input:  input,
-		tokens: make(chan token, 2),
-		state:  lexDefault,
+		input:    input,
+		tokens:   make([]token, 0, 8),
+		startPos: startPosition,
+		state:    lexDefault,
 	}
-	go l.run()
 	return l
 }
 
-func (l *lexer) run() {
-	for l.state != nil {
+// nextToken runs the state machine until a token is available. Once the
+// input is exhausted or an error is found, it keeps returning tokenEOF.
+func (l *lexer) nextToken() token {
+	if l.head == len(l.tokens) {
+		l.tokens = l.tokens[:0]
+		l.head = 0
+	}
+	for len(l.tokens) == 0 {
+		if l.state == nil {
+			return token{tokenEOF, "", l.startPos}
+		}
 		l.state = l.state(l)
 	}
+	tk := l.tokens[l.head]
+	l.head++
+	return tk
 }
 
 func (l *lexer) Lex(lval *yySymType) int {
-	//tk := l.nextToken()
-	tk := <-l.tokens
-	//if tk.ident==tokenError {
-	//    fmt.Println("Recv Error")
-	//} else {
-	//    fmt.Printf("Recv %d\n",tk.ident)
-	//}
-	//fmt.Println(tk)
+	tk := l.nextToken()
 	lval.stringValue = tk.value
+	lval.position = tk.pos
+	l.lastPos = tk.pos
 	return tk.ident
 }
 func (l *lexer) Error(e string) {
 	if l.lastError == nil {
-		l.lastError = NewParseError(e)
+		l.lastError = newParseErrorAt(l.input, l.lastPos, "%s", e)
 	}
 }
 
@@ -325,157 +461,182 @@ func Parse(s string) (Expression, error) {
 }
 
 //line yacctab:1
-var yyExca = []int{
+var yyExca = [...]int8{
 	-1, 1,
 	1, -1,
 	-2, 0,
 }
 
-const yyNprod = 49
 const yyPrivate = 57344
 
-var yyTokenNames []string
-var yyStates []string
-
-const yyLast = 315
+const yyLast = 335
+
+var yyAct = [...]int8{
+	66, 2, 67, 68, 64, 36, 37, 38, 45, 46,
+	70, 95, 69, 77, 90, 76, 77, 77, 42, 86,
+	74, 47, 48, 49, 50, 51, 52, 53, 54, 55,
+	56, 57, 58, 59, 60, 89, 62, 31, 32, 39,
+	44, 33, 61, 25, 26, 29, 30, 27, 28, 88,
+	20, 21, 22, 23, 24, 34, 35, 34, 35, 72,
+	75, 20, 21, 22, 23, 24, 34, 35, 71, 78,
+	79, 80, 81, 82, 83, 43, 40, 14, 87, 84,
+	22, 23, 24, 34, 35, 13, 15, 12, 1, 93,
+	94, 91, 31, 32, 0, 0, 33, 0, 25, 26,
+	29, 30, 27, 28, 0, 20, 21, 22, 23, 24,
+	34, 35, 0, 0, 63, 9, 16, 7, 8, 10,
+	11, 0, 0, 0, 0, 0, 0, 9, 16, 7,
+	8, 10, 11, 4, 0, 5, 0, 0, 0, 0,
+	17, 0, 6, 92, 0, 4, 18, 5, 0, 0,
+	0, 0, 17, 0, 6, 85, 0, 0, 18, 9,
+	16, 7, 8, 10, 11, 0, 0, 0, 0, 0,
+	0, 9, 16, 7, 8, 10, 11, 4, 0, 5,
+	0, 0, 0, 0, 17, 0, 6, 65, 0, 4,
+	18, 5, 0, 0, 0, 0, 17, 0, 6, 0,
+	41, 0, 18, 9, 16, 7, 8, 10, 11, 0,
+	0, 3, 0, 9, 16, 7, 8, 10, 11, 0,
+	0, 4, 0, 5, 0, 0, 0, 0, 17, 0,
+	6, 4, 0, 5, 18, 0, 0, 0, 17, 0,
+	6, 31, 32, 0, 18, 33, 73, 25, 26, 29,
+	30, 27, 28, 0, 20, 21, 22, 23, 24, 34,
+	35, 31, 32, 19, 0, 33, 0, 25, 26, 29,
+	30, 27, 28, 0, 20, 21, 22, 23, 24, 34,
+	35, 31, 32, 0, 0, 33, 0, 25, 26, 29,
+	30, 27, 28, 0, 20, 21, 22, 23, 24, 34,
+	35, 31, 0, 0, 0, 0, 0, 25, 26, 29,
+	30, 27, 28, 0, 20, 21, 22, 23, 24, 34,
+	35, 25, 26, 29, 30, 27, 28, 0, 20, 21,
+	22, 23, 24, 34, 35,
+}
 
-var yyAct = []int{
+var yyPact = [...]int16{
+	199, -32768, 251, -32768, 209, 209, 209, -32768, -32768, -32768,
+	-32768, -32768, -32768, -32768, -32768, -32768, 8, 167, 4, -32768,
+	209, 209, 209, 209, 209, 209, 209, 209, 209, 209,
+	209, 209, 209, 209, 37, 209, 38, -32768, 82, 155,
+	-31, -32768, 271, -24, -32768, 53, 44, 55, 55, 29,
+	29, 29, 305, 305, 305, 305, 305, 305, 305, 291,
+	231, -11, 27, -32768, -17, -32768, 271, -32768, 209, -32768,
+	66, 209, 209, 209, 123, -12, -32768, 209, 271, 34,
+	20, 271, 271, 271, -18, -32768, 111, 271, 209, 209,
+	-32768, -21, -32768, 271, 271, -32768,
+}
 
-	64, 2, 85, 84, 62, 35, 36, 37, 44, 45,
-	70, 69, 68, 91, 67, 74, 59, 86, 41, 74,
-	82, 46, 47, 48, 49, 50, 51, 52, 53, 54,
-	55, 56, 57, 58, 71, 60, 31, 32, 43, 38,
-	25, 26, 29, 30, 27, 28, 42, 20, 21, 22,
-	23, 24, 33, 34, 73, 39, 74, 72, 65, 66,
-	20, 21, 22, 23, 24, 33, 34, 75, 33, 34,
-	78, 79, 76, 77, 14, 83, 80, 22, 23, 24,
-	33, 34, 13, 15, 12, 89, 90, 87, 31, 32,
-	1, 0, 25, 26, 29, 30, 27, 28, 0, 20,
-	21, 22, 23, 24, 33, 34, 0, 0, 61, 9,
-	16, 7, 8, 10, 11, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 4, 0, 5, 0, 0,
-	0, 0, 17, 0, 6, 88, 0, 0, 18, 9,
-	16, 7, 8, 10, 11, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 4, 0, 5, 0, 0,
-	0, 0, 17, 0, 6, 81, 0, 0, 18, 9,
-	16, 7, 8, 10, 11, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 4, 0, 5, 0, 0,
-	0, 0, 17, 0, 6, 63, 0, 0, 18, 9,
-	16, 7, 8, 10, 11, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 4, 0, 5, 0, 0,
-	0, 0, 17, 0, 6, 0, 40, 0, 18, 9,
-	16, 7, 8, 10, 11, 0, 0, 3, 0, 9,
-	16, 7, 8, 10, 11, 4, 0, 5, 0, 0,
-	0, 0, 17, 0, 6, 4, 0, 5, 18, 0,
-	0, 0, 17, 0, 6, 31, 32, 19, 18, 25,
-	26, 29, 30, 27, 28, 0, 20, 21, 22, 23,
-	24, 33, 34, 31, 32, 0, 0, 25, 26, 29,
-	30, 27, 28, 0, 20, 21, 22, 23, 24, 33,
-	34, 25, 26, 29, 30, 27, 28, 0, 20, 21,
-	22, 23, 24, 33, 34,
-}
-var yyPact = []int{
-
-	225, -1000, 255, -1000, 235, 235, 235, -1000, -1000, -1000,
-	-1000, -1000, -1000, -1000, -1000, -1000, 10, 195, 4, -1000,
-	235, 235, 235, 235, 235, 235, 235, 235, 235, 235,
-	235, 235, 235, 11, 235, 39, -1000, 78, 165, 27,
-	-1000, 273, -20, -1000, -24, -25, 54, 54, 42, 42,
-	42, 287, 287, 287, 287, 287, 287, 273, 273, 5,
-	26, -1000, 24, -1000, 273, -1000, 235, -1000, 68, 235,
-	235, 135, -9, -1000, 235, 273, -32, -33, 273, 273,
-	-13, -1000, 105, 273, 235, 235, -1000, -17, -1000, 273,
-	273, -1000,
-}
-var yyPgo = []int{
-
-	0, 0, 90, 84, 83, 82, 74, 55, 4, 46,
-}
-var yyR1 = []int{
+var yyPgo = [...]int8{
+	0, 0, 88, 87, 86, 85, 77, 76, 4, 75,
+}
 
+var yyR1 = [...]int8{
 	0, 2, 2, 1, 1, 1, 1, 1, 1, 1,
 	1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
-	1, 1, 1, 1, 1, 1, 1, 1, 3, 3,
-	3, 4, 4, 4, 4, 4, 4, 8, 8, 5,
-	5, 7, 7, 6, 6, 9, 9, 9, 9,
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 3,
+	3, 3, 4, 4, 4, 4, 4, 4, 8, 8,
+	5, 5, 7, 7, 6, 6, 9, 9, 9, 9,
 }
-var yyR2 = []int{
 
+var yyR2 = [...]int8{
 	0, 2, 1, 3, 3, 3, 3, 3, 3, 3,
-	3, 3, 3, 3, 3, 3, 2, 2, 3, 1,
-	1, 1, 1, 1, 1, 1, 1, 1, 3, 4,
-	1, 6, 5, 7, 6, 4, 3, 1, 3, 3,
-	2, 1, 3, 3, 2, 3, 3, 5, 5,
-}
-var yyChk = []int{
-
-	-1000, -2, -1, 12, 20, 22, 29, 6, 7, 4,
-	8, 9, -3, -5, -6, -4, 5, 27, 33, 12,
-	21, 22, 23, 24, 25, 14, 15, 18, 19, 16,
-	17, 10, 11, 26, 27, -1, -1, -1, 29, -7,
-	31, -1, -9, 34, 4, 5, -1, -1, -1, -1,
-	-1, -1, -1, -1, -1, -1, -1, -1, -1, 5,
-	-1, 30, -8, 30, -1, 31, 32, 34, 32, 35,
-	35, 29, 31, 30, 32, -1, 4, 5, -1, -1,
-	-8, 30, 29, -1, 35, 35, 30, -8, 30, -1,
-	-1, 30,
-}
-var yyDef = []int{
-
-	0, -2, 0, 2, 0, 0, 0, 19, 20, 21,
-	22, 23, 24, 25, 26, 27, 30, 0, 0, 1,
+	3, 3, 3, 3, 3, 3, 5, 2, 2, 3,
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 3,
+	4, 1, 6, 5, 7, 6, 4, 3, 1, 3,
+	3, 2, 1, 3, 3, 2, 3, 3, 5, 5,
+}
+
+var yyChk = [...]int16{
+	-32768, -2, -1, 12, 22, 24, 31, 6, 7, 4,
+	8, 9, -3, -5, -6, -4, 5, 29, 35, 12,
+	23, 24, 25, 26, 27, 16, 17, 20, 21, 18,
+	19, 10, 11, 14, 28, 29, -1, -1, -1, 31,
+	-7, 33, -1, -9, 36, 4, 5, -1, -1, -1,
+	-1, -1, -1, -1, -1, -1, -1, -1, -1, -1,
+	-1, 5, -1, 32, -8, 32, -1, 33, 34, 36,
+	34, 15, 15, 15, 31, 33, 32, 34, -1, 4,
+	5, -1, -1, -1, -8, 32, 31, -1, 15, 15,
+	32, -8, 32, -1, -1, 32,
+}
+
+var yyDef = [...]int8{
+	0, -2, 0, 2, 0, 0, 0, 20, 21, 22,
+	23, 24, 25, 26, 27, 28, 31, 0, 0, 1,
 	0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 16, 17, 0, 0, 0,
-	40, 41, 0, 44, 0, 0, 3, 4, 5, 6,
-	7, 8, 9, 10, 11, 12, 13, 14, 15, 28,
-	0, 18, 0, 36, 37, 39, 0, 43, 0, 0,
-	0, 0, 29, 35, 0, 42, 0, 0, 45, 46,
-	0, 32, 0, 38, 0, 0, 31, 0, 34, 47,
-	48, 33,
+	0, 0, 0, 0, 0, 0, 17, 18, 0, 0,
+	0, 41, 42, 0, 45, 0, 0, 3, 4, 5,
+	6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+	0, 29, 0, 19, 0, 37, 38, 40, 0, 44,
+	0, 0, 0, 0, 0, 30, 36, 0, 43, 0,
+	0, 46, 47, 16, 0, 33, 0, 39, 0, 0,
+	32, 0, 35, 48, 49, 34,
 }
-var yyTok1 = []int{
 
+var yyTok1 = [...]int8{
 	1, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	3, 3, 3, 20, 3, 3, 3, 25, 3, 3,
-	29, 30, 24, 21, 32, 22, 26, 23, 3, 3,
-	3, 3, 3, 3, 3, 3, 3, 3, 35, 3,
-	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 22, 3, 3, 3, 27, 3, 3,
+	31, 32, 26, 23, 34, 24, 28, 25, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 15, 3,
+	3, 3, 3, 14, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	3, 27, 3, 31, 3, 3, 3, 3, 3, 3,
+	3, 29, 3, 33, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	3, 3, 3, 33, 3, 34,
+	3, 3, 3, 35, 3, 36,
 }
-var yyTok2 = []int{
 
+var yyTok2 = [...]int8{
 	2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
-	12, 13, 14, 15, 16, 17, 18, 19, 28,
+	12, 13, 16, 17, 18, 19, 20, 21, 30,
 }
-var yyTok3 = []int{
+
+var yyTok3 = [...]int8{
 	0,
 }
 
+var yyErrorMessages = [...]struct {
+	state int
+	token int
+	msg   string
+}{}
+
 //line yaccpar:1
 
 /*	parser for yacc output	*/
 
-var yyDebug = 0
+var (
+	yyDebug        = 0
+	yyErrorVerbose = false
+)
 
 type yyLexer interface {
 	Lex(lval *yySymType) int
 	Error(s string)
 }
 
-const yyFlag = -1000
+type yyParser interface {
+	Parse(yyLexer) int
+	Lookahead() int
+}
+
+type yyParserImpl struct {
+	lval  yySymType
+	stack [yyInitialStackSize]yySymType
+	char  int
+}
+
+func (p *yyParserImpl) Lookahead() int {
+	return p.char
+}
+
+func yyNewParser() yyParser {
+	return &yyParserImpl{}
+}
+
+const yyFlag = -32768
 
 func yyTokname(c int) string {
-	// 4 is TOKSTART above
-	if c >= 4 && c-4 < len(yyToknames) {
-		if yyToknames[c-4] != "" {
-			return yyToknames[c-4]
+	if c >= 1 && c-1 < len(yyToknames) {
+		if yyToknames[c-1] != "" {
+			return yyToknames[c-1]
 		}
 	}
 	return __yyfmt__.Sprintf("tok-%v", c)
@@ -490,51 +651,127 @@ func yyStatname(s int) string {
 	return __yyfmt__.Sprintf("state-%v", s)
 }
 
-func yylex1(lex yyLexer, lval *yySymType) int {
-	c := 0
-	char := lex.Lex(lval)
+func yyErrorMessage(state, lookAhead int) string {
+	const TOKSTART = 4
+
+	if !yyErrorVerbose {
+		return "syntax error"
+	}
+
+	for _, e := range yyErrorMessages {
+		if e.state == state && e.token == lookAhead {
+			return "syntax error: " + e.msg
+		}
+	}
+
+	res := "syntax error: unexpected " + yyTokname(lookAhead)
+
+	// To match Bison, suggest at most four expected tokens.
+	expected := make([]int, 0, 4)
+
+	// Look for shiftable tokens.
+	base := int(yyPact[state])
+	for tok := TOKSTART; tok-1 < len(yyToknames); tok++ {
+		if n := base + tok; n >= 0 && n < yyLast && int(yyChk[int(yyAct[n])]) == tok {
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
+	}
+
+	if yyDef[state] == -2 {
+		i := 0
+		for yyExca[i] != -1 || int(yyExca[i+1]) != state {
+			i += 2
+		}
+
+		// Look for tokens that we accept or reduce.
+		for i += 2; yyExca[i] >= 0; i += 2 {
+			tok := int(yyExca[i])
+			if tok < TOKSTART || yyExca[i+1] == 0 {
+				continue
+			}
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
+
+		// If the default action is to accept or reduce, give up.
+		if yyExca[i+1] != 0 {
+			return res
+		}
+	}
+
+	for i, tok := range expected {
+		if i == 0 {
+			res += ", expecting "
+		} else {
+			res += " or "
+		}
+		res += yyTokname(tok)
+	}
+	return res
+}
+
+func yylex1(lex yyLexer, lval *yySymType) (char, token int) {
+	token = 0
+	char = lex.Lex(lval)
 	if char <= 0 {
-		c = yyTok1[0]
+		token = int(yyTok1[0])
 		goto out
 	}
 	if char < len(yyTok1) {
-		c = yyTok1[char]
+		token = int(yyTok1[char])
 		goto out
 	}
 	if char >= yyPrivate {
 		if char < yyPrivate+len(yyTok2) {
-			c = yyTok2[char-yyPrivate]
+			token = int(yyTok2[char-yyPrivate])
 			goto out
 		}
 	}
 	for i := 0; i < len(yyTok3); i += 2 {
-		c = yyTok3[i+0]
-		if c == char {
-			c = yyTok3[i+1]
+		token = int(yyTok3[i+0])
+		if token == char {
+			token = int(yyTok3[i+1])
 			goto out
 		}
 	}
 
 out:
-	if c == 0 {
-		c = yyTok2[1] /* unknown char */
+	if token == 0 {
+		token = int(yyTok2[1]) /* unknown char */
 	}
 	if yyDebug >= 3 {
-		__yyfmt__.Printf("lex %s(%d)\n", yyTokname(c), uint(char))
+		__yyfmt__.Printf("lex %s(%d)\n", yyTokname(token), uint(char))
 	}
-	return c
+	return char, token
 }
 
 func yyParse(yylex yyLexer) int {
+	return yyNewParser().Parse(yylex)
+}
+
+func (yyrcvr *yyParserImpl) Parse(yylex yyLexer) int {
 	var yyn int
-	var yylval yySymType
 	var yyVAL yySymType
-	yyS := make([]yySymType, yyMaxDepth)
+	var yyDollar []yySymType
+	_ = yyDollar // silence set and not used
+	yyS := yyrcvr.stack[:]
 
 	Nerrs := 0   /* number of errors */
 	Errflag := 0 /* error recovery flag */
 	yystate := 0
-	yychar := -1
+	yyrcvr.char = -1
+	yytoken := -1 // yyrcvr.char translated into internal numbering
+	defer func() {
+		// Make sure we report no lookahead when not parsing.
+		yystate = -1
+		yyrcvr.char = -1
+		yytoken = -1
+	}()
 	yyp := -1
 	goto yystack
 
@@ -547,7 +784,7 @@ ret1:
 yystack:
 	/* put a state and value onto the stack */
 	if yyDebug >= 4 {
-		__yyfmt__.Printf("char %v in %v\n", yyTokname(yychar), yyStatname(yystate))
+		__yyfmt__.Printf("char %v in %v\n", yyTokname(yytoken), yyStatname(yystate))
 	}
 
 	yyp++
@@ -560,21 +797,22 @@ yystack:
 	yyS[yyp].yys = yystate
 
 yynewstate:
-	yyn = yyPact[yystate]
+	yyn = int(yyPact[yystate])
 	if yyn <= yyFlag {
 		goto yydefault /* simple state */
 	}
-	if yychar < 0 {
-		yychar = yylex1(yylex, &yylval)
+	if yyrcvr.char < 0 {
+		yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
 	}
-	yyn += yychar
+	yyn += yytoken
 	if yyn < 0 || yyn >= yyLast {
 		goto yydefault
 	}
-	yyn = yyAct[yyn]
-	if yyChk[yyn] == yychar { /* valid shift */
-		yychar = -1
-		yyVAL = yylval
+	yyn = int(yyAct[yyn])
+	if int(yyChk[yyn]) == yytoken { /* valid shift */
+		yyrcvr.char = -1
+		yytoken = -1
+		yyVAL = yyrcvr.lval
 		yystate = yyn
 		if Errflag > 0 {
 			Errflag--
@@ -584,27 +822,27 @@ yynewstate:
 
 yydefault:
 	/* default state action */
-	yyn = yyDef[yystate]
+	yyn = int(yyDef[yystate])
 	if yyn == -2 {
-		if yychar < 0 {
-			yychar = yylex1(yylex, &yylval)
+		if yyrcvr.char < 0 {
+			yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
 		}
 
 		/* look through exception table */
 		xi := 0
 		for {
-			if yyExca[xi+0] == -1 && yyExca[xi+1] == yystate {
+			if yyExca[xi+0] == -1 && int(yyExca[xi+1]) == yystate {
 				break
 			}
 			xi += 2
 		}
 		for xi += 2; ; xi += 2 {
-			yyn = yyExca[xi+0]
-			if yyn < 0 || yyn == yychar {
+			yyn = int(yyExca[xi+0])
+			if yyn < 0 || yyn == yytoken {
 				break
 			}
 		}
-		yyn = yyExca[xi+1]
+		yyn = int(yyExca[xi+1])
 		if yyn < 0 {
 			goto ret0
 		}
@@ -613,11 +851,11 @@ yydefault:
 		/* error ... attempt to resume parsing */
 		switch Errflag {
 		case 0: /* brand new error */
-			yylex.Error("syntax error")
+			yylex.Error(yyErrorMessage(yystate, yytoken))
 			Nerrs++
 			if yyDebug >= 1 {
 				__yyfmt__.Printf("%s", yyStatname(yystate))
-				__yyfmt__.Printf(" saw %s\n", yyTokname(yychar))
+				__yyfmt__.Printf(" saw %s\n", yyTokname(yytoken))
 			}
 			fallthrough
 
@@ -626,10 +864,10 @@ yydefault:
 
 			/* find a state where "error" is a legal shift action */
 			for yyp >= 0 {
-				yyn = yyPact[yyS[yyp].yys] + yyErrCode
+				yyn = int(yyPact[yyS[yyp].yys]) + yyErrCode
 				if yyn >= 0 && yyn < yyLast {
-					yystate = yyAct[yyn] /* simulate a shift of "error" */
-					if yyChk[yystate] == yyErrCode {
+					yystate = int(yyAct[yyn]) /* simulate a shift of "error" */
+					if int(yyChk[yystate]) == yyErrCode {
 						goto yystack
 					}
 				}
@@ -645,12 +883,13 @@ yydefault:
 
 		case 3: /* no shift yet; clobber input char */
 			if yyDebug >= 2 {
-				__yyfmt__.Printf("error recovery discards %s\n", yyTokname(yychar))
+				__yyfmt__.Printf("error recovery discards %s\n", yyTokname(yytoken))
 			}
-			if yychar == yyEofCode {
+			if yytoken == yyEofCode {
 				goto ret1
 			}
-			yychar = -1
+			yyrcvr.char = -1
+			yytoken = -1
 			goto yynewstate /* try again in the same state */
 		}
 	}
@@ -664,267 +903,328 @@ yydefault:
 	yypt := yyp
 	_ = yypt // guard against "declared and not used"
 
-	yyp -= yyR2[yyn]
+	yyp -= int(yyR2[yyn])
+	// yyp is now the index of $0. Perform the default action. Iff the
+	// reduced production is ε, $1 is possibly out of range.
+	if yyp+1 >= len(yyS) {
+		nyys := make([]yySymType, len(yyS)*2)
+		copy(nyys, yyS)
+		yyS = nyys
+	}
 	yyVAL = yyS[yyp+1]
 
 	/* consult goto table to find next state */
-	yyn = yyR1[yyn]
-	yyg := yyPgo[yyn]
+	yyn = int(yyR1[yyn])
+	yyg := int(yyPgo[yyn])
 	yyj := yyg + yyS[yyp].yys + 1
 
 	if yyj >= yyLast {
-		yystate = yyAct[yyg]
+		yystate = int(yyAct[yyg])
 	} else {
-		yystate = yyAct[yyj]
-		if yyChk[yystate] != -yyn {
-			yystate = yyAct[yyg]
+		yystate = int(yyAct[yyj])
+		if int(yyChk[yystate]) != -yyn {
+			yystate = int(yyAct[yyg])
 		}
 	}
 	// dummy call; replaced with literal code
 	switch yynt {
 
 	case 1:
-		//line parser.y:40
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.y:46
 		{
 			if l, ok := yylex.(*lexer); ok {
-				l.ast = yyS[yypt-1].expression
+				l.ast = yyDollar[1].expression
 			}
 			return 1
 		}
 	case 2:
-		//line parser.y:41
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:47
 		{
 			return 1
 		}
 	case 3:
-		//line parser.y:44
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:50
 		{
-			yyVAL.expression = &binExpr{i_add, yyS[yypt-2].expression, yyS[yypt-0].expression}
+			yyVAL.expression = &binExpr{i_add, yyDollar[1].expression, yyDollar[3].expression, node{yyDollar[2].position}}
 		}
 	case 4:
-		//line parser.y:45
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:51
 		{
-			yyVAL.expression = &binExpr{i_sub, yyS[yypt-2].expression, yyS[yypt-0].expression}
+			yyVAL.expression = &binExpr{i_sub, yyDollar[1].expression, yyDollar[3].expression, node{yyDollar[2].position}}
 		}
 	case 5:
-		//line parser.y:46
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:52
 		{
-			yyVAL.expression = &binExpr{i_div, yyS[yypt-2].expression, yyS[yypt-0].expression}
+			yyVAL.expression = &binExpr{i_div, yyDollar[1].expression, yyDollar[3].expression, node{yyDollar[2].position}}
 		}
 	case 6:
-		//line parser.y:47
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:53
 		{
-			yyVAL.expression = &binExpr{i_mul, yyS[yypt-2].expression, yyS[yypt-0].expression}
+			yyVAL.expression = &binExpr{i_mul, yyDollar[1].expression, yyDollar[3].expression, node{yyDollar[2].position}}
 		}
 	case 7:
-		//line parser.y:48
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:54
 		{
-			yyVAL.expression = &binExpr{i_mod, yyS[yypt-2].expression, yyS[yypt-0].expression}
+			yyVAL.expression = &binExpr{i_mod, yyDollar[1].expression, yyDollar[3].expression, node{yyDollar[2].position}}
 		}
 	case 8:
-		//line parser.y:49
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:55
 		{
-			yyVAL.expression = &binExpr{i_equ, yyS[yypt-2].expression, yyS[yypt-0].expression}
+			yyVAL.expression = &binExpr{i_equ, yyDollar[1].expression, yyDollar[3].expression, node{yyDollar[2].position}}
 		}
 	case 9:
-		//line parser.y:50
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:56
 		{
-			yyVAL.expression = &binExpr{i_neq, yyS[yypt-2].expression, yyS[yypt-0].expression}
+			yyVAL.expression = &binExpr{i_neq, yyDollar[1].expression, yyDollar[3].expression, node{yyDollar[2].position}}
 		}
 	case 10:
-		//line parser.y:51
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:57
 		{
-			yyVAL.expression = &binExpr{i_lt, yyS[yypt-2].expression, yyS[yypt-0].expression}
+			yyVAL.expression = &binExpr{i_lt, yyDollar[1].expression, yyDollar[3].expression, node{yyDollar[2].position}}
 		}
 	case 11:
-		//line parser.y:52
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:58
 		{
-			yyVAL.expression = &binExpr{i_gt, yyS[yypt-2].expression, yyS[yypt-0].expression}
+			yyVAL.expression = &binExpr{i_gt, yyDollar[1].expression, yyDollar[3].expression, node{yyDollar[2].position}}
 		}
 	case 12:
-		//line parser.y:53
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:59
 		{
-			yyVAL.expression = &binExpr{i_lte, yyS[yypt-2].expression, yyS[yypt-0].expression}
+			yyVAL.expression = &binExpr{i_lte, yyDollar[1].expression, yyDollar[3].expression, node{yyDollar[2].position}}
 		}
 	case 13:
-		//line parser.y:54
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:60
 		{
-			yyVAL.expression = &binExpr{i_gte, yyS[yypt-2].expression, yyS[yypt-0].expression}
+			yyVAL.expression = &binExpr{i_gte, yyDollar[1].expression, yyDollar[3].expression, node{yyDollar[2].position}}
 		}
 	case 14:
-		//line parser.y:55
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:61
 		{
-			yyVAL.expression = &binExpr{i_and, yyS[yypt-2].expression, yyS[yypt-0].expression}
+			yyVAL.expression = &logicalExpr{i_jump_if_false_or_pop, yyDollar[1].expression, yyDollar[3].expression, node{yyDollar[2].position}}
 		}
 	case 15:
-		//line parser.y:56
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:62
 		{
-			yyVAL.expression = &binExpr{i_or, yyS[yypt-2].expression, yyS[yypt-0].expression}
+			yyVAL.expression = &logicalExpr{i_jump_if_true_or_pop, yyDollar[1].expression, yyDollar[3].expression, node{yyDollar[2].position}}
 		}
 	case 16:
-		//line parser.y:57
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line parser.y:63
 		{
-			yyVAL.expression = &unaryExpr{i_not, yyS[yypt-0].expression}
+			yyVAL.expression = &conditionalExpr{yyDollar[1].expression, yyDollar[3].expression, yyDollar[5].expression, node{yyDollar[2].position}}
 		}
 	case 17:
-		//line parser.y:58
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.y:64
 		{
-			yyVAL.expression = &unaryExpr{i_neg, yyS[yypt-0].expression}
+			yyVAL.expression = &unaryExpr{i_not, yyDollar[2].expression, node{yyDollar[1].position}}
 		}
 	case 18:
-		//line parser.y:59
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.y:65
 		{
-			yyVAL.expression = yyS[yypt-1].expression
+			yyVAL.expression = &unaryExpr{i_neg, yyDollar[2].expression, node{yyDollar[1].position}}
 		}
 	case 19:
-		//line parser.y:60
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:66
 		{
-			yyVAL.expression = &literalNumberExpr{yyS[yypt-0].stringValue}
+			yyVAL.expression = yyDollar[2].expression
 		}
 	case 20:
-		//line parser.y:61
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:67
 		{
-			yyVAL.expression = &literalNumberExpr{yyS[yypt-0].stringValue}
+			yyVAL.expression = &literalNumberExpr{yyDollar[1].stringValue, node{yyDollar[1].position}}
 		}
 	case 21:
-		//line parser.y:62
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:68
 		{
-			yyVAL.expression = &literalStringExpr{yyS[yypt-0].stringValue}
+			yyVAL.expression = &literalNumberExpr{yyDollar[1].stringValue, node{yyDollar[1].position}}
 		}
 	case 22:
-		//line parser.y:63
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:69
 		{
-			yyVAL.expression = &literalBooleanExpr{yyS[yypt-0].stringValue}
+			yyVAL.expression = &literalStringExpr{yyDollar[1].stringValue, node{yyDollar[1].position}}
 		}
 	case 23:
-		//line parser.y:64
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:70
 		{
-			yyVAL.expression = &literalNullExpr{}
+			yyVAL.expression = &literalBooleanExpr{yyDollar[1].stringValue, node{yyDollar[1].position}}
 		}
 	case 24:
-		//line parser.y:65
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:71
 		{
-			yyVAL.expression = yyS[yypt-0].expression
+			yyVAL.expression = &literalNullExpr{node{yyDollar[1].position}}
 		}
 	case 25:
-		//line parser.y:66
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:72
 		{
-			yyVAL.expression = yyS[yypt-0].expression
+			yyVAL.expression = yyDollar[1].expression
 		}
 	case 26:
-		//line parser.y:67
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:73
 		{
-			yyVAL.expression = yyS[yypt-0].expression
+			yyVAL.expression = yyDollar[1].expression
 		}
 	case 27:
-		//line parser.y:68
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:74
 		{
-			yyVAL.expression = yyS[yypt-0].expression
+			yyVAL.expression = yyDollar[1].expression
 		}
 	case 28:
-		//line parser.y:72
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:75
 		{
-			yyVAL.expression = &attributeSelectionExpr{yyS[yypt-2].expression, &literalStringExpr{yyS[yypt-0].stringValue}}
+			yyVAL.expression = yyDollar[1].expression
 		}
 	case 29:
-		//line parser.y:73
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:79
 		{
-			yyVAL.expression = &attributeSelectionExpr{yyS[yypt-3].expression, yyS[yypt-1].expression}
+			yyVAL.expression = &attributeSelectionExpr{yyDollar[1].expression, &literalStringExpr{yyDollar[3].stringValue, node{yyDollar[3].position}}, node{yyDollar[3].position}}
 		}
 	case 30:
-		//line parser.y:74
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.y:80
 		{
-			yyVAL.expression = &attributeSelectionExpr{&getGlobalObjectExpr{}, &literalStringExpr{yyS[yypt-0].stringValue}}
+			yyVAL.expression = &attributeSelectionExpr{yyDollar[1].expression, yyDollar[3].expression, node{yyDollar[2].position}}
 		}
 	case 31:
-		//line parser.y:77
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:81
 		{
-			yyVAL.expression = &functionCallExpr{yyS[yypt-5].expression, &literalStringExpr{yyS[yypt-3].stringValue}, yyS[yypt-1].list}
+			yyVAL.expression = &attributeSelectionExpr{&getGlobalObjectExpr{node{yyDollar[1].position}}, &literalStringExpr{yyDollar[1].stringValue, node{yyDollar[1].position}}, node{yyDollar[1].position}}
 		}
 	case 32:
-		//line parser.y:78
+		yyDollar = yyS[yypt-6 : yypt+1]
+//line parser.y:84
 		{
-			yyVAL.expression = &functionCallExpr{yyS[yypt-4].expression, &literalStringExpr{yyS[yypt-2].stringValue}, NewExpressionList()}
+			yyVAL.expression = &functionCallExpr{yyDollar[1].expression, &literalStringExpr{yyDollar[3].stringValue, node{yyDollar[3].position}}, yyDollar[5].list, node{yyDollar[3].position}}
 		}
 	case 33:
-		//line parser.y:79
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line parser.y:85
 		{
-			yyVAL.expression = &functionCallExpr{yyS[yypt-6].expression, yyS[yypt-4].expression, yyS[yypt-1].list}
+			yyVAL.expression = &functionCallExpr{yyDollar[1].expression, &literalStringExpr{yyDollar[3].stringValue, node{yyDollar[3].position}}, NewExpressionList(), node{yyDollar[3].position}}
 		}
 	case 34:
-		//line parser.y:80
+		yyDollar = yyS[yypt-7 : yypt+1]
+//line parser.y:86
 		{
-			yyVAL.expression = &functionCallExpr{yyS[yypt-5].expression, yyS[yypt-3].expression, NewExpressionList()}
+			yyVAL.expression = &functionCallExpr{yyDollar[1].expression, yyDollar[3].expression, yyDollar[6].list, node{yyDollar[2].position}}
 		}
 	case 35:
-		//line parser.y:81
+		yyDollar = yyS[yypt-6 : yypt+1]
+//line parser.y:87
 		{
-			yyVAL.expression = &functionCallExpr{&getGlobalObjectExpr{}, &literalStringExpr{yyS[yypt-3].stringValue}, yyS[yypt-1].list}
+			yyVAL.expression = &functionCallExpr{yyDollar[1].expression, yyDollar[3].expression, NewExpressionList(), node{yyDollar[2].position}}
 		}
 	case 36:
-		//line parser.y:82
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.y:88
 		{
-			yyVAL.expression = &functionCallExpr{&getGlobalObjectExpr{}, &literalStringExpr{yyS[yypt-2].stringValue}, NewExpressionList()}
+			yyVAL.expression = &functionCallExpr{&getGlobalObjectExpr{node{yyDollar[1].position}}, &literalStringExpr{yyDollar[1].stringValue, node{yyDollar[1].position}}, yyDollar[3].list, node{yyDollar[1].position}}
 		}
 	case 37:
-		//line parser.y:85
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:89
 		{
-			yyVAL.list = NewExpressionList().Append(yyS[yypt-0].expression)
+			yyVAL.expression = &functionCallExpr{&getGlobalObjectExpr{node{yyDollar[1].position}}, &literalStringExpr{yyDollar[1].stringValue, node{yyDollar[1].position}}, NewExpressionList(), node{yyDollar[1].position}}
 		}
 	case 38:
-		//line parser.y:86
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:92
 		{
-			yyVAL.list = yyS[yypt-2].list.Append(yyS[yypt-0].expression)
+			yyVAL.list = NewExpressionList().Append(yyDollar[1].expression)
 		}
 	case 39:
-		//line parser.y:89
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:93
 		{
-			yyVAL.expression = &arrayDefExpr{yyS[yypt-1].list}
+			yyVAL.list = yyDollar[1].list.Append(yyDollar[3].expression)
 		}
 	case 40:
-		//line parser.y:90
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:96
 		{
-			yyVAL.expression = &arrayDefExpr{nil}
+			yyVAL.expression = &arrayDefExpr{yyDollar[2].list, node{yyDollar[1].position}}
 		}
 	case 41:
-		//line parser.y:93
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.y:97
 		{
-			yyVAL.list = NewExpressionList().Append(&unaryExpr{i_array_append, yyS[yypt-0].expression})
+			yyVAL.expression = &arrayDefExpr{nil, node{yyDollar[1].position}}
 		}
 	case 42:
-		//line parser.y:94
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:100
 		{
-			yyVAL.list = yyS[yypt-2].list.Append(&unaryExpr{i_array_append, yyS[yypt-0].expression})
+			yyVAL.list = NewExpressionList().Append(&unaryExpr{i_array_append, yyDollar[1].expression, node{yyDollar[1].position}})
 		}
 	case 43:
-		//line parser.y:97
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:101
 		{
-			yyVAL.expression = &objectDefExpr{yyS[yypt-1].list}
+			yyVAL.list = yyDollar[1].list.Append(&unaryExpr{i_array_append, yyDollar[3].expression, node{yyDollar[3].position}})
 		}
 	case 44:
-		//line parser.y:98
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:104
 		{
-			yyVAL.expression = &objectDefExpr{nil}
+			yyVAL.expression = &objectDefExpr{yyDollar[2].list, node{yyDollar[1].position}}
 		}
 	case 45:
-		//line parser.y:101
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.y:105
 		{
-			yyVAL.list = NewExpressionList().Append(&binExpr{i_set_index, &literalStringExpr{yyS[yypt-2].stringValue}, yyS[yypt-0].expression})
+			yyVAL.expression = &objectDefExpr{nil, node{yyDollar[1].position}}
 		}
 	case 46:
-		//line parser.y:102
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:108
 		{
-			yyVAL.list = NewExpressionList().Append(&binExpr{i_set_index, &literalStringExpr{yyS[yypt-2].stringValue}, yyS[yypt-0].expression})
+			yyVAL.list = NewExpressionList().Append(&binExpr{i_set_index, &literalStringExpr{yyDollar[1].stringValue, node{yyDollar[1].position}}, yyDollar[3].expression, node{yyDollar[1].position}})
 		}
 	case 47:
-		//line parser.y:103
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:109
 		{
-			yyVAL.list = yyS[yypt-4].list.Append(&binExpr{i_set_index, &literalStringExpr{yyS[yypt-2].stringValue}, yyS[yypt-0].expression})
+			yyVAL.list = NewExpressionList().Append(&binExpr{i_set_index, &literalStringExpr{yyDollar[1].stringValue, node{yyDollar[1].position}}, yyDollar[3].expression, node{yyDollar[1].position}})
 		}
 	case 48:
-		//line parser.y:104
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line parser.y:110
+		{
+			yyVAL.list = yyDollar[1].list.Append(&binExpr{i_set_index, &literalStringExpr{yyDollar[3].stringValue, node{yyDollar[3].position}}, yyDollar[5].expression, node{yyDollar[3].position}})
+		}
+	case 49:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line parser.y:111
 		{
-			yyVAL.list = yyS[yypt-4].list.Append(&binExpr{i_set_index, &literalStringExpr{yyS[yypt-2].stringValue}, yyS[yypt-0].expression})
+			yyVAL.list = yyDollar[1].list.Append(&binExpr{i_set_index, &literalStringExpr{yyDollar[3].stringValue, node{yyDollar[3].position}}, yyDollar[5].expression, node{yyDollar[3].position}})
 		}
 	}
 	goto yystack /* stack new state and value */
@@ -36,6 +36,7 @@ func (log *LogEntry) Load(context *ctp.ApiContext) *ctp.HttpError {
 	if !ctp.LoadResource(context, "logs", ctp.Base64Id(context.Params[1]), log) {
 		return ctp.NewHttpError(http.StatusNotFound, "Not Found")
 	}
+	log.Trigger = ctp.ExpandLink(context.CtpBase, log.Trigger)
 	log.BuildLinks(context)
 	return nil
 }
@@ -43,9 +44,11 @@ func (log *LogEntry) Load(context *ctp.ApiContext) *ctp.HttpError {
 func (log *LogEntry) Create(context *ctp.ApiContext) *ctp.HttpError {
 	log.BuildLinks(context)
 	//log.CreationTime = ctp.Now()
+	log.Trigger = ctp.ShortenLink(context.CtpBase, log.Trigger)
 	if !ctp.CreateResource(context, "logs", log) {
 		return ctp.NewHttpError(http.StatusInternalServerError, "Could not save object")
 	}
+	log.Trigger = ctp.ExpandLink(context.CtpBase, log.Trigger)
 	return nil
 }
 
@@ -58,7 +61,7 @@ func (log *LogEntry) Delete(context *ctp.ApiContext) *ctp.HttpError {
 }
 */
 
-func CreateNormalLogEntry(context *ctp.ApiContext, trigger *Trigger, result *Result, tags []string) *ctp.HttpError {
+func CreateNormalLogEntry(context *ctp.ApiContext, trigger *Trigger, result *Result, tags []string) (*LogEntry, *ctp.HttpError) {
 	var log = new(LogEntry)
 	log.Id = ctp.NewBase64Id()
 	log.Parent = trigger.Parent
@@ -67,10 +70,10 @@ func CreateNormalLogEntry(context *ctp.ApiContext, trigger *Trigger, result *Res
 	log.Trigger = trigger.Self
 	log.Result = result
 	log.Tags = tags
-	return log.Create(context)
+	return log, log.Create(context)
 }
 
-func CreateErrorLogEntry(context *ctp.ApiContext, trigger *Trigger, errmsg string) *ctp.HttpError {
+func CreateErrorLogEntry(context *ctp.ApiContext, trigger *Trigger, errmsg string) (*LogEntry, *ctp.HttpError) {
 	var log = new(LogEntry)
 	log.Id = ctp.NewBase64Id()
 	log.Parent = trigger.Parent
@@ -79,7 +82,7 @@ func CreateErrorLogEntry(context *ctp.ApiContext, trigger *Trigger, errmsg strin
 	log.Trigger = trigger.Self
 	log.Error = &errmsg
 	log.Tags = []string{"error"}
-	return log.Create(context)
+	return log, log.Create(context)
 }
 
 ////////////////////////////////////////////////////////////////////////////
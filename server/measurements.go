@@ -15,20 +15,40 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"github.com/cloudsecurityalliance/ctpd/server/ctp"
 	"github.com/cloudsecurityalliance/ctpd/server/jsmm"
-	"gopkg.in/mgo.v2/bson"
 	"net/http"
 	"reflect"
+	"sort"
+	"strings"
 )
 
 type ResultRow map[string]interface{}
 
+// Values of Result.SignatureStatus, set by the server when a result is received.
+const (
+	signatureNone             = "none"             // result is not signed
+	signatureVerified         = "verified"         // signature verified with a registered authority key
+	signatureUnknownAuthority = "unknownAuthority" // signed by an authority that is not registered
+)
+
 type Result struct {
-	Value       []ResultRow   `json:"value" bson:"value"`
-	UpdateTime  ctp.Timestamp `json:"updateTime" bson:"updateTime"`
-	AuthorityId *string       `json:"authorityId" bson:"authorityId"`
-	Signature   *string       `json:"signature" bson:"signature"`
+	Value           []ResultRow   `json:"value" bson:"value"`
+	UpdateTime      ctp.Timestamp `json:"updateTime" bson:"updateTime"`
+	AuthorityId     *string       `json:"authorityId" bson:"authorityId"`
+	Signature       *string       `json:"signature" bson:"signature"`
+	SignatureStatus string        `json:"signatureStatus,omitempty" bson:"signatureStatus,omitempty"`
+}
+
+// signedResult is the content of a result covered by its signature, that is
+// the result without the signature property.
+type signedResult struct {
+	Value       []ResultRow   `json:"value"`
+	UpdateTime  ctp.Timestamp `json:"updateTime"`
+	AuthorityId *string       `json:"authorityId"`
 }
 
 type Objective struct {
@@ -36,6 +56,14 @@ type Objective struct {
 	Status    ctp.BoolErr `json:"status"    bson:"status"`
 }
 
+// A StateRequest records the last state change requested by a CTP client
+// through PUT /measurements/{id}?x=state.
+type StateRequest struct {
+	State       ctp.MeasurementState `json:"state"       bson:"state"`
+	RequestedBy []string             `json:"requestedBy" bson:"requestedBy"`
+	RequestTime ctp.Timestamp        `json:"requestTime" bson:"requestTime"`
+}
+
 type Measurement struct {
 	ctp.NamedResource `bson:",inline"`
 	Metric            ctp.Link             `json:"metric"          bson:"metric"`
@@ -44,6 +72,12 @@ type Measurement struct {
 	CreateTrigger     *ctp.Link            `json:"createTrigger"   bson:"createTrigger,omitempty"`
 	UserActivated     bool                 `json:"userActivated"   bson:"userActivated"`
 	State             ctp.MeasurementState `json:"state"           bson:"state"`
+	SignatureRequired bool                 `json:"signatureRequired" bson:"signatureRequired"`
+	StateRequest      *StateRequest        `json:"stateRequest,omitempty" bson:"stateRequest,omitempty"`
+	ResultRetention   *ctp.Duration        `json:"resultRetention,omitempty" bson:"resultRetention,omitempty"` // seconds, 0 keeps results forever
+	Parameters        map[string]interface{} `json:"parameters,omitempty" bson:"parameters,omitempty"`
+	ResultId          ctp.Base64Id         `json:"-"               bson:"resultId,omitempty"` // current result in the "results" collection
+	history           []MeasurementResult  // previous results, loaded on demand
 }
 
 func (measurement *Measurement) BuildLinks(context *ctp.ApiContext) {
@@ -71,14 +105,24 @@ func (measurement *Measurement) Create(context *ctp.ApiContext) *ctp.HttpError {
 		return ctp.NewBadRequestError("Invalid or missing state value")
 	}
 
+	if measurement.ResultRetention != nil && *measurement.ResultRetention < 0 {
+		return ctp.NewBadRequestError("resultRetention must be a positive number of seconds")
+	}
+
+	metric, err := measurementLoadMetric(context, measurement)
+	if err != nil {
+		return err
+	}
+
+	if err := measurementCheckParameters(measurement, metric); err != nil {
+		return err
+	}
+
 	if measurement.Result != nil {
 		if err := measurementCheckResult(context, measurement); err != nil {
 			return err
 		}
-	} else {
-		if err := measurementCheckMetric(context, measurement); err != nil {
-			return err
-		}
+		measurement.ResultId = ctp.NewBase64Id()
 	}
 
 	if measurement.Objective != nil {
@@ -90,6 +134,9 @@ func (measurement *Measurement) Create(context *ctp.ApiContext) *ctp.HttpError {
 	if !ctp.CreateResource(context, "measurements", measurement) {
 		return ctp.NewInternalServerError("Could not save measurement object")
 	}
+	if measurement.Result != nil && !measurementStoreResult(context, measurement) {
+		return ctp.NewInternalServerError("Could not save measurement result")
+	}
 	return nil
 }
 
@@ -101,60 +148,66 @@ func (measurement *Measurement) Update(context *ctp.ApiContext, update ctp.Resou
 	}
 
 	switch context.QueryParam {
-	case "userActivated":
+	case "state":
+		if !measurement.UserActivated {
+			return ctp.NewHttpError(http.StatusConflict, "Measurement cannot be user-activated.")
+		}
 		switch up.State {
 		case "activated":
+			// the measurement becomes activated when the first result is received.
 			if measurement.State == "deactivated" {
 				measurement.State = "pending" // FIXME: add backoffice logic for notification of state change?
 			}
 		case "deactivated":
 			measurement.State = "deactivated"
 			measurement.Result = nil
+			measurement.ResultId = ""
 		default:
 			return ctp.NewBadRequestError("state can only be 'activated' or 'deactivated'")
 		}
+		measurement.StateRequest = &StateRequest{
+			State:       up.State,
+			RequestedBy: context.AccountTags.WithPrefix("account:"),
+			RequestTime: ctp.Now(),
+		}
+		ctp.Log(context, ctp.INFO, "Measurement %s state set to '%s' at the request of %v", measurement.Id, measurement.State, measurement.StateRequest.RequestedBy)
 	case "objective":
 		measurement.Objective = up.Objective
 		if err := measurementObjectiveEvaluate(context, measurement); err != nil {
 			return err
 		}
-	case "result":
-		if measurement.State == "deactivated" {
-			return ctp.NewHttpError(http.StatusConflict, "Measurement is not in activated state.")
+	case "retention":
+		if up.ResultRetention != nil && *up.ResultRetention < 0 {
+			return ctp.NewBadRequestError("resultRetention must be a positive number of seconds")
 		}
-		if measurement.State == "pending" {
-			measurement.State = "activated"
+		measurement.ResultRetention = up.ResultRetention
+		if !measurementPruneResults(context, measurement) {
+			return ctp.NewInternalServerError("Could not remove expired measurement results")
 		}
-
-		if up.Result == nil {
-			return ctp.NewBadRequestError("No result provided in request")
-		}
-
-		measurement.Result = up.Result
-
-		if measurement.Result.UpdateTime.IsZero() {
-			measurement.Result.UpdateTime = ctp.Now()
-		}
-
-		if err := measurementCheckMetric(context, measurement); err != nil {
+	case "result":
+		if err := measurementAcceptResult(context, measurement, up.Result); err != nil {
 			return err
 		}
 
-		if measurement.Objective != nil {
-			if err := measurementObjectiveEvaluate(context, measurement); err != nil {
-				return err
-			}
+		if !measurementStoreResult(context, measurement) {
+			return ctp.NewInternalServerError("Could not save measurement result")
 		}
 
-		measurementTriggersEvaluate(context, measurement)
-
 	default:
 		return ctp.NewBadRequestError("invalid query string") // should never happen, because already filtered in serve.go
 	}
 
 	if !ctp.UpdateResource(context, "measurements", measurement.Id, measurement) {
+		if context.QueryParam == "result" && !resultDelete(context, measurement.ResultId) {
+			ctp.Log(context, ctp.ERROR, "Could not remove result %s of measurement %s", measurement.ResultId, measurement.Id)
+		}
 		return ctp.NewInternalServerError("Could not update measurement object")
 	}
+
+	// triggers only see a result once it is persisted, as in a batch.
+	if context.QueryParam == "result" {
+		measurementTriggersEvaluate(context, measurement)
+	}
 	return nil
 }
 
@@ -167,27 +220,121 @@ func (measurement *Measurement) Delete(context *ctp.ApiContext) *ctp.HttpError {
 
 ////////////////////////////////////////////////////////////////////////////
 
-func measurementCheckMetric(context *ctp.ApiContext, item *Measurement) *ctp.HttpError {
-	var metric Metric
+// measurementAcceptResult checks a new result of a measurement and makes it
+// the current result, evaluating the objective. The caller stores the
+// result, then evaluates triggers.
+func measurementAcceptResult(context *ctp.ApiContext, measurement *Measurement, result *Result) *ctp.HttpError {
+	if measurement.State == "deactivated" {
+		return ctp.NewHttpError(http.StatusConflict, "Measurement is not in activated state.")
+	}
+	if measurement.State == "pending" {
+		measurement.State = "activated"
+	}
+
+	if result == nil {
+		return ctp.NewBadRequestError("No result provided in request")
+	}
+
+	measurement.Result = result
+	measurement.ResultId = ctp.NewBase64Id()
+
+	// the signature covers updateTime as sent by the agent, so check before setting a default.
+	if err := measurementCheckResult(context, measurement); err != nil {
+		return err
+	}
+
+	if measurement.Result.UpdateTime.IsZero() {
+		measurement.Result.UpdateTime = ctp.Now()
+	}
+
+	if measurement.Objective != nil {
+		if err := measurementObjectiveEvaluate(context, measurement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func measurementLoadMetric(context *ctp.ApiContext, item *Measurement) (*Metric, *ctp.HttpError) {
+	metric := new(Metric)
 
 	if item.Metric == "" {
-		return ctp.NewBadRequestError("Missing metric attribute in measurement.")
+		return nil, ctp.NewBadRequestError("Missing metric attribute in measurement.")
 	}
 
 	metricParams, ok := ctp.ParseLink(context.CtpBase, "@/metrics/$", item.Metric)
 	if !ok {
-		return ctp.NewBadRequestError("Metric URL is incorrect in measurement")
+		return nil, ctp.NewBadRequestError("Metric URL is incorrect in measurement")
+	}
+
+	if !ctp.LoadResource(context, "metrics", ctp.Base64Id(metricParams[0]), metric) {
+		return nil, ctp.NewBadRequestErrorf("Metric %s does not exist", ctp.ExpandLink(context.CtpBase, item.Metric))
+	}
+	metricUpgrade(metric)
+	return metric, nil
+}
+
+// measurementCheckParameters verifies the parameter values of a measurement
+// against the declarations of its metric, reporting every incorrect value.
+// Parameters that the measurement does not set take the value declared in
+// the metric, and are left out if the metric declares none but the
+// parameter is optional.
+func measurementCheckParameters(item *Measurement, metric *Metric) *ctp.HttpError {
+	var problems []string
+	var unknown []string
+
+	values := make(map[string]interface{}, len(metric.MeasurementParameters))
+	for _, parameter := range metric.MeasurementParameters {
+		value := item.Parameters[parameter.Name]
+		if value == nil {
+			value = parameter.Value
+		}
+		if value == nil && parameter.optional {
+			continue
+		}
+		if value == nil {
+			problems = append(problems, fmt.Sprintf("parameter '%s': missing value", parameter.Name))
+			continue
+		}
+		if err := parameter.column().checkValue(value); err != nil {
+			problems = append(problems, fmt.Sprintf("parameter '%s': %s", parameter.Name, err.Error()))
+			continue
+		}
+		values[parameter.Name] = value
 	}
 
-	if !ctp.LoadResource(context, "metrics", ctp.Base64Id(metricParams[0]), &metric) {
-		return ctp.NewBadRequestErrorf("Metric %s does not exist", ctp.ExpandLink(context.CtpBase, item.Metric))
+	for name := range item.Parameters {
+		if metricParameter(metric, name) == nil {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		problems = append(problems, fmt.Sprintf("parameter '%s': metric does not declare this parameter", name))
+	}
+
+	if len(problems) > 0 {
+		return ctp.NewBadRequestErrorf("Invalid measurement parameters - %s", strings.Join(problems, "; ")).WithDetail("problems", problems)
+	}
+	item.Parameters = values
+	if len(values) == 0 {
+		item.Parameters = nil
 	}
 	return nil
 }
 
-func measurementCheckResult(context *ctp.ApiContext, item *Measurement) *ctp.HttpError {
-	var metric Metric
+// metricParameter returns the declaration of a parameter of metric, or nil
+// if there is none.
+func metricParameter(metric *Metric, name string) *MeasurementParameter {
+	for i := range metric.MeasurementParameters {
+		if metric.MeasurementParameters[i].Name == name {
+			return &metric.MeasurementParameters[i]
+		}
+	}
+	return nil
+}
 
+func measurementCheckResult(context *ctp.ApiContext, item *Measurement) *ctp.HttpError {
 	if item.Metric == "" {
 		return ctp.NewBadRequestError("Missing metric attribute in measurement.")
 	}
@@ -196,53 +343,155 @@ func measurementCheckResult(context *ctp.ApiContext, item *Measurement) *ctp.Htt
 		return ctp.NewBadRequestError("Missing result attribute in measurement.")
 	}
 
-	metricParams, ok := ctp.ParseLink(context.CtpBase, "@/metrics/$", item.Metric)
-	if !ok {
-		return ctp.NewBadRequestError("Metric URL is incorrect in measurement")
+	metric, err := measurementLoadMetric(context, item)
+	if err != nil {
+		return err
+	}
+
+	if err := resultCheckFormat(item.Result, metric); err != nil {
+		return err
 	}
+	return measurementCheckSignature(context, item, metric)
+}
 
-	if !ctp.LoadResource(context, "metrics", ctp.Base64Id(metricParams[0]), &metric) {
-		return ctp.NewBadRequestErrorf("Metric %s does not exist", ctp.ExpandLink(context.CtpBase, item.Metric))
+// A ResultProblem locates a cell of a result value that does not match the
+// result format of the metric. Column is empty if the whole row is at fault.
+type ResultProblem struct {
+	Row    int    `json:"row"`
+	Column string `json:"column,omitempty"`
+	Error  string `json:"error"`
+}
+
+func (problem ResultProblem) String() string {
+	if problem.Column == "" {
+		return fmt.Sprintf("row %d: %s", problem.Row, problem.Error)
 	}
+	return fmt.Sprintf("row %d, column '%s': %s", problem.Row, problem.Column, problem.Error)
+}
 
-	for _, row := range item.Result.Value {
-		if len(row) != len(metric.ResultFormat) {
-			return ctp.NewBadRequestErrorf("Metric expects %d columns, but result value provides %d", len(metric.ResultFormat), len(row))
+// resultCheckFormat verifies that the columns of each row of a result are
+// those described by the result format of metric, reporting every cell that
+// does not match.
+func resultCheckFormat(result *Result, metric *Metric) *ctp.HttpError {
+	var problems []ResultProblem
+
+	for i, row := range result.Value {
+		if row == nil {
+			problems = append(problems, ResultProblem{Row: i, Error: "expected an object"})
+			continue
 		}
-		for name, cell := range row {
-			metricDetailFound := false
-			for _, metricDetail := range metric.ResultFormat {
-				if metricDetail.Name == name {
-					metricDetailFound = true
-					kind := reflect.ValueOf(cell).Kind()
-					switch metricDetail.Type {
-					case "number":
-						if kind != reflect.Float64 {
-							return ctp.NewBadRequestError("Metric expects a number, but result is of different type")
-						}
-					case "boolean":
-						if kind != reflect.Bool {
-							return ctp.NewBadRequestError("Metric expects a boolean, but result is of different type")
-						}
-					case "string":
-						if kind != reflect.String {
-							return ctp.NewBadRequestError("Metric expects a string, but result is of different type")
-						}
-					default:
-						return ctp.NewBadRequestError("Metric type information is incorrect")
-					}
-					break // from for
-				}
+		for _, column := range metric.ResultFormat {
+			cell, found := row[column.Name]
+			if !found && !column.Nullable {
+				problems = append(problems, ResultProblem{i, column.Name, "missing column"})
+				continue
 			}
-			if !metricDetailFound {
-				return ctp.NewBadRequestErrorf("Metric does not describe '%s', which appears in result", name)
+			if err := column.checkValue(cell); err != nil {
+				problems = append(problems, ResultProblem{i, column.Name, err.Error()})
+			}
+		}
+		var unknown []string
+		for name := range row {
+			if metricColumn(metric, name) == nil {
+				unknown = append(unknown, name)
 			}
 		}
+		sort.Strings(unknown)
+		for _, name := range unknown {
+			problems = append(problems, ResultProblem{i, name, "metric does not describe this column"})
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	messages := make([]string, len(problems))
+	for i, problem := range problems {
+		messages[i] = problem.String()
+	}
+	return ctp.NewBadRequestErrorf("Result does not match the result format of the metric - %s", strings.Join(messages, "; ")).WithDetail("problems", problems)
+}
+
+// metricColumn returns the description of a column of the result of metric,
+// or nil if there is none.
+func metricColumn(metric *Metric, name string) *ResultColumnFormat {
+	for i := range metric.ResultFormat {
+		if metric.ResultFormat[i].Name == name {
+			return &metric.ResultFormat[i]
+		}
 	}
 	return nil
 }
 
-func importMeasurementResultInJSMM(machine *jsmm.Machine, result *Result) error {
+// measurementCheckSignature verifies the JWS signature of a result with the
+// public key of its authority and sets the result signature status.
+// Results with an invalid signature are always rejected, while unsigned
+// results or results from unregistered authorities are only rejected if the
+// metric or the measurement require a signature.
+func measurementCheckSignature(context *ctp.ApiContext, item *Measurement, metric *Metric) *ctp.HttpError {
+	var signed signedResult
+
+	result := item.Result
+	required := item.SignatureRequired || metric.SignatureRequired
+
+	if result.Signature == nil || *result.Signature == "" {
+		if required {
+			return ctp.NewBadRequestError("Measurement requires a signed result")
+		}
+		result.SignatureStatus = signatureNone
+		return nil
+	}
+
+	if result.AuthorityId == nil || *result.AuthorityId == "" {
+		return ctp.NewBadRequestError("Signed result must have an authorityId")
+	}
+
+	authority, ok := loadAuthority(context, *result.AuthorityId)
+	if !ok {
+		if required {
+			return ctp.NewBadRequestErrorf("Result signed by unknown authority '%s'", *result.AuthorityId)
+		}
+		ctp.Log(context, ctp.WARNING, "Result of measurement %s is signed by unknown authority '%s'", item.Id, *result.AuthorityId)
+		result.SignatureStatus = signatureUnknownAuthority
+		return nil
+	}
+
+	key, err := ctp.ParseRSAPublicKey(authority.PublicKey)
+	if err != nil {
+		return ctp.NewInternalServerErrorf("Public key of authority '%s' is invalid - %s", authority.AuthorityId, err.Error())
+	}
+
+	// a detached payload is rebuilt from the received result.
+	detached, err := json.Marshal(signedResult{result.Value, result.UpdateTime, result.AuthorityId})
+	if err != nil {
+		return ctp.NewBadRequestErrorf("Could not encode result for signature verification - %s", err.Error())
+	}
+
+	payload, err := ctp.VerifyJWS(*result.Signature, key, detached)
+	if err != nil {
+		return ctp.NewBadRequestErrorf("Invalid result signature - %s", err.Error())
+	}
+
+	payload = bytes.TrimSpace(payload)
+	if len(payload) < 2 || payload[0] != '{' || payload[len(payload)-1] != '}' {
+		return ctp.NewBadRequestError("Invalid result signature - payload is not a JSON object")
+	}
+	if err := json.Unmarshal(payload, &signed); err != nil {
+		return ctp.NewBadRequestErrorf("Invalid result signature - %s", err.Error())
+	}
+	if signed.UpdateTime != result.UpdateTime ||
+		signed.AuthorityId == nil || *signed.AuthorityId != *result.AuthorityId ||
+		!reflect.DeepEqual(signed.Value, result.Value) {
+		return ctp.NewBadRequestError("Invalid result signature - signed content does not match result")
+	}
+
+	result.SignatureStatus = signatureVerified
+	return nil
+}
+
+// ImportMeasurementResultInJSMM sets the global variables that objectives
+// and trigger conditions use to access a result.
+func ImportMeasurementResultInJSMM(machine *jsmm.Machine, result *Result) error {
 	if result == nil {
 		return nil
 	}
@@ -261,32 +510,47 @@ func importMeasurementResultInJSMM(machine *jsmm.Machine, result *Result) error
 	return nil
 }
 
+// ImportMeasurementParametersInJSMM sets the 'parameters' global variable to
+// the parameter values of a measurement.
+func ImportMeasurementParametersInJSMM(machine *jsmm.Machine, parameters map[string]interface{}) error {
+	if parameters == nil {
+		parameters = map[string]interface{}{}
+	}
+	return jsmm.ImportGlobal(machine, "parameters", parameters)
+}
+
 func measurementObjectiveEvaluate(context *ctp.ApiContext, item *Measurement) *ctp.HttpError {
 	item.Objective.Status = ctp.Terror
 
 	ctp.Log(context, ctp.DEBUG, "Evaluating objective: %s\n", item.Objective.Condition)
 
-	machine, err := jsmm.Compile(item.Objective.Condition)
+	machine, err := newMachine(context, item.Objective.Condition, jsmm.ObjectiveFunctions)
 	if err != nil {
-		return ctp.NewBadRequestErrorf("Error in objective compilation - %s", err.Error())
+		return scriptErrorf(err, "Error in objective compilation - %s", err.Error())
 	}
+	machine.SetHostData(item)
 
 	if item.Result == nil {
 		item.Objective.Status = ctp.Ttrue
 		return nil
 	}
 
-	if context.DebugVM {
-		machine.DebugMode(true)
+	if err := ImportMeasurementResultInJSMM(machine, item.Result); err != nil {
+		return ctp.NewBadRequestErrorf("Error in objective evaluation while importing result - %s", err.Error())
 	}
-
-	if err := importMeasurementResultInJSMM(machine, item.Result); err != nil {
-		return ctp.NewBadRequestErrorf("Error in objective evaluation while importing result - %s", err.Error)
+	if err := ImportMeasurementParametersInJSMM(machine, item.Parameters); err != nil {
+		return ctp.NewBadRequestErrorf("Error in objective evaluation while importing parameters - %s", err.Error())
+	}
+	if err := importMeasurementHistoryInJSMM(context, machine, item); err != nil {
+		return ctp.NewInternalServerErrorf("Error in objective evaluation while importing history - %s", err.Error())
 	}
 
 	v, exception := machine.Execute()
 	if exception != nil {
-		return ctp.NewBadRequestErrorf("Error in objective evaluation - %s", exception.Error())
+		if exception.Kind() == jsmm.ExceptionLimit {
+			ctp.Log(context, ctp.WARNING, "Objective evaluation of measurement %s interrupted: %s", item.Id, exception.Error())
+		}
+		return scriptErrorf(exception, "Error in objective evaluation - %s", exception.Error())
 	}
 	if v != nil {
 		item.Objective.Status = ctp.ToBoolErr(v.ToBoolean())
@@ -295,65 +559,93 @@ func measurementObjectiveEvaluate(context *ctp.ApiContext, item *Measurement) *c
 }
 
 func measurementTriggersEvaluate(context *ctp.ApiContext, measurement *Measurement) {
-	var trigger Trigger
-	now := ctp.Now()
-
 	mlink := ctp.ShortenLink(context.CtpBase, measurement.Self)
-	query := context.Session.DB("ctp").C("triggers").Find(bson.M{"measurement": mlink})
 
-	n, err := query.Count()
+	triggers, ok := measurementsTriggersLoad(context, []ctp.Link{mlink})
+	if !ok {
+		return
+	}
+	for _, trigger := range triggers[mlink] {
+		triggerEvaluate(context, trigger, measurement)
+	}
+}
+
+// measurementsTriggersLoad reads the triggers of several measurements with a
+// single query, grouped by the short link of their measurement.
+func measurementsTriggersLoad(context *ctp.ApiContext, mlinks []ctp.Link) (map[ctp.Link][]*Trigger, bool) {
+	links := make(ctp.AnyOf, len(mlinks))
+	for i, mlink := range mlinks {
+		links[i] = mlink
+	}
+	selector := ctp.Selector{"measurement": links}
+
+	n, err := context.Storage.Count("triggers", selector)
 	if err == nil {
-		ctp.Log(context, ctp.DEBUG, "Evaluating %d triggers related to measurement %s", n, measurement.Id)
+		ctp.Log(context, ctp.DEBUG, "Evaluating %d triggers related to %d measurement(s)", n, len(mlinks))
 	} else {
-		ctp.Log(context, ctp.ERROR, "Failed to evaludate triggers related to measurement %s, %s", measurement.Id, err.Error())
-		return
+		ctp.Log(context, ctp.ERROR, "Failed to evaludate triggers related to %d measurement(s), %s", len(mlinks), err.Error())
+		return nil, false
 	}
 
-	iter := query.Iter()
-	for iter.Next(&trigger) {
-		var err error
-		var err_upd error
-		var ok bool
+	triggers := make(map[ctp.Link][]*Trigger)
+	iter := context.Storage.Find("triggers", selector, "", 0, 0)
+	for {
+		trigger := new(Trigger)
 
+		if !iter.Next(trigger) {
+			break
+		}
 		trigger.BuildLinks(context)
+		triggers[trigger.Measurement] = append(triggers[trigger.Measurement], trigger)
+	}
+	if err := iter.Close(); err != nil {
+		ctp.Log(context, ctp.ERROR, "Failed to evaludate triggers related to %d measurement(s), %s", len(mlinks), err.Error())
+		return nil, false
+	}
+	return triggers, true
+}
 
-		ctp.Log(context, ctp.DEBUG, "Evaludating trigger %s, currently with status '%s'", trigger.Id, trigger.Status.String())
+// triggerEvaluate evaluates a trigger against the current result of its
+// measurement. The new status is saved and also set in trigger, so that the
+// trigger can be evaluated again against a later result.
+func triggerEvaluate(context *ctp.ApiContext, trigger *Trigger, measurement *Measurement) {
+	var err error
+	var err_upd error
+	var ok bool
+	now := ctp.Now()
 
-		switch trigger.Status {
-		case ctp.Tfalse:
-			ok, err = triggerCheckCondition(context, &trigger, measurement)
-		case ctp.Ttrue:
-			if uint(ctp.SecondsSince(trigger.StatusUpdateTime)) <= trigger.GuardTime {
-				continue
-			}
-			ok, err = triggerCheckCondition(context, &trigger, measurement)
-		case ctp.Terror:
-			continue
-		}
+	ctp.Log(context, ctp.DEBUG, "Evaludating trigger %s, currently with status '%s'", trigger.Id, trigger.Status.String())
 
-		switch {
-		case err != nil:
-			ctp.Log(context, ctp.ERROR, "Error in trigger %s for measurement %s", trigger.Id, measurement.Id)
-			err_log := CreateErrorLogEntry(context, &trigger, err.Error())
-			if err_log != nil {
-				ctp.Log(context, ctp.ERROR, "Failed to create error log: %s", err_log.Error())
-			}
-			err_upd = context.Session.DB("ctp").C("triggers").Update(bson.M{"_id": trigger.Id}, bson.M{"$set": bson.M{"status": ctp.Terror, "statusUpdateTime": now.String()}})
-		case ok:
-			ctp.Log(context, ctp.DEBUG, "trigger %s is TRUE", trigger.Id)
-			err_log := CreateNormalLogEntry(context, &trigger, measurement.Result, trigger.Tags)
-			if err_log != nil {
-				ctp.Log(context, ctp.ERROR, "Failed to create normal log: %s", err_log.Error())
-			}
-			err_upd = context.Session.DB("ctp").C("triggers").Update(bson.M{"_id": trigger.Id}, bson.M{"$set": bson.M{"status": ctp.Ttrue, "statusUpdateTime": now.String()}})
-		default:
-			ctp.Log(context, ctp.DEBUG, "Trigger %s is FALSE", trigger.Id)
-			err_upd = context.Session.DB("ctp").C("triggers").Update(bson.M{"_id": trigger.Id}, bson.M{"$set": bson.M{"status": ctp.Tfalse, "statusUpdateTime": now.String()}})
+	switch trigger.Status {
+	case ctp.Tfalse:
+		ok, err = triggerCheckCondition(context, trigger, measurement)
+	case ctp.Ttrue:
+		if uint(ctp.SecondsSince(trigger.StatusUpdateTime)) <= trigger.GuardTime {
+			return
 		}
+		ok, err = triggerCheckCondition(context, trigger, measurement)
+	case ctp.Terror:
+		return
+	}
 
-		if err_upd != nil {
-			ctp.Log(context, ctp.ERROR, "Failed to update trigger 'status' and 'statusDateTime': %s", err_upd.Error())
-		}
+	switch {
+	case err != nil:
+		ctp.Log(context, ctp.ERROR, "Error in trigger %s for measurement %s", trigger.Id, measurement.Id)
+		triggerLogAndNotify(context, trigger, measurement.Result, err)
+		trigger.Status = ctp.Terror
+	case ok:
+		ctp.Log(context, ctp.DEBUG, "trigger %s is TRUE", trigger.Id)
+		triggerLogAndNotify(context, trigger, measurement.Result, nil)
+		trigger.Status = ctp.Ttrue
+	default:
+		ctp.Log(context, ctp.DEBUG, "Trigger %s is FALSE", trigger.Id)
+		trigger.Status = ctp.Tfalse
+	}
+	trigger.StatusUpdateTime = now
+
+	err_upd = context.Storage.UpdateParts("triggers", trigger.Id, map[string]interface{}{"status": trigger.Status, "statusUpdateTime": now.String()})
+	if err_upd != nil {
+		ctp.Log(context, ctp.ERROR, "Failed to update trigger 'status' and 'statusDateTime': %s", err_upd.Error())
 	}
 }
 
@@ -381,11 +673,11 @@ func HandlePUTMeasurement(w http.ResponseWriter, r *http.Request, context *ctp.A
 	var access ctp.Tags
 
 	switch context.QueryParam {
-	case "userActivated":
+	case "state":
 		access = ctp.UserRoleTag
 	case "result":
 		access = ctp.AgentRoleTag
-	case "objective":
+	case "objective", "retention":
 		access = ctp.AdminRoleTag
 	}
 	handler := ctp.NewPUTHandler(access)
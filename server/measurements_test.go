@@ -0,0 +1,123 @@
+package server
+
+import (
+	"github.com/cloudsecurityalliance/ctpd/server/ctp"
+	"reflect"
+	"testing"
+)
+
+func TestMeasurementCheckParameters(t *testing.T) {
+	metric := &Metric{
+		MeasurementParameters: []MeasurementParameter{
+			{Name: "window", Type: columnDuration, Value: "PT5M"},
+			{Name: "threshold", Type: columnNumber},
+			{Name: "strict", Type: columnBoolean, Value: false},
+			{Name: "region", Type: columnString, optional: true},
+		},
+	}
+
+	tests := []struct {
+		parameters map[string]interface{}
+		values     map[string]interface{}
+		problems   int
+	}{
+		{map[string]interface{}{"threshold": 10.0}, map[string]interface{}{"window": "PT5M", "threshold": 10.0, "strict": false}, 0},
+		{map[string]interface{}{"threshold": 10.0, "window": "PT1H", "region": "eu"}, map[string]interface{}{"window": "PT1H", "threshold": 10.0, "strict": false, "region": "eu"}, 0},
+		{map[string]interface{}{"threshold": 10.0, "strict": nil}, map[string]interface{}{"window": "PT5M", "threshold": 10.0, "strict": false}, 0},
+		{nil, nil, 1},
+		{map[string]interface{}{"threshold": "10"}, nil, 1},
+		{map[string]interface{}{"threshold": 10.0, "window": "5 minutes", "strict": 1.0}, nil, 2},
+		{map[string]interface{}{"threshold": 10.0, "size": 1.0, "color": "red"}, nil, 2},
+	}
+	for _, test := range tests {
+		item := &Measurement{Parameters: test.parameters}
+
+		err := measurementCheckParameters(item, metric)
+		problems := 0
+		if err != nil {
+			problems = len(err.Details()["problems"].([]string))
+		}
+		if problems != test.problems {
+			t.Errorf("measurementCheckParameters(%v) reported %d problems (%v), expected %d", test.parameters, problems, err, test.problems)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(item.Parameters, test.values) {
+			t.Errorf("measurementCheckParameters(%v) set parameters to %v, expected %v", test.parameters, item.Parameters, test.values)
+		}
+	}
+
+	item := &Measurement{}
+	if err := measurementCheckParameters(item, &Metric{}); err != nil || item.Parameters != nil {
+		t.Error("Measurement of a metric without parameters has parameters", item.Parameters, err)
+	}
+}
+
+func TestMeasurementLegacyParameters(t *testing.T) {
+	context, _ := testMetricContext(t)
+
+	legacy := &Metric{
+		NamedResource: ctp.NamedResource{Resource: ctp.Resource{Id: "legacy"}, Name: "legacy"},
+		MeasurementParameters: []MeasurementParameter{
+			{Name: "window", Type: columnNumber, Value: ""},
+			{Name: "samples", Type: columnInteger, Value: "10"},
+		},
+		ResultFormat: []ResultColumnFormat{{Name: "v", Type: columnNumber}},
+	}
+	if !ctp.CreateResource(context, "metrics", legacy) {
+		t.Fatal("Could not create metric")
+	}
+
+	item := &Measurement{Metric: "@/metrics/legacy"}
+	metric, err := measurementLoadMetric(context, item)
+	if err != nil {
+		t.Fatal("Could not load metric", err)
+	}
+	if err := measurementCheckParameters(item, metric); err != nil {
+		t.Fatal("Measurement of a legacy metric was rejected:", err)
+	}
+	if !reflect.DeepEqual(item.Parameters, map[string]interface{}{"samples": 10.0}) {
+		t.Error("Measurement of a legacy metric has parameters", item.Parameters)
+	}
+}
+
+func TestParametersGlobal(t *testing.T) {
+	context, _ := testMetricContext(t)
+
+	item := &Measurement{
+		Result:     &Result{Value: []ResultRow{{"v": 12.0}}},
+		Parameters: map[string]interface{}{"threshold": 10.0, "window": "PT5M"},
+		Objective:  &Objective{Condition: `value[0].v > parameters.threshold && parameters.window == "PT5M"`},
+	}
+	if err := measurementObjectiveEvaluate(context, item); err != nil || item.Objective.Status != ctp.Ttrue {
+		t.Error("Objective using parameters evaluated to", item.Objective.Status, err)
+	}
+
+	item.Parameters = nil
+	item.Objective.Condition = `value[0].v > 0 && toJSON(parameters) == "{}"`
+	if err := measurementObjectiveEvaluate(context, item); err != nil || item.Objective.Status != ctp.Ttrue {
+		t.Error("Objective without parameters evaluated to", item.Objective.Status, err)
+	}
+}
+
+func TestMeasurementUpdateResult(t *testing.T) {
+	context := testBatchContext(t)
+	context.AccountTags = ctp.NewTags("role:agent", "tag:a")
+	context.QueryParam = "result"
+
+	measurement := testEvaluationMeasurement(t, context, "m1")
+	if err := measurement.Update(context, &Measurement{Result: &Result{Value: []ResultRow{{"v": 7.0}}}}); err != nil {
+		t.Fatal("Update failed:", err)
+	}
+
+	var stored Measurement
+	if !ctp.LoadResource(context, "measurements", "m1", &stored) || stored.Result == nil || stored.ResultId != measurement.ResultId {
+		t.Error("Result was not saved in the measurement")
+	}
+	if n, _ := context.Storage.Count("results", ctp.Selector{"_id": string(measurement.ResultId)}); n != 1 {
+		t.Error("Result was not stored")
+	}
+	var trigger Trigger
+	if n, _ := context.Storage.Count("logs", ctp.Selector{}); n != 1 || !ctp.LoadResource(context, "triggers", "trigger1", &trigger) || trigger.Status != ctp.Ttrue {
+		t.Error("Trigger was not fired, status", trigger.Status)
+	}
+}
@@ -15,21 +15,431 @@
 package server
 
 import (
+	"fmt"
 	"github.com/cloudsecurityalliance/ctpd/server/ctp"
-	//"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"math"
 	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// A MeasurementParameter declares a parameter of the measurements of a
+// metric. Its type is one of the column types of a result format, except
+// enum, and Value, if not null, is the value of the parameter in the
+// measurements that do not set it.
 type MeasurementParameter struct {
-	Name  string `json:"name"  bson:"name"`
-	Type  string `json:"type"  bson:"type"`
-	Value string `json:"value" bson:"value"`
+	Name     string      `json:"name"  bson:"name"`
+	Type     string      `json:"type"  bson:"type"`
+	Value    interface{} `json:"value" bson:"value"`
+	optional bool        // legacy parameter without a default, which measurements may omit
 }
 
+// column returns the description of a result column that parameter values
+// must match.
+func (parameter *MeasurementParameter) column() *ResultColumnFormat {
+	return &ResultColumnFormat{Name: parameter.Name, Type: parameter.Type}
+}
+
+// upgradeValue converts the default value of a parameter stored by earlier
+// versions of ctpd, where values were always strings, to the declared type
+// of the parameter. Values that do not convert are left as they are.
+//
+// An empty string was the absence of a default value, at a time when
+// measurements had no parameter values. Such a parameter becomes optional,
+// so that measurements can still be created under the metric without
+// setting it. The metric is not rewritten: once it is updated, its
+// parameters without a default become required.
+func (parameter *MeasurementParameter) upgradeValue() {
+	value, ok := parameter.Value.(string)
+	if !ok {
+		return
+	}
+	if value == "" && parameter.Type != columnString {
+		parameter.Value = nil
+		parameter.optional = true
+		return
+	}
+	switch parameter.Type {
+	case columnNumber, columnInteger:
+		if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+			parameter.Value = f
+		}
+	case columnBoolean:
+		if b, err := strconv.ParseBool(strings.TrimSpace(value)); err == nil {
+			parameter.Value = b
+		}
+	}
+}
+
+// metricUpgrade converts a metric stored by earlier versions of ctpd to the
+// current form.
+func metricUpgrade(metric *Metric) {
+	for i := range metric.MeasurementParameters {
+		metric.MeasurementParameters[i].upgradeValue()
+	}
+}
+
+// Types of the columns of a result format. A timestamp is a string in RFC
+// 3339 format, a duration is a string in ISO 8601 format such as "PT1M30S",
+// and an enum is one of the strings listed in the values of the column.
+const (
+	columnNumber    = "number"
+	columnInteger   = "integer"
+	columnBoolean   = "boolean"
+	columnString    = "string"
+	columnTimestamp = "timestamp"
+	columnDuration  = "duration"
+	columnEnum      = "enum"
+)
+
+// A ResultColumnFormat describes a column of the result of a metric. Min and
+// Max bound numbers, integers and durations, in seconds. A nullable column
+// may be null or missing in a row.
 type ResultColumnFormat struct {
-	Name string `json:"name" bson:"name"`
-	Type string `json:"type" bson:"type"`
+	Name     string   `json:"name"               bson:"name"`
+	Type     string   `json:"type"               bson:"type"`
+	Nullable bool     `json:"nullable,omitempty" bson:"nullable,omitempty"`
+	Values   []string `json:"values,omitempty"   bson:"values,omitempty"`
+	Min      *float64 `json:"min,omitempty"      bson:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"      bson:"max,omitempty"`
+}
+
+// check verifies that a column is correctly described.
+func (column *ResultColumnFormat) check() error {
+	switch column.Type {
+	case columnNumber, columnInteger, columnDuration:
+		if column.Min != nil && column.Max != nil && *column.Min > *column.Max {
+			return fmt.Errorf("min is greater than max")
+		}
+	case columnBoolean, columnString, columnTimestamp, columnEnum:
+		if column.Min != nil || column.Max != nil {
+			return fmt.Errorf("min and max do not apply to type '%s'", column.Type)
+		}
+	default:
+		return fmt.Errorf("unknown type '%s'", column.Type)
+	}
+
+	if column.Type != columnEnum {
+		if column.Values != nil {
+			return fmt.Errorf("values only apply to type 'enum'")
+		}
+		return nil
+	}
+	if len(column.Values) == 0 {
+		return fmt.Errorf("an enum must list its values")
+	}
+	for i, value := range column.Values {
+		for _, other := range column.Values[:i] {
+			if value == other {
+				return fmt.Errorf("value '%s' is listed twice", value)
+			}
+		}
+	}
+	return nil
+}
+
+// checkValue verifies that a cell of a result matches the column.
+func (column *ResultColumnFormat) checkValue(cell interface{}) error {
+	var n float64
+
+	if cell == nil {
+		if !column.Nullable {
+			return fmt.Errorf("expected a %s, but got null", column.Type)
+		}
+		return nil
+	}
+
+	switch column.Type {
+	case columnNumber, columnInteger:
+		v, ok := cell.(float64)
+		if !ok {
+			return fmt.Errorf("expected a%s %s, but got %s", article(column.Type), column.Type, jsonType(cell))
+		}
+		if column.Type == columnInteger && v != math.Trunc(v) {
+			return fmt.Errorf("expected an integer, but got %v", v)
+		}
+		n = v
+	case columnBoolean:
+		if _, ok := cell.(bool); !ok {
+			return fmt.Errorf("expected a boolean, but got %s", jsonType(cell))
+		}
+		return nil
+	case columnString, columnTimestamp, columnDuration, columnEnum:
+		s, ok := cell.(string)
+		if !ok {
+			return fmt.Errorf("expected a%s %s, but got %s", article(column.Type), column.Type, jsonType(cell))
+		}
+		switch column.Type {
+		case columnTimestamp:
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				return fmt.Errorf("expected a timestamp in RFC 3339 format, but got '%s'", s)
+			}
+		case columnDuration:
+			d, err := parseDuration(s)
+			if err != nil {
+				return err
+			}
+			n = d
+		case columnEnum:
+			for _, value := range column.Values {
+				if s == value {
+					return nil
+				}
+			}
+			return fmt.Errorf("'%s' is not one of %s", s, strings.Join(column.Values, ", "))
+		}
+		if column.Type != columnDuration {
+			return nil
+		}
+	default:
+		return fmt.Errorf("metric type information is incorrect")
+	}
+
+	if column.Min != nil && n < *column.Min {
+		return fmt.Errorf("%v is less than the minimum %v", n, *column.Min)
+	}
+	if column.Max != nil && n > *column.Max {
+		return fmt.Errorf("%v is greater than the maximum %v", n, *column.Max)
+	}
+	return nil
+}
+
+func article(columnType string) string {
+	if columnType == columnInteger || columnType == columnEnum {
+		return "n"
+	}
+	return ""
+}
+
+// jsonType names the JSON type of a value decoded by encoding/json.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case string:
+		return "a string"
+	case []interface{}:
+		return "an array"
+	}
+	return "an object"
+}
+
+var durationFormat = regexp.MustCompile(`^P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseDuration returns the number of seconds of an ISO 8601 duration made
+// of weeks, days, hours, minutes and seconds, such as "P1DT12H" or "PT0.5S".
+// Years and months are not accepted, since their length varies.
+func parseDuration(s string) (float64, error) {
+	m := durationFormat.FindStringSubmatch(s)
+	if m == nil || s == "P" || strings.HasSuffix(s, "T") {
+		return 0, fmt.Errorf("expected a duration in ISO 8601 format, but got '%s'", s)
+	}
+
+	var seconds float64
+	for i, unit := range []float64{7 * 86400, 86400, 3600, 60, 1} {
+		if m[i+1] != "" {
+			v, _ := strconv.ParseFloat(m[i+1], 64)
+			seconds += v * unit
+		}
+	}
+	return seconds, nil
+}
+
+// metricCheck verifies the parameter declarations and the result format of
+// a metric, reporting every incorrect parameter and column.
+func metricCheck(metric *Metric) *ctp.HttpError {
+	var problems []string
+
+	for i, parameter := range metric.MeasurementParameters {
+		if parameter.Name == "" {
+			problems = append(problems, fmt.Sprintf("parameter %d has no name", i))
+			continue
+		}
+		// parameter names are keys of the parameters of measurements.
+		if strings.Contains(parameter.Name, ".") || strings.HasPrefix(parameter.Name, "$") {
+			problems = append(problems, fmt.Sprintf("parameter '%s': a name cannot contain '.' or start with '$'", parameter.Name))
+			continue
+		}
+		for _, other := range metric.MeasurementParameters[:i] {
+			if other.Name == parameter.Name {
+				problems = append(problems, fmt.Sprintf("parameter '%s' is declared twice", parameter.Name))
+				break
+			}
+		}
+		column := parameter.column()
+		if column.Type == columnEnum {
+			problems = append(problems, fmt.Sprintf("parameter '%s': type 'enum' does not apply to parameters", parameter.Name))
+		} else if err := column.check(); err != nil {
+			problems = append(problems, fmt.Sprintf("parameter '%s': %s", parameter.Name, err.Error()))
+		} else if parameter.Value != nil {
+			if err := column.checkValue(parameter.Value); err != nil {
+				problems = append(problems, fmt.Sprintf("parameter '%s': %s", parameter.Name, err.Error()))
+			}
+		}
+	}
+
+	for i, column := range metric.ResultFormat {
+		if column.Name == "" {
+			problems = append(problems, fmt.Sprintf("column %d has no name", i))
+			continue
+		}
+		for _, other := range metric.ResultFormat[:i] {
+			if other.Name == column.Name {
+				problems = append(problems, fmt.Sprintf("column '%s' is described twice", column.Name))
+				break
+			}
+		}
+		if err := column.check(); err != nil {
+			problems = append(problems, fmt.Sprintf("column '%s': %s", column.Name, err.Error()))
+		}
+	}
+
+	if len(problems) > 0 {
+		return ctp.NewBadRequestErrorf("Invalid metric - %s", strings.Join(problems, "; ")).WithDetail("problems", problems)
+	}
+	return nil
+}
+
+// A MetricChange describes a difference between two descriptions of a
+// metric. A breaking change may make the results or the parameters of
+// existing measurements invalid.
+type MetricChange struct {
+	Property    string `json:"property"`
+	Description string `json:"description"`
+	Breaking    bool   `json:"breaking"`
+}
+
+func (change MetricChange) String() string {
+	return change.Property + ": " + change.Description
+}
+
+// metricChanges lists the differences between the descriptions of a metric
+// before and after an update. A change breaks the metric if a result or the
+// parameter values of a measurement created before could be invalid after.
+// Measurements refer to their metric by id, so renaming it does not break
+// them. They keep the parameter values they were created with, so changing
+// a default value or adding a parameter that has one does not break them
+// either: they simply have no value for the added parameter.
+func metricChanges(before *Metric, after *Metric) []MetricChange {
+	var changes []MetricChange
+
+	add := func(property string, breaking bool, format string, params ...interface{}) {
+		changes = append(changes, MetricChange{property, fmt.Sprintf(format, params...), breaking})
+	}
+
+	if before.Name != after.Name {
+		add("name", false, "renamed from '%s' to '%s'", before.Name, after.Name)
+	}
+	if before.Annotation != after.Annotation {
+		add("annotation", false, "changed")
+	}
+	if before.BaseMetric != after.BaseMetric {
+		add("baseMetric", true, "changed from '%s' to '%s'", before.BaseMetric, after.BaseMetric)
+	}
+	if before.SignatureRequired != after.SignatureRequired {
+		add("signatureRequired", after.SignatureRequired, "changed to %v", after.SignatureRequired)
+	}
+
+	for _, parameter := range before.MeasurementParameters {
+		property := "measurementParameters." + parameter.Name
+		updated := metricParameter(after, parameter.Name)
+		switch {
+		case updated == nil:
+			add(property, true, "removed")
+		case updated.Type != parameter.Type:
+			add(property, true, "type changed from '%s' to '%s'", parameter.Type, updated.Type)
+		case !reflect.DeepEqual(updated.Value, parameter.Value):
+			// measurements keep the values they were created with.
+			add(property, false, "default value changed")
+		}
+	}
+	for _, parameter := range after.MeasurementParameters {
+		if metricParameter(before, parameter.Name) == nil {
+			add("measurementParameters."+parameter.Name, parameter.Value == nil, "added")
+		}
+	}
+
+	for _, column := range before.ResultFormat {
+		property := "resultFormat." + column.Name
+		updated := metricColumn(after, column.Name)
+		if updated == nil {
+			add(property, true, "removed")
+			continue
+		}
+		if updated.Type != column.Type {
+			add(property, true, "type changed from '%s' to '%s'", column.Type, updated.Type)
+			continue
+		}
+		if updated.Nullable != column.Nullable {
+			add(property, column.Nullable, "nullable changed to %v", updated.Nullable)
+		}
+		if narrower, changed := boundChange(column.Min, updated.Min, 1); changed {
+			add(property, narrower, "min changed")
+		}
+		if narrower, changed := boundChange(column.Max, updated.Max, -1); changed {
+			add(property, narrower, "max changed")
+		}
+		for _, value := range column.Values {
+			if !containsString(updated.Values, value) {
+				add(property, true, "value '%s' removed", value)
+			}
+		}
+		for _, value := range updated.Values {
+			if !containsString(column.Values, value) {
+				add(property, false, "value '%s' added", value)
+			}
+		}
+	}
+	for _, column := range after.ResultFormat {
+		if metricColumn(before, column.Name) == nil {
+			add("resultFormat."+column.Name, !column.Nullable, "added")
+		}
+	}
+	return changes
+}
+
+// boundChange reports whether a min (sign 1) or max (sign -1) bound changed,
+// and if so, whether it accepts fewer values than before.
+func boundChange(before *float64, after *float64, sign float64) (bool, bool) {
+	switch {
+	case before == nil && after == nil:
+		return false, false
+	case before == nil:
+		return true, true
+	case after == nil:
+		return false, true
+	case *before == *after:
+		return false, false
+	}
+	return (*after-*before)*sign > 0, true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// metricBreakingChanges describes the breaking changes in changes.
+func metricBreakingChanges(changes []MetricChange) []string {
+	var breaking []string
+
+	for _, change := range changes {
+		if change.Breaking {
+			breaking = append(breaking, change.String())
+		}
+	}
+	return breaking
 }
 
 type Metric struct {
@@ -37,6 +447,9 @@ type Metric struct {
 	BaseMetric            string                 `json:"baseMetric"            bson:"baseMetric"`
 	MeasurementParameters []MeasurementParameter `json:"measurementParameters" bson:"measurementParameters"`
 	ResultFormat          []ResultColumnFormat   `json:"resultFormat"          bson:"resultFormat"`
+	SignatureRequired     bool                   `json:"signatureRequired"     bson:"signatureRequired"`
+	Version               int                    `json:"version,omitempty"         bson:"version,omitempty"`
+	PreviousVersion       *ctp.Link              `json:"previousVersion,omitempty" bson:"previousVersion,omitempty"`
 }
 
 func (metric *Metric) BuildLinks(context *ctp.ApiContext) {
@@ -48,6 +461,7 @@ func (metric *Metric) Load(context *ctp.ApiContext) *ctp.HttpError {
 	if !ctp.LoadResource(context, "metrics", ctp.Base64Id(context.Params[1]), metric) {
 		return ctp.NewHttpError(http.StatusNotFound, "Not Found")
 	}
+	metricUpgrade(metric)
 	metric.BuildLinks(context)
 	return nil
 }
@@ -55,17 +469,110 @@ func (metric *Metric) Load(context *ctp.ApiContext) *ctp.HttpError {
 func (metric *Metric) Create(context *ctp.ApiContext) *ctp.HttpError {
 	metric.BuildLinks(context)
 
+	// versions are only set by PUT /metrics/{id}?x=version
+	metric.Version = 0
+	metric.PreviousVersion = nil
+
+	if err := metricCheck(metric); err != nil {
+		return err
+	}
+
 	if !ctp.CreateResource(context, "metrics", metric) {
 		return ctp.NewHttpError(http.StatusInternalServerError, "Could not save object")
 	}
 	return nil
 }
 
-func (metric *Metric) Delete(context *ctp.ApiContext) *ctp.HttpError {
+// Update replaces the description of a metric. Changes that could make the
+// results or the parameters of existing measurements invalid are rejected
+// while measurements use the metric: a new version of the metric must be
+// created instead with PUT /metrics/{id}?x=version.
+//
+// Measurements are counted before the metric is written, without a lock, so
+// a measurement created in between may end up under a metric that changed in
+// a way that breaks it.
+func (metric *Metric) Update(context *ctp.ApiContext, update ctp.ResourceUpdater) *ctp.HttpError {
+	metric.BuildLinks(context)
+	up, ok := update.(*Metric)
+	if !ok {
+		return ctp.NewInternalServerError("Updated object is not a metric") // should never happen
+	}
+
+	if err := metricCheck(up); err != nil {
+		return err
+	}
+
+	changes := metricChanges(metric, up)
+	if breaking := metricBreakingChanges(changes); len(breaking) > 0 {
+		count, err := metricMeasurementCount(context, metric)
+		if err != nil {
+			return ctp.NewInternalServerError(err)
+		}
+		if count > 0 {
+			return ctp.NewHttpErrorf(http.StatusConflict, "Metric is used by %d measurement(s) and cannot be changed as follows: %s. Create a new version with x=version instead.", count, strings.Join(breaking, "; ")).WithDetail("changes", changes)
+		}
+	}
+
+	metric.Name = up.Name
+	metric.Annotation = up.Annotation
+	metric.BaseMetric = up.BaseMetric
+	metric.MeasurementParameters = up.MeasurementParameters
+	metric.ResultFormat = up.ResultFormat
+	metric.SignatureRequired = up.SignatureRequired
+
+	if !ctp.UpdateResource(context, "metrics", metric.Id, metric) {
+		return ctp.NewInternalServerError("Could not update metric")
+	}
+	ctp.Log(context, ctp.INFO, "Updated metric %s with %d change(s)", metric.Id, len(changes))
+	return nil
+}
+
+// metricNewVersion creates a copy of metric with the description in up,
+// leaving metric and the measurements that use it unchanged. Only the latest
+// version of a metric can be versioned, so that versions form a single line.
+func metricNewVersion(context *ctp.ApiContext, metric *Metric, up *Metric) (*Metric, *ctp.HttpError) {
+	if err := metricCheck(up); err != nil {
+		return nil, err
+	}
+
+	previous := ctp.ShortenLink(context.CtpBase, metric.Self)
+	successors, serr := context.Storage.Count("metrics", ctp.Selector{"previousVersion": previous})
+	if serr != nil {
+		return nil, ctp.NewInternalServerError(serr)
+	}
+	if successors > 0 {
+		return nil, ctp.NewHttpError(http.StatusConflict, "Metric already has a newer version, create a version of the latest one instead.")
+	}
+
+	version := *up
+	version.Id = ctp.NewBase64Id()
+	version.ChangeId = version.Id
+	version.Parent = nil
+	version.AccessTags = metric.AccessTags
+	version.Version = metric.Version + 1
+	if metric.Version == 0 {
+		version.Version = 2 // the original metric is the first version
+	}
+	version.PreviousVersion = &previous
+	version.BuildLinks(context)
+
+	if !ctp.CreateResource(context, "metrics", &version) {
+		return nil, ctp.NewInternalServerError("Could not save new version of metric")
+	}
+	ctp.Log(context, ctp.INFO, "Created metric %s as version %d of metric %s", version.Id, version.Version, metric.Id)
+	return &version, nil
+}
+
+// metricMeasurementCount returns the number of measurements that use metric.
+func metricMeasurementCount(context *ctp.ApiContext, metric *Metric) (int, error) {
 	metricUrl := ctp.NewLink(context.CtpBase, "@/metrics/$", metric.Id) // just to create a clean URL
 
-	query := context.Session.DB("ctp").C("measurements").Find(bson.M{"metric": metricUrl})
-	count, err := query.Count()
+	// measurements store a short link to their metric
+	return context.Storage.Count("measurements", ctp.Selector{"metric": ctp.ShortenLink(context.CtpBase, metricUrl)})
+}
+
+func (metric *Metric) Delete(context *ctp.ApiContext) *ctp.HttpError {
+	count, err := metricMeasurementCount(context, metric)
 	if err != nil {
 		return ctp.NewInternalServerError(err)
 	}
@@ -97,6 +604,54 @@ func HandlePOSTMetric(w http.ResponseWriter, r *http.Request, context *ctp.ApiCo
 	handler.Handle(w, r, context, &metric)
 }
 
+// HandlePUTMetric serves PUT /metrics/{id}, which updates a metric, and
+// PUT /metrics/{id}?x=version, which creates a new version of it.
+func HandlePUTMetric(w http.ResponseWriter, r *http.Request, context *ctp.ApiContext) {
+	var metric Metric
+	var update Metric
+
+	if context.QueryParam != "version" {
+		handler := ctp.NewPUTHandler(ctp.AdminRoleTag)
+
+		handler.Handle(w, r, context, &metric, &update)
+		return
+	}
+
+	if !context.AuthenticateClient(w, r) {
+		ctp.Log(context, ctp.WARNING, "Missing access tags")
+		return
+	}
+
+	if !context.VerifyAccessTags(w, ctp.AdminRoleTag) {
+		ctp.Log(context, ctp.WARNING, "Mismatched access tags for API signature")
+		return
+	}
+
+	if err := metric.Load(context); err != nil {
+		ctp.RenderErrorResponse(w, context, err)
+		return
+	}
+
+	if !context.VerifyAccessTags(w, metric.AccessTags) {
+		ctp.Log(context, ctp.WARNING, "Mismatched access tags for resource")
+		return
+	}
+
+	if err := ctp.ParseResource(r.Body, &update); err != nil {
+		ctp.RenderErrorResponse(w, context, ctp.NewBadRequestErrorf("Failed to parse resource, %s", err.Error()))
+		return
+	}
+
+	version, err := metricNewVersion(context, &metric, &update)
+	if err != nil {
+		ctp.RenderErrorResponse(w, context, err)
+		return
+	}
+
+	version.AccessTags = nil
+	ctp.RenderJsonResponse(w, context, 201, version)
+}
+
 func HandleDELETEMetric(w http.ResponseWriter, r *http.Request, context *ctp.ApiContext) {
 	var metric Metric
 
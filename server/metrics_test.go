@@ -0,0 +1,348 @@
+package server
+
+import (
+	"github.com/cloudsecurityalliance/ctpd/server/ctp"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func bound(v float64) *float64 {
+	return &v
+}
+
+func TestCheckValue(t *testing.T) {
+	tests := []struct {
+		column ResultColumnFormat
+		cell   interface{}
+		ok     bool
+	}{
+		{ResultColumnFormat{Type: columnNumber}, 1.5, true},
+		{ResultColumnFormat{Type: columnNumber}, "1.5", false},
+		{ResultColumnFormat{Type: columnNumber}, true, false},
+		{ResultColumnFormat{Type: columnInteger}, 3.0, true},
+		{ResultColumnFormat{Type: columnInteger}, -3.0, true},
+		{ResultColumnFormat{Type: columnInteger}, 3.5, false},
+		{ResultColumnFormat{Type: columnInteger}, 1e-9, false},
+		{ResultColumnFormat{Type: columnNumber, Min: bound(0), Max: bound(10)}, 0.0, true},
+		{ResultColumnFormat{Type: columnNumber, Min: bound(0), Max: bound(10)}, 10.0, true},
+		{ResultColumnFormat{Type: columnNumber, Min: bound(0), Max: bound(10)}, -0.1, false},
+		{ResultColumnFormat{Type: columnNumber, Min: bound(0), Max: bound(10)}, 10.1, false},
+		{ResultColumnFormat{Type: columnInteger, Max: bound(5)}, 6.0, false},
+		{ResultColumnFormat{Type: columnDuration, Max: bound(60)}, "PT1M", true},
+		{ResultColumnFormat{Type: columnDuration, Max: bound(60)}, "PT61S", false},
+		{ResultColumnFormat{Type: columnDuration, Min: bound(1)}, "PT0.5S", false},
+		{ResultColumnFormat{Type: columnBoolean}, false, true},
+		{ResultColumnFormat{Type: columnBoolean}, "true", false},
+		{ResultColumnFormat{Type: columnString}, "", true},
+		{ResultColumnFormat{Type: columnString}, 1.0, false},
+		{ResultColumnFormat{Type: columnTimestamp}, "2015-06-01T12:00:00Z", true},
+		{ResultColumnFormat{Type: columnTimestamp}, "2015-06-01T12:00:00+02:00", true},
+		{ResultColumnFormat{Type: columnTimestamp}, "2015-06-01", false},
+		{ResultColumnFormat{Type: columnEnum, Values: []string{"low", "high"}}, "high", true},
+		{ResultColumnFormat{Type: columnEnum, Values: []string{"low", "high"}}, "medium", false},
+		{ResultColumnFormat{Type: columnEnum, Values: []string{"low", "high"}}, "HIGH", false},
+		{ResultColumnFormat{Type: columnNumber}, nil, false},
+		{ResultColumnFormat{Type: columnNumber, Nullable: true}, nil, true},
+		{ResultColumnFormat{Type: columnEnum, Values: []string{"low"}, Nullable: true}, nil, true},
+		{ResultColumnFormat{Type: "float"}, 1.0, false},
+	}
+	for _, test := range tests {
+		err := test.column.checkValue(test.cell)
+		if (err == nil) != test.ok {
+			t.Errorf("checkValue(%v) on %s column returned %v, expected success to be %v", test.cell, test.column.Type, err, test.ok)
+		}
+	}
+}
+
+func TestUpgradeValue(t *testing.T) {
+	tests := []struct {
+		parameter MeasurementParameter
+		value     interface{}
+		optional  bool
+	}{
+		{MeasurementParameter{Type: columnNumber, Value: "2.5"}, 2.5, false},
+		{MeasurementParameter{Type: columnInteger, Value: " 3 "}, 3.0, false},
+		{MeasurementParameter{Type: columnNumber, Value: "many"}, "many", false},
+		{MeasurementParameter{Type: columnBoolean, Value: "true"}, true, false},
+		{MeasurementParameter{Type: columnDuration, Value: "PT1M"}, "PT1M", false},
+		{MeasurementParameter{Type: columnNumber, Value: ""}, nil, true},
+		{MeasurementParameter{Type: columnBoolean, Value: ""}, nil, true},
+		{MeasurementParameter{Type: columnTimestamp, Value: ""}, nil, true},
+		{MeasurementParameter{Type: columnDuration, Value: ""}, nil, true},
+		{MeasurementParameter{Type: columnString, Value: ""}, "", false},
+		{MeasurementParameter{Type: columnNumber, Value: 1.0}, 1.0, false},
+		{MeasurementParameter{Type: columnNumber}, nil, false},
+	}
+	for _, test := range tests {
+		parameter := test.parameter
+		parameter.upgradeValue()
+		if parameter.Value != test.value || parameter.optional != test.optional {
+			t.Errorf("upgradeValue(%#v) on %s parameter returned %#v (optional %v), expected %#v (optional %v)", test.parameter.Value, test.parameter.Type, parameter.Value, parameter.optional, test.value, test.optional)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		duration string
+		seconds  float64
+		ok       bool
+	}{
+		{"PT1M30S", 90, true},
+		{"P1W", 7 * 86400, true},
+		{"P1DT12H", 86400 + 12*3600, true},
+		{"PT0.5S", 0.5, true},
+		{"P0D", 0, true},
+		{"P", 0, false},
+		{"PT", 0, false},
+		{"P1DT", 0, false},
+		{"P1Y", 0, false},
+		{"P1M", 0, false},
+		{"PT1.5M", 0, false},
+		{"1H", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		seconds, err := parseDuration(test.duration)
+		if (err == nil) != test.ok || seconds != test.seconds {
+			t.Errorf("parseDuration(%q) returned %v, %v, expected %v and success to be %v", test.duration, seconds, err, test.seconds, test.ok)
+		}
+	}
+}
+
+func TestResultCheckFormat(t *testing.T) {
+	metric := &Metric{
+		ResultFormat: []ResultColumnFormat{
+			{Name: "count", Type: columnInteger},
+			{Name: "note", Type: columnString, Nullable: true},
+		},
+	}
+	tests := []struct {
+		row      ResultRow
+		problems int
+	}{
+		{ResultRow{"count": 1.0, "note": "ok"}, 0},
+		{ResultRow{"count": 1.0, "note": nil}, 0},
+		{ResultRow{"count": 1.0}, 0},
+		{ResultRow{"count": nil}, 1},
+		{ResultRow{"note": "ok"}, 1},
+		{ResultRow{"count": 1.5, "other": 1.0}, 2},
+		{nil, 1},
+	}
+	for _, test := range tests {
+		err := resultCheckFormat(&Result{Value: []ResultRow{test.row}}, metric)
+		problems := 0
+		if err != nil {
+			problems = len(err.Details()["problems"].([]ResultProblem))
+		}
+		if problems != test.problems {
+			t.Errorf("resultCheckFormat(%v) reported %d problems (%v), expected %d", test.row, problems, err, test.problems)
+		}
+	}
+}
+
+func TestMetricCheck(t *testing.T) {
+	metric := &Metric{
+		MeasurementParameters: []MeasurementParameter{
+			{Name: "threshold", Type: columnNumber, Value: 10.0},
+			{Name: "", Type: columnNumber},
+			{Name: "a.b", Type: columnString},
+			{Name: "threshold", Type: columnNumber},
+			{Name: "level", Type: columnEnum},
+			{Name: "retries", Type: columnInteger, Value: "3"},
+		},
+		ResultFormat: []ResultColumnFormat{
+			{Name: "v", Type: columnNumber, Min: bound(1), Max: bound(0)},
+			{Name: "v", Type: columnNumber},
+			{Name: "", Type: columnNumber},
+			{Name: "flag", Type: columnBoolean, Min: bound(0)},
+			{Name: "kind", Type: columnEnum},
+			{Name: "size", Type: "float"},
+		},
+	}
+	expected := []string{
+		"parameter 1 has no name",
+		"parameter 'a.b'",
+		"parameter 'threshold' is declared twice",
+		"parameter 'level'",
+		"parameter 'retries'",
+		"column 'v': min is greater than max",
+		"column 'v' is described twice",
+		"column 2 has no name",
+		"column 'flag'",
+		"column 'kind'",
+		"column 'size'",
+	}
+
+	err := metricCheck(metric)
+	if err == nil {
+		t.Fatal("metricCheck accepted an invalid metric")
+	}
+	problems := err.Details()["problems"].([]string)
+	if len(problems) != len(expected) {
+		t.Errorf("metricCheck reported %d problems, expected %d: %v", len(problems), len(expected), problems)
+	}
+	for _, prefix := range expected {
+		found := false
+		for _, problem := range problems {
+			if strings.HasPrefix(problem, prefix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("metricCheck did not report %q: %v", prefix, problems)
+		}
+	}
+
+	valid := &Metric{
+		MeasurementParameters: []MeasurementParameter{{Name: "threshold", Type: columnNumber, Value: 10.0}},
+		ResultFormat:          []ResultColumnFormat{{Name: "v", Type: columnEnum, Values: []string{"a"}, Nullable: true}},
+	}
+	if err := metricCheck(valid); err != nil {
+		t.Error("metricCheck rejected a valid metric:", err)
+	}
+}
+
+func TestBoundChange(t *testing.T) {
+	tests := []struct {
+		before, after     *float64
+		sign              float64
+		narrower, changed bool
+	}{
+		{nil, nil, 1, false, false},
+		{bound(1), bound(1), 1, false, false},
+		{nil, bound(1), 1, true, true},
+		{bound(1), nil, 1, false, true},
+		{bound(1), bound(2), 1, true, true},
+		{bound(2), bound(1), 1, false, true},
+		{nil, bound(1), -1, true, true},
+		{bound(1), nil, -1, false, true},
+		{bound(1), bound(2), -1, false, true},
+		{bound(2), bound(1), -1, true, true},
+	}
+	for i, test := range tests {
+		narrower, changed := boundChange(test.before, test.after, test.sign)
+		if narrower != test.narrower || changed != test.changed {
+			t.Errorf("boundChange test %d returned %v, %v, expected %v, %v", i, narrower, changed, test.narrower, test.changed)
+		}
+	}
+}
+
+func TestMetricChanges(t *testing.T) {
+	column := func(nullable bool, values ...string) []ResultColumnFormat {
+		if values == nil {
+			return []ResultColumnFormat{{Name: "v", Type: columnNumber, Nullable: nullable}}
+		}
+		return []ResultColumnFormat{{Name: "v", Type: columnEnum, Nullable: nullable, Values: values}}
+	}
+	parameters := func(names ...string) []MeasurementParameter {
+		var list []MeasurementParameter
+		for _, name := range names {
+			list = append(list, MeasurementParameter{Name: name, Type: columnNumber, Value: 1.0})
+		}
+		return list
+	}
+
+	tests := []struct {
+		name     string
+		before   Metric
+		after    Metric
+		changes  int
+		breaking bool
+	}{
+		{"unchanged", Metric{ResultFormat: column(false)}, Metric{ResultFormat: column(false)}, 0, false},
+		{"made nullable", Metric{ResultFormat: column(false)}, Metric{ResultFormat: column(true)}, 1, false},
+		{"made required", Metric{ResultFormat: column(true)}, Metric{ResultFormat: column(false)}, 1, true},
+		{"enum value added", Metric{ResultFormat: column(false, "a")}, Metric{ResultFormat: column(false, "a", "b")}, 1, false},
+		{"enum value removed", Metric{ResultFormat: column(false, "a", "b")}, Metric{ResultFormat: column(false, "a")}, 1, true},
+		{"enum value replaced", Metric{ResultFormat: column(false, "a")}, Metric{ResultFormat: column(false, "b")}, 2, true},
+		{"type changed", Metric{ResultFormat: column(false)}, Metric{ResultFormat: column(false, "a")}, 1, true},
+		{"parameter added", Metric{MeasurementParameters: parameters("x")}, Metric{MeasurementParameters: parameters("x", "y")}, 1, false},
+		{"required parameter added", Metric{}, Metric{MeasurementParameters: []MeasurementParameter{{Name: "x", Type: columnNumber}}}, 1, true},
+		{"parameter removed", Metric{MeasurementParameters: parameters("x", "y")}, Metric{MeasurementParameters: parameters("y")}, 1, true},
+		{"default changed", Metric{MeasurementParameters: parameters("x")}, Metric{MeasurementParameters: []MeasurementParameter{{Name: "x", Type: columnNumber, Value: 2.0}}}, 1, false},
+		{"annotation changed", Metric{}, Metric{NamedResource: ctp.NamedResource{Annotation: "new"}}, 1, false},
+		{"renamed", Metric{NamedResource: ctp.NamedResource{Name: "a"}}, Metric{NamedResource: ctp.NamedResource{Name: "b"}}, 1, false},
+		{"base metric changed", Metric{BaseMetric: "a"}, Metric{BaseMetric: "b"}, 1, true},
+	}
+	for _, test := range tests {
+		changes := metricChanges(&test.before, &test.after)
+		breaking := len(metricBreakingChanges(changes)) > 0
+		if len(changes) != test.changes || breaking != test.breaking {
+			t.Errorf("%s: metricChanges returned %v, expected %d change(s) with breaking %v", test.name, changes, test.changes, test.breaking)
+		}
+	}
+
+	// the min of a column is narrower when raised, its max when lowered.
+	before := Metric{ResultFormat: []ResultColumnFormat{{Name: "v", Type: columnNumber, Min: bound(0), Max: bound(10)}}}
+	wider := Metric{ResultFormat: []ResultColumnFormat{{Name: "v", Type: columnNumber, Min: bound(-1), Max: bound(11)}}}
+	narrower := Metric{ResultFormat: []ResultColumnFormat{{Name: "v", Type: columnNumber, Min: bound(1), Max: bound(9)}}}
+	if changes := metricChanges(&before, &wider); len(changes) != 2 || len(metricBreakingChanges(changes)) != 0 {
+		t.Error("Widening bounds should be 2 changes that do not break, got", changes)
+	}
+	if changes := metricChanges(&before, &narrower); len(changes) != 2 || len(metricBreakingChanges(changes)) != 2 {
+		t.Error("Narrowing bounds should be 2 breaking changes, got", changes)
+	}
+}
+
+func testMetricContext(t *testing.T) (*ctp.ApiContext, *Metric) {
+	context := &ctp.ApiContext{
+		Configuration: ctp.Configuration{},
+		CtpBase:       "https://localhost/api/1.0/",
+		Storage:       ctp.NewMemoryStorage(),
+	}
+	metric := &Metric{
+		NamedResource: ctp.NamedResource{Resource: ctp.Resource{Id: "metric1"}, Name: "m"},
+		ResultFormat:  []ResultColumnFormat{{Name: "v", Type: columnNumber}},
+	}
+	metric.BuildLinks(context)
+	if !ctp.CreateResource(context, "metrics", metric) {
+		t.Fatal("Could not create metric")
+	}
+	return context, metric
+}
+
+func TestMetricUpdate(t *testing.T) {
+	context, metric := testMetricContext(t)
+
+	renamed := &Metric{NamedResource: ctp.NamedResource{Name: "renamed"}, ResultFormat: []ResultColumnFormat{{Name: "v", Type: columnInteger}}}
+	if err := metric.Update(context, renamed); err != nil {
+		t.Error("Breaking change of an unused metric was rejected:", err)
+	}
+
+	measurement := &Measurement{Metric: "@/metrics/metric1"}
+	measurement.Id = "measurement1"
+	if !ctp.CreateResource(context, "measurements", measurement) {
+		t.Fatal("Could not create measurement")
+	}
+
+	annotated := &Metric{NamedResource: ctp.NamedResource{Name: "used", Annotation: "used"}, ResultFormat: metric.ResultFormat}
+	if err := metric.Update(context, annotated); err != nil {
+		t.Error("Change that does not break a used metric was rejected:", err)
+	}
+	if err := metric.Update(context, &Metric{NamedResource: ctp.NamedResource{Name: "again"}, ResultFormat: []ResultColumnFormat{{Name: "w", Type: columnNumber}}}); err == nil || err.StatusCode() != http.StatusConflict {
+		t.Error("Breaking change of a used metric should fail with 409, got", err)
+	}
+	if metric.Name != "used" || metric.Annotation != "used" || metric.ResultFormat[0].Name != "v" {
+		t.Error("Rejected change was applied to metric:", metric.Name, metric.Annotation)
+	}
+}
+
+func TestMetricNewVersion(t *testing.T) {
+	context, metric := testMetricContext(t)
+
+	up := &Metric{NamedResource: ctp.NamedResource{Name: "m"}, ResultFormat: []ResultColumnFormat{{Name: "w", Type: columnString}}}
+	second, err := metricNewVersion(context, metric, up)
+	if err != nil || second.Version != 2 || *second.PreviousVersion != "@/metrics/metric1" {
+		t.Fatal("First version failed", err, second)
+	}
+	if _, err := metricNewVersion(context, metric, up); err == nil || err.StatusCode() != http.StatusConflict {
+		t.Error("Versioning a metric twice should fail with 409, got", err)
+	}
+	third, err := metricNewVersion(context, second, up)
+	if err != nil || third.Version != 3 {
+		t.Error("Versioning the latest version failed", err, third)
+	}
+}
@@ -0,0 +1,100 @@
+//    Copyright 2015 Cloud Security Alliance EMEA (cloudsecurityalliance.org)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/cloudsecurityalliance/ctpd/server/ctp"
+	"github.com/cloudsecurityalliance/ctpd/server/xmpp"
+	"strconv"
+	"time"
+)
+
+const xmppQueueLength = 256
+
+type xmppNotification struct {
+	to      xmpp.JID
+	subject string
+	body    string
+}
+
+// xmppNotifier delivers notifications from a single goroutine, so that
+// request handlers never wait on the XMPP server. The connection is opened
+// lazily and re-opened after a failure.
+type xmppNotifier struct {
+	config xmpp.Config
+	queue  chan xmppNotification
+	client *xmpp.Client
+}
+
+var notifier *xmppNotifier
+
+func newXmppConfig(conf ctp.Configuration) xmpp.Config {
+	config := xmpp.Config{
+		Server:   conf["xmpp_server"],
+		Jid:      conf["xmpp_jid"],
+		Password: conf["xmpp_password"],
+		UseTLS:   conf["xmpp_tls"] != "no",
+	}
+	if timeout, err := strconv.Atoi(conf["xmpp_timeout"]); err == nil && timeout > 0 {
+		config.Timeout = time.Duration(timeout) * time.Second
+	}
+	return config
+}
+
+func newXmppNotifier(config xmpp.Config) *xmppNotifier {
+	n := &xmppNotifier{
+		config: config,
+		queue:  make(chan xmppNotification, xmppQueueLength),
+	}
+	go n.run()
+	return n
+}
+
+func (n *xmppNotifier) Notify(to xmpp.JID, subject string, body string) bool {
+	select {
+	case n.queue <- xmppNotification{to, subject, body}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n *xmppNotifier) run() {
+	for notification := range n.queue {
+		n.send(notification)
+	}
+}
+
+func (n *xmppNotifier) send(notification xmppNotification) {
+	var err error
+
+	// one retry with a fresh connection, in case the previous one went stale.
+	for attempt := 0; attempt < 2; attempt++ {
+		if n.client == nil {
+			if n.client, err = xmpp.Dial(n.config); err != nil {
+				ctp.Log(nil, ctp.ERROR, "Failed to connect to XMPP server as %s: %s", n.config.Jid, err.Error())
+				return
+			}
+			ctp.Log(nil, ctp.INFO, "Connected to XMPP server as %s", n.client.JID().String())
+		}
+		if err = n.client.Send(notification.to, notification.subject, notification.body); err == nil {
+			ctp.Log(nil, ctp.DEBUG, "Sent XMPP notification to %s", notification.to.String())
+			return
+		}
+		n.client.Close()
+		n.client = nil
+	}
+	ctp.Log(nil, ctp.ERROR, "Failed to send XMPP notification to %s: %s", notification.to.String(), err.Error())
+}
@@ -0,0 +1,307 @@
+//    Copyright 2015 Cloud Security Alliance EMEA (cloudsecurityalliance.org)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/cloudsecurityalliance/ctpd/server/ctp"
+	"github.com/cloudsecurityalliance/ctpd/server/jsmm"
+	"net/http"
+	"strconv"
+)
+
+// A MeasurementResult is a result accepted for a measurement, kept in the
+// "results" collection along with the status of the objective it led to.
+// Its parents are the measurement and the ancestors of the measurement.
+type MeasurementResult struct {
+	ctp.Resource    `bson:",inline"`
+	Result          `bson:",inline"`
+	ObjectiveStatus *ctp.BoolErr `json:"objectiveStatus,omitempty" bson:"objectiveStatus,omitempty"`
+}
+
+// historyEntry is the form of a MeasurementResult in the 'history' global
+// variable of CTPScript. Objective is null if the measurement had no
+// objective or if its evaluation failed.
+type historyEntry struct {
+	Value       []ResultRow `jsmm:"value"`
+	UpdateTime  string      `jsmm:"updateTime"`
+	AuthorityId *string     `jsmm:"authorityId"`
+	Signature   *string     `jsmm:"signature"`
+	Objective   *bool       `jsmm:"objective"`
+}
+
+const defaultHistoryDepth = 10
+
+// historyDepth returns the maximum number of previous results in the
+// 'history' global variable, set by the history_depth configuration entry.
+func historyDepth(conf ctp.Configuration) int {
+	if v, err := strconv.Atoi(conf["history_depth"]); err == nil && v >= 0 {
+		return v
+	}
+	return defaultHistoryDepth
+}
+
+// resultRetention returns the number of seconds the results of a measurement
+// are kept, set by its resultRetention property or else by the
+// result_retention configuration entry. 0 means forever.
+func resultRetention(conf ctp.Configuration, measurement *Measurement) ctp.Duration {
+	if measurement.ResultRetention != nil {
+		return *measurement.ResultRetention
+	}
+	if v, err := strconv.Atoi(conf["result_retention"]); err == nil && v > 0 {
+		return ctp.Duration(v)
+	}
+	return 0
+}
+
+// measurementStoreResult adds the current result of a measurement to its
+// history, and removes the results that fell out of its retention window.
+func measurementStoreResult(context *ctp.ApiContext, measurement *Measurement) bool {
+	stored := &MeasurementResult{Result: *measurement.Result}
+
+	if measurement.ResultId == "" {
+		measurement.ResultId = ctp.NewBase64Id()
+	}
+	stored.Id = measurement.ResultId
+	stored.Parent = append([]ctp.Base64Id{measurement.Id}, measurement.Parent...)
+	stored.AccessTags = measurement.AccessTags
+	if measurement.Objective != nil && measurement.Objective.Status != ctp.Terror {
+		status := measurement.Objective.Status
+		stored.ObjectiveStatus = &status
+	}
+	measurement.history = nil
+	if !ctp.CreateResource(context, "results", stored) {
+		return false
+	}
+	if !measurementPruneResults(context, measurement) {
+		ctp.Log(context, ctp.WARNING, "Could not remove expired results of measurement %s", measurement.Id)
+	}
+	return true
+}
+
+// measurementPruneResults removes the results of a measurement that were
+// updated before its retention window.
+func measurementPruneResults(context *ctp.ApiContext, measurement *Measurement) bool {
+	var item ctp.Resource
+
+	retention := resultRetention(context.Configuration, measurement)
+	if retention == 0 {
+		return true
+	}
+	selector := ctp.Selector{
+		"parent.0":   string(measurement.Id),
+		"updateTime": ctp.Range{Max: ctp.Now() - ctp.Timestamp(retention) - 1},
+	}
+
+	iter := context.Storage.Find("results", selector, "", 0, 0)
+	for iter.Next(&item) {
+		if !resultDelete(context, item.Id) {
+			iter.Close()
+			return false
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return false
+	}
+	measurement.history = nil
+	return true
+}
+
+// measurementHistory returns at most depth results that precede the current
+// result of a measurement, the most recent first. The results are read once
+// per request.
+func measurementHistory(context *ctp.ApiContext, measurement *Measurement, depth int) ([]MeasurementResult, error) {
+	if measurement.history != nil {
+		return measurement.history, nil
+	}
+
+	selector := ctp.Selector{"parent.0": string(measurement.Id)}
+
+	// one more than depth, in case the current result is already stored.
+	history := make([]MeasurementResult, 0, depth+1)
+	iter := context.Storage.Find("results", selector, "-updateTime", 0, depth+1)
+	for {
+		var stored MeasurementResult
+
+		if !iter.Next(&stored) {
+			break
+		}
+		if stored.Id != measurement.ResultId {
+			history = append(history, stored)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	if len(history) > depth {
+		history = history[:depth]
+	}
+
+	measurement.history = history
+	return history, nil
+}
+
+// importMeasurementHistoryInJSMM sets the 'history' global variable, if it is
+// used by the code of the machine.
+func importMeasurementHistoryInJSMM(context *ctp.ApiContext, machine *jsmm.Machine, measurement *Measurement) error {
+	if !machine.UsesGlobal("history") {
+		return nil
+	}
+
+	history, err := measurementHistory(context, measurement, historyDepth(context.Configuration))
+	if err != nil {
+		return err
+	}
+	return ImportResultHistoryInJSMM(machine, history)
+}
+
+// ImportResultHistoryInJSMM sets the 'history' global variable to an array
+// of previous results, the most recent first.
+func ImportResultHistoryInJSMM(machine *jsmm.Machine, history []MeasurementResult) error {
+	entries := make([]historyEntry, len(history))
+	for i, stored := range history {
+		entries[i] = historyEntry{
+			Value:       stored.Value,
+			UpdateTime:  stored.UpdateTime.String(),
+			AuthorityId: stored.AuthorityId,
+			Signature:   stored.Signature,
+		}
+		if stored.ObjectiveStatus != nil {
+			objective := *stored.ObjectiveStatus == ctp.Ttrue
+			entries[i].Objective = &objective
+		}
+	}
+	return jsmm.ImportGlobal(machine, "history", entries)
+}
+
+// measurementResultsDelete removes the history of a measurement.
+func measurementResultsDelete(context *ctp.ApiContext, id ctp.Base64Id) bool {
+	return IterateChildrenDelete(context, "results", "parent.0", string(id), resultDelete)
+}
+
+func resultDelete(context *ctp.ApiContext, id ctp.Base64Id) bool {
+	return ctp.DeleteResource(context, "results", id)
+}
+
+// A ResultCollectionItem is an accepted result of a measurement, along with
+// the status of the objective it led to.
+type ResultCollectionItem struct {
+	Result
+	ObjectiveStatus *ctp.BoolErr `json:"objectiveStatus,omitempty"`
+}
+
+// A ResultCollection lists the results of a measurement, the oldest first.
+type ResultCollection struct {
+	ctp.Resource
+	CollectionLength int                    `json:"collectionLength"`
+	ReturnedLength   int                    `json:"returnedLength"`
+	CollectionType   string                 `json:"collectionType"`
+	Items            []ResultCollectionItem `json:"collection"`
+}
+
+// parseTimeRange returns the bounds on updateTime set by the 'from' and 'to'
+// query parameters.
+func parseTimeRange(r *http.Request) (ctp.Range, *ctp.HttpError) {
+	var bounds ctp.Range
+
+	for _, param := range []string{"from", "to"} {
+		query := r.URL.Query().Get(param)
+		if query == "" {
+			continue
+		}
+		t, err := ctp.ParseTimestamp(query)
+		if err != nil {
+			return bounds, ctp.NewBadRequestErrorf("%s must be a date and time in RFC 3339 format", param)
+		}
+		if param == "from" {
+			bounds.Min = t
+		} else {
+			bounds.Max = t
+		}
+	}
+	return bounds, nil
+}
+
+// HandleGETMeasurementResults serves GET /measurements/{id}/results, with
+// optional 'from' and 'to' bounds on updateTime and the 'page' and 'items'
+// pagination of collections. It is open to the accounts that can read the
+// measurement.
+func HandleGETMeasurementResults(w http.ResponseWriter, r *http.Request, context *ctp.ApiContext) {
+	var measurement Measurement
+	var stored MeasurementResult
+
+	bounds, err := parseTimeRange(r)
+	if err != nil {
+		ctp.RenderErrorResponse(w, context, err)
+		return
+	}
+
+	skip, items, err := parsePagination(r)
+	if err != nil {
+		ctp.RenderErrorResponse(w, context, err)
+		return
+	}
+
+	if !context.AuthenticateClient(w, r) {
+		ctp.Log(context, ctp.WARNING, "Missing access tags")
+		return
+	}
+
+	if !context.VerifyAccessTags(w, ctp.UserRoleTag) {
+		ctp.Log(context, ctp.WARNING, "Mismatched access tags for API signature")
+		return
+	}
+
+	if err := measurement.Load(context); err != nil {
+		ctp.RenderErrorResponse(w, context, err)
+		return
+	}
+
+	if !context.VerifyAccessTags(w, measurement.AccessTags) {
+		ctp.Log(context, ctp.WARNING, "Mismatched access tags for resource")
+		return
+	}
+
+	selector := ctp.Selector{"parent.0": string(measurement.Id)}
+	if bounds.Min != nil || bounds.Max != nil {
+		selector["updateTime"] = bounds
+	}
+
+	count, serr := context.Storage.Count("results", selector)
+	if serr != nil {
+		ctp.RenderErrorResponse(w, context, ctp.NewInternalServerError(serr))
+		return
+	}
+
+	collection := &ResultCollection{
+		CollectionLength: count,
+		CollectionType:   "results",
+		Items:            make([]ResultCollectionItem, 0),
+	}
+	collection.Self = ctp.Link(r.URL.RequestURI())
+	collection.Scope = measurement.Self
+
+	iter := context.Storage.Find("results", selector, "updateTime", skip, items)
+	for iter.Next(&stored) {
+		collection.Items = append(collection.Items, ResultCollectionItem{stored.Result, stored.ObjectiveStatus})
+		stored = MeasurementResult{}
+	}
+	if serr := iter.Close(); serr != nil {
+		ctp.RenderErrorResponse(w, context, ctp.NewInternalServerError(serr))
+		return
+	}
+	collection.ReturnedLength = len(collection.Items)
+
+	ctp.RenderJsonResponse(w, context, 200, collection)
+}
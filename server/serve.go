@@ -17,6 +17,7 @@ package server
 import (
 	"github.com/cloudsecurityalliance/ctpd/server/ctp"
 	"net/http"
+	"sync"
 )
 
 var ctpUrlMap = map[string]ctp.HandlerFunc{
@@ -33,14 +34,16 @@ var ctpUrlMap = map[string]ctp.HandlerFunc{
 	"GET:/attributes/$":                HandleGETAttribute,
 	"GET:/attributes/$/measurements":   HandleGETCollection,
 	"GET:/measurements/$":              HandleGETMeasurement,
+	"GET:/measurements/$/results":      HandleGETMeasurementResults,
 	"GET:/metrics":                     HandleGETCollection,
 	"GET:/metrics/$":                   HandleGETMetric,
 	"GET:/triggers/$":                  HandleGETTrigger,
-	"GET:/dependencies/$":              ctp.HandleNotImplemented,
+	"GET:/dependencies/$":              HandleGETDependency,
+	"GET:/dependencies/$/dependencies": HandleGETCollection,
 	"GET:/logs/$":                      HandleGETLogEntry,
-	"PUT:/measurements/$/?initiate":    HandlePUTMeasurement,
+	"PUT:/measurements/$?state":        HandlePUTMeasurement,
 	"POST:/serviceViews/$/triggers":    HandlePOSTTrigger,
-	"DELETE:/triggers/$":               ctp.HandleNotImplemented,
+	"DELETE:/triggers/$":               HandleDELETETrigger,
 
 	// Unoficial backoffice API
 	"GET:/serviceViews/$?tags":        HandleGETTags,
@@ -53,50 +56,90 @@ var ctpUrlMap = map[string]ctp.HandlerFunc{
 	"PUT:/measurements/$?tags":        HandlePUTTags,
 	"GET:/metrics/$?tags":             HandleGETTags,
 	"PUT:/metrics/$?tags":             HandlePUTTags,
+	"PUT:/metrics/$":                  HandlePUTMetric,
+	"PUT:/metrics/$?version":          HandlePUTMetric,
 	"GET:/accounts/$?tags":          HandleGETTags,
 	"PUT:/accounts/$?tags":          HandlePUTTags,
 	"GET:/triggers/$?tags":            HandleGETTags,
 	"PUT:/triggers/$?tags":            HandlePUTTags,
-	"GET:/dependencies/$?tags":        ctp.HandleNotImplemented,
-	"PUT:/dependencies/$?tags":        ctp.HandleNotImplemented,
+	"GET:/dependencies/$?tags":        HandleGETTags,
+	"PUT:/dependencies/$?tags":        HandlePUTTags,
 	"GET:/logs/$?tags":                HandleGETTags,
 	"PUT:/logs/$?tags":                HandlePUTTags,
+	"GET:/authorities/$?tags":         HandleGETTags,
+	"PUT:/authorities/$?tags":         HandlePUTTags,
 	"PUT:/measurements/$?result":      HandlePUTMeasurement,
 	"PUT:/measurements/$?objective":   HandlePUTMeasurement,
+	"PUT:/measurements/$?retention":   HandlePUTMeasurement,
+	"PUT:/measurements?results":       HandlePUTMeasurementResults,
+	"POST:/measurements/$?evaluate":   HandlePOSTMeasurementEvaluation,
 	"POST:/serviceViews":              HandlePOSTServiceView,
 	"POST:/serviceViews/$/assets":     HandlePOSTAsset,
 	"POST:/assets/$/attributes":       HandlePOSTAttribute,
 	"POST:/attributes/$/measurements": HandlePOSTMeasurement,
 	"POST:/metrics":                   HandlePOSTMetric,
-	"POST:/dependencies":              ctp.HandleNotImplemented,
+	"POST:/dependencies":              HandlePOSTDependency,
 	"DELETE:/serviceViews/$":          HandleDELETEServiceView,
 	"DELETE:/assets/$":                HandleDELETEAsset,
 	"DELETE:/attributes/$":            HandleDELETEAttribute,
 	"DELETE:/measurements/$":          HandleDELETEMeasurement,
 	"DELETE:/metrics/$":               HandleDELETEMetric,
-	"DELETE:/dependencies/$":          ctp.HandleNotImplemented,
+	"DELETE:/dependencies/$":          HandleDELETEDependency,
 	"DELETE:/logs/$":                  ctp.HandleNotImplemented,
 	"GET:/accounts/$":               HandleGETAccount,
 	"POST:/accounts":                HandlePOSTAccount,
 	"GET:/accounts":                 HandleGETCollection,
-	"PUT:/accounts/$":               ctp.HandleNotImplemented,
+	"PUT:/accounts/$":               HandlePUTAccount,
+	"PUT:/accounts/$?name":          HandlePUTAccount,
+	"PUT:/accounts/$?accountTags":   HandlePUTAccount,
+	"PUT:/accounts/$?token":         HandlePUTAccount,
 	"DELETE:/accounts/$":            HandleDELETEAccount,
+	"GET:/authorities":              HandleGETCollection,
+	"GET:/authorities/$":            HandleGETAuthority,
+	"POST:/authorities":             HandlePOSTAuthority,
+	"DELETE:/authorities/$":         HandleDELETEAuthority,
 }
 
 type CtpApiHandlerMux struct {
-	Configuration ctp.Configuration
+	mutex         sync.RWMutex
+	configuration ctp.Configuration
 }
 
 func NewCtpApiHandlerMux(conf ctp.Configuration) *CtpApiHandlerMux {
-	return &CtpApiHandlerMux{conf}
+	if conf["xmpp_use"] == "yes" && notifier == nil {
+		notifier = newXmppNotifier(newXmppConfig(conf))
+	}
+	programCache.Resize(programCacheSize(conf))
+	return &CtpApiHandlerMux{configuration: conf}
 }
 
 var muxRunOnce bool = false
 
-/* TODO: add signal processing (e.g. SIG_HUP) */
+// Configuration returns the configuration used to serve new requests.
+func (mux *CtpApiHandlerMux) Configuration() ctp.Configuration {
+	mux.mutex.RLock()
+	defer mux.mutex.RUnlock()
+	return mux.configuration
+}
+
+// Reconfigure replaces the configuration used to serve new requests, while
+// requests in progress complete with the previous one.
+func (mux *CtpApiHandlerMux) Reconfigure(conf ctp.Configuration) {
+	mux.mutex.Lock()
+	mux.configuration = conf
+	mux.mutex.Unlock()
+
+	hits, misses, size := programCache.Stats()
+	ctp.Log(nil, ctp.INFO, "CTPScript cache: %d hits, %d misses, %d programs", hits, misses, size)
+	programCache.Resize(programCacheSize(conf))
+}
 
 func (mux *CtpApiHandlerMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	context, err := ctp.NewApiContext(r, mux.Configuration)
+	context, err := ctp.NewApiContext(r, mux.Configuration())
+	if err == ctp.ErrDatabaseUnavailable {
+		ctp.RenderErrorResponse(w, context, ctp.NewHttpError(http.StatusServiceUnavailable, "Database is unavailable, try again later"))
+		return
+	}
 	if err != nil {
 		ctp.RenderErrorResponse(w, context, ctp.NewHttpError(500, "Context creation failure"))
 		return
@@ -15,10 +15,12 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"github.com/cloudsecurityalliance/ctpd/server/ctp"
 	"github.com/cloudsecurityalliance/ctpd/server/jsmm"
+	"github.com/cloudsecurityalliance/ctpd/server/xmpp"
 )
 
 type Trigger struct {
@@ -53,22 +55,46 @@ func (trigger *Trigger) Create(context *ctp.ApiContext) *ctp.HttpError {
 		return ctp.NewBadRequestError("Invalid measurement URL")
 	}
 
-	ok, err := triggerCheckCondition(context, trigger, nil)
+	if trigger.Notification != "" {
+		if _, err := xmpp.ParseURI(trigger.Notification); err != nil {
+			return ctp.NewBadRequestErrorf("Invalid notification URI - %s", err.Error())
+		}
+	}
+
+	measurement, err := triggerLoadMeasurement(context, trigger)
 	if err != nil {
 		return ctp.NewBadRequestErrorf("%s", err.Error())
 	}
 
-	if ok {
-		triggerLogAndNotify(context, trigger, nil)
+	ok, err := triggerCheckCondition(context, trigger, measurement)
+	if err != nil {
+		if httpErr, isHttpErr := err.(*ctp.HttpError); isHttpErr {
+			return httpErr
+		}
+		return ctp.NewBadRequestErrorf("%s", err.Error())
 	}
 
+	trigger.Status = ctp.ToBoolErr(ok)
+	trigger.StatusUpdateTime = ctp.Now()
+
 	if !ctp.CreateResource(context, "triggers", trigger) {
 		return ctp.NewHttpError(http.StatusInternalServerError, "Could not save object")
 	}
+
+	if ok {
+		triggerLogAndNotify(context, trigger, measurement.Result, nil)
+	}
 	return nil
 }
 
+// Delete removes a trigger, along with the log entries it created if the
+// 'logs' query parameter is "delete".
 func (trigger *Trigger) Delete(context *ctp.ApiContext) *ctp.HttpError {
+	if context.Query.Get("logs") == "delete" {
+		if !triggerLogsDelete(context, trigger.Id) {
+			return ctp.NewHttpError(http.StatusInternalServerError, "Could not delete logs of trigger")
+		}
+	}
 	if !ctp.DeleteResource(context, "triggers", trigger.Id) {
 		return ctp.NewHttpError(http.StatusInternalServerError, "Could not delete trigger")
 	}
@@ -77,32 +103,76 @@ func (trigger *Trigger) Delete(context *ctp.ApiContext) *ctp.HttpError {
 
 ////////////////////////////////////////////////////////////////////////////
 
-func triggerLogAndNotify(context *ctp.ApiContext, trigger *Trigger, err error) {
-	// TODO: log and notify
+// triggerLogAndNotify records a log entry for a trigger that evaluated to true
+// (err is nil) or failed (err is not nil), and sends the log entry to the
+// XMPP address in trigger.Notification, if any.
+func triggerLogAndNotify(context *ctp.ApiContext, trigger *Trigger, result *Result, err error) {
+	var log *LogEntry
+	var err_log *ctp.HttpError
+
+	if err != nil {
+		log, err_log = CreateErrorLogEntry(context, trigger, err.Error())
+	} else {
+		log, err_log = CreateNormalLogEntry(context, trigger, result, trigger.Tags)
+	}
+	if err_log != nil {
+		ctp.Log(context, ctp.ERROR, "Failed to create log for trigger %s: %s", trigger.Id, err_log.Error())
+		return
+	}
+
+	if trigger.Notification == "" {
+		return
+	}
+	if notifier == nil {
+		ctp.Log(context, ctp.WARNING, "Trigger %s requests a notification to '%s', but XMPP is not configured", trigger.Id, trigger.Notification)
+		return
+	}
+
+	to, err := xmpp.ParseURI(trigger.Notification)
+	if err != nil {
+		ctp.Log(context, ctp.ERROR, "Invalid notification URI '%s' in trigger %s: %s", trigger.Notification, trigger.Id, err.Error())
+		return
+	}
+
+	body, err := json.MarshalIndent(log, "", "  ")
+	if err != nil {
+		ctp.Log(context, ctp.ERROR, "Failed to encode log %s for notification: %s", log.Id, err.Error())
+		return
+	}
+
+	if !notifier.Notify(to, "CTP trigger "+string(trigger.Self), string(body)) {
+		ctp.Log(context, ctp.ERROR, "XMPP notification queue is full, dropping notification of log %s", log.Id)
+	}
+}
+
+func triggerLoadMeasurement(context *ctp.ApiContext, trigger *Trigger) (*Measurement, error) {
+	measurementParams, ok := ctp.ParseLink(context.CtpBase, "@/measurements/$", trigger.Measurement)
+	if !ok {
+		return nil, fmt.Errorf("Measurement URL is incorrect")
+	}
+
+	measurement := new(Measurement)
+	if !ctp.LoadResource(context, "measurements", ctp.Base64Id(measurementParams[0]), measurement) {
+		return nil, fmt.Errorf("Measurement %s does not exist", ctp.ExpandLink(context.CtpBase, trigger.Measurement))
+	}
+	return measurement, nil
 }
 
 func triggerCheckCondition(context *ctp.ApiContext, trigger *Trigger, measurement *Measurement) (bool, error) {
 
     if measurement==nil {
-        measurementParams, ok := ctp.ParseLink(context.CtpBase, "@/measurements/$", trigger.Measurement)
-        if !ok {
-            return false, fmt.Errorf("Measurement URL is incorrect")
-        }
+        var err error
 
-        measurement = new(Measurement)
-        if !ctp.LoadResource(context, "measurements", ctp.Base64Id(measurementParams[0]), measurement) {
-            return false, fmt.Errorf("Measurement %s does not exist", ctp.ExpandLink(context.CtpBase, trigger.Measurement))
+        if measurement, err = triggerLoadMeasurement(context, trigger); err != nil {
+            return false, err
         }
     }
 
-	machine, err := jsmm.Compile(trigger.Condition)
+	machine, err := newMachine(context, trigger.Condition, jsmm.TriggerFunctions)
 	if err != nil {
-		return false, ctp.NewBadRequestErrorf("Error in condition specification - %s", err.Error())
+		return false, scriptErrorf(err, "Error in condition specification - %s", err.Error())
 	}
-
-    if context.DebugVM {
-        machine.DebugMode(true)
-    }
+	machine.SetHostData(measurement)
 
 	if measurement.State != "activated" {
 		return false, nil
@@ -112,13 +182,22 @@ func triggerCheckCondition(context *ctp.ApiContext, trigger *Trigger, measuremen
 		return false, nil
 	}
 
-    if err := importMeasurementResultInJSMM(machine, measurement.Result); err != nil {
+    if err := ImportMeasurementResultInJSMM(machine, measurement.Result); err != nil {
+		return false, err
+	}
+	if err := ImportMeasurementParametersInJSMM(machine, measurement.Parameters); err != nil {
+		return false, err
+	}
+	if err := importMeasurementHistoryInJSMM(context, machine, measurement); err != nil {
 		return false, err
 	}
 
 	v, exception := machine.Execute()
 	if exception != nil {
-		return false, fmt.Errorf("Failed to evaluate condition: %s", exception.Error())
+		if exception.Kind() == jsmm.ExceptionLimit {
+			ctp.Log(context, ctp.WARNING, "Condition evaluation of trigger %s interrupted: %s", trigger.Id, exception.Error())
+		}
+		return false, scriptErrorf(exception, "Failed to evaluate condition: %s", exception.Error())
 	}
 	return v.ToBoolean(), nil
 }
@@ -139,9 +218,18 @@ func HandlePOSTTrigger(w http.ResponseWriter, r *http.Request, context *ctp.ApiC
 	handler.Handle(w, r, context, &trigger)
 }
 
+// HandleDELETETrigger deletes a trigger. The log entries it created are kept,
+// unless the query string contains 'logs=delete'.
 func HandleDELETETrigger(w http.ResponseWriter, r *http.Request, context *ctp.ApiContext) {
 	var trigger Trigger
 
+	switch r.URL.Query().Get("logs") {
+	case "", "keep", "delete":
+	default:
+		ctp.RenderErrorResponse(w, context, ctp.NewBadRequestError("logs must be either 'keep' or 'delete'"))
+		return
+	}
+
 	handler := ctp.NewDELETEHandler(ctp.AdminRoleTag)
 
 	handler.Handle(w, r, context, &trigger)
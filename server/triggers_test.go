@@ -0,0 +1,53 @@
+package server
+
+import (
+	"github.com/cloudsecurityalliance/ctpd/server/ctp"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleDELETETrigger(t *testing.T) {
+	tests := []struct {
+		query string
+		code  int
+		logs  int
+	}{
+		{"", http.StatusNoContent, 1},
+		{"?logs=keep", http.StatusNoContent, 1},
+		{"?logs=delete", http.StatusNoContent, 0},
+		{"?logs=all", http.StatusBadRequest, 1},
+	}
+	for _, test := range tests {
+		context := testBatchContext(t)
+		context.Params = []string{"triggers", "trigger1"}
+
+		account := &ctp.Account{AccountTags: ctp.NewTags("role:admin", "tag:a"), Token: "admin"}
+		account.Id = "account2"
+		if !ctp.CreateResource(context, "accounts", account) {
+			t.Fatal("Could not create account")
+		}
+		trigger := &Trigger{}
+		if !ctp.LoadResource(context, "triggers", "trigger1", trigger) {
+			t.Fatal("Could not load trigger")
+		}
+		trigger.BuildLinks(context)
+		triggerLogAndNotify(context, trigger, nil, nil)
+
+		r := httptest.NewRequest("DELETE", "/triggers/trigger1"+test.query, nil)
+		r.Header.Set("Authorization", "Bearer admin")
+		context.Query = r.URL.Query()
+		w := httptest.NewRecorder()
+
+		HandleDELETETrigger(w, r, context)
+		if w.Code != test.code {
+			t.Errorf("DELETE with query %q returned %d, expected %d: %s", test.query, w.Code, test.code, w.Body.String())
+		}
+		if n, _ := context.Storage.Count("logs", ctp.Selector{}); n != test.logs {
+			t.Errorf("DELETE with query %q left %d logs, expected %d", test.query, n, test.logs)
+		}
+		if n, _ := context.Storage.Count("triggers", ctp.Selector{}); n != 0 && test.code == http.StatusNoContent {
+			t.Errorf("DELETE with query %q did not remove the trigger", test.query)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+//    Copyright 2015 Cloud Security Alliance EMEA (cloudsecurityalliance.org)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package xmpp implements the small subset of XMPP (RFC 6120) needed by ctpd
+// to deliver trigger notifications: stream negotiation with optional
+// STARTTLS, SASL PLAIN authentication, resource binding and sending
+// messages.
+package xmpp
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	nsStream  = "http://etherx.jabber.org/streams"
+	nsClient  = "jabber:client"
+	nsTLS     = "urn:ietf:params:xml:ns:xmpp-tls"
+	nsSASL    = "urn:ietf:params:xml:ns:xmpp-sasl"
+	nsBind    = "urn:ietf:params:xml:ns:xmpp-bind"
+	nsSession = "urn:ietf:params:xml:ns:xmpp-session"
+)
+
+type Config struct {
+	Server    string        // host:port, defaults to the domain of Jid on port 5222
+	Jid       string        // node@domain/resource used to log in
+	Password  string
+	UseTLS    bool          // require STARTTLS
+	TLSConfig *tls.Config   // optional, used when UseTLS is set
+	Timeout   time.Duration // connection and negotiation timeout
+}
+
+type JID struct {
+	Node     string
+	Domain   string
+	Resource string
+}
+
+func ParseJID(s string) (JID, error) {
+	var jid JID
+
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		jid.Resource = s[i+1:]
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '@'); i >= 0 {
+		jid.Node = s[:i]
+		s = s[i+1:]
+	}
+	jid.Domain = s
+	if jid.Domain == "" {
+		return jid, errors.New("JID has no domain part")
+	}
+	return jid, nil
+}
+
+func (jid JID) String() string {
+	s := jid.Domain
+	if jid.Node != "" {
+		s = jid.Node + "@" + s
+	}
+	if jid.Resource != "" {
+		s = s + "/" + jid.Resource
+	}
+	return s
+}
+
+// ParseURI extracts the JID from an xmpp URI of the form
+// xmpp:node@domain/resource (RFC 5122), ignoring any query component.
+func ParseURI(uri string) (JID, error) {
+	if !strings.HasPrefix(uri, "xmpp:") {
+		return JID{}, errors.New("XMPP URI must start with 'xmpp:'")
+	}
+	s := strings.TrimPrefix(uri[len("xmpp:"):], "//")
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		s = s[:i]
+	}
+	return ParseJID(s)
+}
+
+type Client struct {
+	mutex  sync.Mutex
+	conn   net.Conn
+	dec    *xml.Decoder
+	jid    JID
+	closed bool
+	err    error
+}
+
+type streamFeatures struct {
+	XMLName    xml.Name  `xml:"http://etherx.jabber.org/streams features"`
+	StartTLS   *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+	Mechanisms []string  `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanisms>mechanism"`
+	Bind       *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+	Session    *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-session session"`
+}
+
+type iqResult struct {
+	XMLName xml.Name `xml:"iq"`
+	Type    string   `xml:"type,attr"`
+	Id      string   `xml:"id,attr"`
+	Jid     string   `xml:"urn:ietf:params:xml:ns:xmpp-bind bind>jid"`
+}
+
+// Dial connects to an XMPP server and authenticates with the credentials in config.
+// The returned client is ready to send messages.
+func Dial(config Config) (*Client, error) {
+	jid, err := ParseJID(config.Jid)
+	if err != nil {
+		return nil, err
+	}
+	if jid.Node == "" {
+		return nil, errors.New("JID used to log in must have a node part")
+	}
+
+	addr := config.Server
+	if addr == "" {
+		addr = jid.Domain + ":5222"
+	}
+
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c := &Client{conn: conn, jid: jid}
+	if err := c.negotiate(config); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	go c.drain()
+	return c, nil
+}
+
+func (c *Client) negotiate(config Config) error {
+	features, err := c.openStream()
+	if err != nil {
+		return err
+	}
+
+	if config.UseTLS {
+		if features.StartTLS == nil {
+			return errors.New("XMPP server does not support STARTTLS")
+		}
+		if features, err = c.startTLS(config); err != nil {
+			return err
+		}
+	}
+
+	if !hasMechanism(features.Mechanisms, "PLAIN") {
+		return errors.New("XMPP server does not support SASL PLAIN authentication")
+	}
+	if err := c.authenticate(config.Password); err != nil {
+		return err
+	}
+
+	if features, err = c.openStream(); err != nil {
+		return err
+	}
+	if features.Bind == nil {
+		return errors.New("XMPP server does not offer resource binding")
+	}
+	if err := c.bind(); err != nil {
+		return err
+	}
+	if features.Session != nil {
+		if err := c.session(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) openStream() (*streamFeatures, error) {
+	_, err := fmt.Fprintf(c.conn, "<?xml version='1.0'?><stream:stream to='%s' xmlns='%s' xmlns:stream='%s' version='1.0'>",
+		xmlEscape(c.jid.Domain), nsClient, nsStream)
+	if err != nil {
+		return nil, err
+	}
+
+	c.dec = xml.NewDecoder(c.conn)
+	start, err := nextStartElement(c.dec)
+	if err != nil {
+		return nil, err
+	}
+	if start.Name.Space != nsStream || start.Name.Local != "stream" {
+		return nil, fmt.Errorf("Expected an XMPP stream, got <%s>", start.Name.Local)
+	}
+
+	features := new(streamFeatures)
+	start, err = nextStartElement(c.dec)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.dec.DecodeElement(features, &start); err != nil {
+		return nil, err
+	}
+	return features, nil
+}
+
+func (c *Client) startTLS(config Config) (*streamFeatures, error) {
+	if _, err := fmt.Fprintf(c.conn, "<starttls xmlns='%s'/>", nsTLS); err != nil {
+		return nil, err
+	}
+	start, err := nextStartElement(c.dec)
+	if err != nil {
+		return nil, err
+	}
+	if start.Name.Local != "proceed" {
+		return nil, errors.New("XMPP server refused STARTTLS")
+	}
+
+	tlsConfig := config.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = c.jid.Domain
+	}
+	tlsConn := tls.Client(c.conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	c.conn = tlsConn
+	return c.openStream()
+}
+
+func (c *Client) authenticate(password string) error {
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00" + c.jid.Node + "\x00" + password))
+	if _, err := fmt.Fprintf(c.conn, "<auth xmlns='%s' mechanism='PLAIN'>%s</auth>", nsSASL, credentials); err != nil {
+		return err
+	}
+	start, err := nextStartElement(c.dec)
+	if err != nil {
+		return err
+	}
+	if err := c.dec.Skip(); err != nil {
+		return err
+	}
+	if start.Name.Space != nsSASL || start.Name.Local != "success" {
+		return fmt.Errorf("XMPP authentication failed for %s", c.jid.Node+"@"+c.jid.Domain)
+	}
+	return nil
+}
+
+func (c *Client) bind() error {
+	resource := ""
+	if c.jid.Resource != "" {
+		resource = "<resource>" + xmlEscape(c.jid.Resource) + "</resource>"
+	}
+	if _, err := fmt.Fprintf(c.conn, "<iq type='set' id='bind_1'><bind xmlns='%s'>%s</bind></iq>", nsBind, resource); err != nil {
+		return err
+	}
+	result, err := c.readIq()
+	if err != nil {
+		return err
+	}
+	if result.Type != "result" {
+		return errors.New("XMPP resource binding failed")
+	}
+	if result.Jid != "" {
+		if jid, err := ParseJID(result.Jid); err == nil {
+			c.jid = jid
+		}
+	}
+	return nil
+}
+
+func (c *Client) session() error {
+	if _, err := fmt.Fprintf(c.conn, "<iq type='set' id='sess_1'><session xmlns='%s'/></iq>", nsSession); err != nil {
+		return err
+	}
+	result, err := c.readIq()
+	if err != nil {
+		return err
+	}
+	if result.Type != "result" {
+		return errors.New("XMPP session establishment failed")
+	}
+	return nil
+}
+
+func (c *Client) readIq() (*iqResult, error) {
+	result := new(iqResult)
+	start, err := nextStartElement(c.dec)
+	if err != nil {
+		return nil, err
+	}
+	if start.Name.Local != "iq" {
+		return nil, fmt.Errorf("Expected <iq>, got <%s>", start.Name.Local)
+	}
+	if err := c.dec.DecodeElement(result, &start); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// drain reads and discards anything the server sends once the session is
+// established, so that a broken connection is noticed before the next Send.
+func (c *Client) drain() {
+	var err error
+
+	for err == nil {
+		_, err = c.dec.Token()
+	}
+	c.mutex.Lock()
+	c.closed = true
+	if err != io.EOF {
+		c.err = err
+	}
+	c.mutex.Unlock()
+}
+
+// JID returns the full JID bound by the server for this client.
+func (c *Client) JID() JID {
+	return c.jid
+}
+
+// Send delivers a message of type 'normal' to the given JID.
+func (c *Client) Send(to JID, subject string, body string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		if c.err != nil {
+			return c.err
+		}
+		return errors.New("XMPP connection is closed")
+	}
+
+	stanza := "<message to='" + xmlEscape(to.String()) + "' type='normal'>"
+	if subject != "" {
+		stanza += "<subject>" + xmlEscape(subject) + "</subject>"
+	}
+	stanza += "<body>" + xmlEscape(body) + "</body></message>"
+
+	_, err := io.WriteString(c.conn, stanza)
+	return err
+}
+
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.closed {
+		io.WriteString(c.conn, "</stream:stream>")
+		c.closed = true
+	}
+	return c.conn.Close()
+}
+
+//
+// Auxiliary functions
+//
+
+func nextStartElement(dec *xml.Decoder) (xml.StartElement, error) {
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			return t, nil
+		case xml.EndElement:
+			if t.Name.Space == nsStream && t.Name.Local == "stream" {
+				return xml.StartElement{}, errors.New("XMPP stream closed by server")
+			}
+		}
+	}
+}
+
+func hasMechanism(mechanisms []string, name string) bool {
+	for _, m := range mechanisms {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
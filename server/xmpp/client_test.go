@@ -0,0 +1,181 @@
+package xmpp
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+type stubMessage struct {
+	To      string `xml:"to,attr"`
+	Subject string `xml:"subject"`
+	Body    string `xml:"body"`
+}
+
+type stubAuth struct {
+	Mechanism string `xml:"mechanism,attr"`
+	Value     string `xml:",chardata"`
+}
+
+// stubServer is a minimal stand-in XMPP server that accepts a single client
+// authenticating with SASL PLAIN and forwards received messages on a channel.
+type stubServer struct {
+	listener net.Listener
+	user     string
+	password string
+	messages chan stubMessage
+	errors   chan error
+}
+
+func newStubServer(t *testing.T, user, password string) *stubServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen", err)
+	}
+	s := &stubServer{listener, user, password, make(chan stubMessage, 10), make(chan error, 1)}
+	go s.serve()
+	return s
+}
+
+func (s *stubServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *stubServer) Close() {
+	s.listener.Close()
+}
+
+func (s *stubServer) openStream(conn net.Conn, features string) (*xml.Decoder, error) {
+	dec := xml.NewDecoder(conn)
+	start, err := nextStartElement(dec)
+	if err != nil {
+		return nil, err
+	}
+	if start.Name.Local != "stream" {
+		return nil, fmt.Errorf("expected stream, got %s", start.Name.Local)
+	}
+	fmt.Fprintf(conn, "<?xml version='1.0'?><stream:stream from='localhost' id='1' xmlns='jabber:client' xmlns:stream='%s' version='1.0'>", nsStream)
+	fmt.Fprintf(conn, "<stream:features>%s</stream:features>", features)
+	return dec, nil
+}
+
+func (s *stubServer) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	s.errors <- s.session(conn)
+}
+
+func (s *stubServer) session(conn net.Conn) error {
+	var auth stubAuth
+
+	dec, err := s.openStream(conn, "<mechanisms xmlns='"+nsSASL+"'><mechanism>PLAIN</mechanism></mechanisms>")
+	if err != nil {
+		return err
+	}
+
+	start, err := nextStartElement(dec)
+	if err != nil {
+		return err
+	}
+	if err := dec.DecodeElement(&auth, &start); err != nil {
+		return err
+	}
+	credentials, _ := base64.StdEncoding.DecodeString(auth.Value)
+	if auth.Mechanism != "PLAIN" || string(credentials) != "\x00"+s.user+"\x00"+s.password {
+		fmt.Fprintf(conn, "<failure xmlns='%s'><not-authorized/></failure>", nsSASL)
+		return nil
+	}
+	fmt.Fprintf(conn, "<success xmlns='%s'/>", nsSASL)
+
+	if dec, err = s.openStream(conn, "<bind xmlns='"+nsBind+"'/>"); err != nil {
+		return err
+	}
+
+	start, err = nextStartElement(dec)
+	if err != nil {
+		return err
+	}
+	if err := dec.Skip(); err != nil {
+		return err
+	}
+	fmt.Fprintf(conn, "<iq type='result' id='bind_1'><bind xmlns='%s'><jid>%s@localhost/ctpd</jid></bind></iq>", nsBind, s.user)
+
+	for {
+		var message stubMessage
+
+		start, err := nextStartElement(dec)
+		if err != nil {
+			return nil
+		}
+		if start.Name.Local != "message" {
+			return fmt.Errorf("expected message, got %s", start.Name.Local)
+		}
+		if err := dec.DecodeElement(&message, &start); err != nil {
+			return err
+		}
+		s.messages <- message
+	}
+}
+
+func TestParseURI(t *testing.T) {
+	jid, err := ParseURI("xmpp:alerts@example.com/ctp?message")
+	if err != nil {
+		t.Fatal("ParseURI failed", err)
+	}
+	if jid.Node != "alerts" || jid.Domain != "example.com" || jid.Resource != "ctp" {
+		t.Error("Unexpected JID", jid)
+	}
+	if _, err := ParseURI("mailto:alerts@example.com"); err == nil {
+		t.Error("Expected an error for a non xmpp URI")
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	server := newStubServer(t, "ctpd", "secret")
+	defer server.Close()
+
+	client, err := Dial(Config{Server: server.Addr(), Jid: "ctpd@localhost/ctpd", Password: "secret", Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal("Dial failed", err)
+	}
+	defer client.Close()
+
+	if client.JID().String() != "ctpd@localhost/ctpd" {
+		t.Error("Unexpected bound JID", client.JID().String())
+	}
+
+	to, _ := ParseJID("customer@example.com/alerts")
+	if err := client.Send(to, "trigger", `{"self": "http://localhost/logs/1", "a<b": true}`); err != nil {
+		t.Fatal("Send failed", err)
+	}
+
+	select {
+	case message := <-server.messages:
+		if message.To != "customer@example.com/alerts" {
+			t.Error("Unexpected recipient", message.To)
+		}
+		if message.Subject != "trigger" || message.Body != `{"self": "http://localhost/logs/1", "a<b": true}` {
+			t.Error("Unexpected message content", message.Subject, message.Body)
+		}
+	case err := <-server.errors:
+		t.Fatal("Stub server failed", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for message")
+	}
+}
+
+func TestAuthenticationFailure(t *testing.T) {
+	server := newStubServer(t, "ctpd", "secret")
+	defer server.Close()
+
+	_, err := Dial(Config{Server: server.Addr(), Jid: "ctpd@localhost", Password: "wrong", Timeout: 5 * time.Second})
+	if err == nil {
+		t.Fatal("Expected authentication failure")
+	}
+}